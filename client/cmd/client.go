@@ -63,7 +63,7 @@ func discoverAndSelectServer() string {
 	}
 	
 	// Let user select from discovered servers
-	selectedAddress, err := connection.SelectServer(servers)
+	selected, err := connection.SelectServer(servers)
 	if err != nil {
 		if err.Error() == "manual_entry_requested" {
 			return promptForManualServerAddress()
@@ -72,12 +72,59 @@ func discoverAndSelectServer() string {
 		return promptForManualServerAddress()
 	}
 	
-	return selectedAddress
+	if selected.TLS {
+		connection.EnableTLS(*acceptNewFingerprint)
+	}
+	return selected.Address
 }
 
+var (
+	useTLS               = flag.Bool("tls", false, "Connect to the server over TLS")
+	acceptNewFingerprint = flag.Bool("accept-new-fingerprint", false, "Trust a server whose TLS certificate changed since it was pinned")
+)
+
 func main() {
 	serverAddr := flag.String("server", "", "Server address in format host:port")
+	limit := flag.String("limit", "", "Default bandwidth limit of each transfer per second, e.g. 2MB")
+	maxTransfers := flag.Int("max-transfers", connection.DefaultMaxTransfers, "How many sends run at once; the rest wait in a queue (0 for no limit)")
+	compress := flag.String("compress", "flate", "Compression for data that is not compressed already: flate, gzip or off")
+	maxFolderSize := flag.String("max-folder-size", "64GB", "Largest folder to accept, e.g. 10GB (0 for no limit)")
+	maxFolderEntries := flag.Int("max-folder-entries", connection.DefaultMaxFolderEntries, "Most files, directories and links a received folder may have (0 for no limit)")
+	symlinks := flag.String("symlinks", "skip", "What to do with symlinks in received folders: skip, keep (only those leading inside the folder) or refuse")
+	onCollision := flag.String("on-collision", "rename", "What to do when a received file or folder has the name of one you have: rename, skip, overwrite or ask")
 	flag.Parse()
+
+	connection.SetMaxTransfers(*maxTransfers)
+
+	if err := connection.SetCompression(*compress); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Invalid compression:"), err)
+		return
+	}
+
+	connection.SetMaxFolderEntries(*maxFolderEntries)
+	if err := connection.SetMaxFolderSize(*maxFolderSize); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Invalid folder size limit:"), err)
+		return
+	}
+	if err := connection.SetSymlinkPolicy(*symlinks); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Invalid symlink policy:"), err)
+		return
+	}
+	if err := connection.SetCollisionPolicy(*onCollision); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Invalid collision policy:"), err)
+		return
+	}
+
+	if *limit != "" {
+		if err := connection.SetDefaultRateLimit(*limit); err != nil {
+			fmt.Println(utils.ErrorColor("❌ Invalid bandwidth limit:"), err)
+			return
+		}
+	}
+
+	if *useTLS {
+		connection.EnableTLS(*acceptNewFingerprint)
+	}
 	
 	utils.PrintBanner()
 	
@@ -110,39 +157,23 @@ func main() {
 	
 	conn, err := connection.Connect(address)
 	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
-			return
-		}
+		fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
+		return
 	}
 
 	defer connection.Close(conn)
 
-	fmt.Println(utils.InfoColor("Please login to continue:"))
-	err = connection.UserInput("Username", conn)
-	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
-			return
-		}
+	if err := connection.Handshake(conn); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Handshake with server failed:"), err)
+		return
 	}
 
-
-	err = connection.UserInput("Store File Path", conn)
-	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error setting file path:"), err)
-			return
-		}
+	fmt.Println(utils.InfoColor("Please login to continue:"))
+	if err := connection.Login(conn); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
+		return
 	}
 
-startChat:
 	fmt.Println(utils.HeaderColor("\n✨ Welcome to DrizLink - P2P File Sharing! ✨"))
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
 	fmt.Println(utils.SuccessColor("✅ Successfully connected to server!"))
@@ -0,0 +1,205 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// autoAcceptFile keeps the auto-accept rules of every server we use, since
+// user and room IDs only mean something on the server that issued them
+const autoAcceptFile = "auto_accept.json"
+
+// AutoAcceptRules decide which offers start without asking
+type AutoAcceptRules struct {
+	Senders []string `json:"senders,omitempty"`  // user IDs whose offers are always accepted
+	Rooms   []string `json:"rooms,omitempty"`    // rooms whose files are always accepted
+	MaxSize int64    `json:"max_size,omitempty"` // offers up to this size are accepted from anyone; 0 turns it off
+}
+
+var autoAcceptMutex sync.Mutex
+
+func loadAutoAccept() (map[string]*AutoAcceptRules, error) {
+	rules := make(map[string]*AutoAcceptRules)
+
+	dir, err := helper.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, autoAcceptFile))
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func saveAutoAccept(rules map[string]*AutoAcceptRules) error {
+	dir, err := helper.ConfigDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, autoAcceptFile), data, 0600)
+}
+
+// serverAutoAccept returns the rules for the server we are connected to
+func serverAutoAccept() *AutoAcceptRules {
+	autoAcceptMutex.Lock()
+	defer autoAcceptMutex.Unlock()
+
+	all, err := loadAutoAccept()
+	if err != nil || all[serverAddress] == nil {
+		return &AutoAcceptRules{}
+	}
+	return all[serverAddress]
+}
+
+// updateAutoAccept changes the rules for the server we are connected to
+func updateAutoAccept(change func(rules *AutoAcceptRules)) error {
+	autoAcceptMutex.Lock()
+	defer autoAcceptMutex.Unlock()
+
+	all, err := loadAutoAccept()
+	if err != nil {
+		return err
+	}
+	rules := all[serverAddress]
+	if rules == nil {
+		rules = &AutoAcceptRules{}
+		all[serverAddress] = rules
+	}
+	change(rules)
+	return saveAutoAccept(all)
+}
+
+// autoAcceptReason returns why an offer may start without asking, or "" if
+// the user has to decide
+func autoAcceptReason(offer *IncomingOffer) string {
+	if takeExpectedDownload(offer) {
+		return "you requested it"
+	}
+
+	rules := serverAutoAccept()
+	if containsString(rules.Senders, offer.SenderId) {
+		return "trusted sender"
+	}
+	if offer.RoomID != "" && containsString(rules.Rooms, offer.RoomID) {
+		return "trusted room"
+	}
+	if rules.MaxSize > 0 && offer.Size <= rules.MaxSize {
+		return "under " + formatSize(rules.MaxSize)
+	}
+	return ""
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, value string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != value {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// HandleAutoAccept handles "/autoaccept", which lists the rules, and
+// "/autoaccept user|room <id>", "/autoaccept size <limit>" and
+// "/autoaccept remove user|room <id>", which change them
+func HandleAutoAccept(args []string) {
+	usage := func() {
+		fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /autoaccept [user <userId> | room <roomId> | size <limit> | remove user|room <id>]"))
+	}
+
+	if len(args) == 0 {
+		printAutoAccept(serverAutoAccept())
+		return
+	}
+
+	var change func(rules *AutoAcceptRules)
+	var done string
+	switch {
+	case len(args) == 2 && args[0] == "user":
+		change = func(rules *AutoAcceptRules) {
+			if !containsString(rules.Senders, args[1]) {
+				rules.Senders = append(rules.Senders, args[1])
+			}
+		}
+		done = "Files from user " + args[1] + " are now accepted automatically"
+	case len(args) == 2 && args[0] == "room":
+		change = func(rules *AutoAcceptRules) {
+			if !containsString(rules.Rooms, args[1]) {
+				rules.Rooms = append(rules.Rooms, args[1])
+			}
+		}
+		done = "Files sent to room " + args[1] + " are now accepted automatically"
+	case len(args) == 2 && args[0] == "size":
+		limit, err := helper.ParseSize(args[1])
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Invalid size limit:"), err)
+			return
+		}
+		change = func(rules *AutoAcceptRules) { rules.MaxSize = limit }
+		done = "Files up to " + formatSize(limit) + " are now accepted automatically"
+		if limit == 0 {
+			done = "Files are no longer accepted automatically because of their size"
+		}
+	case len(args) == 3 && args[0] == "remove" && (args[1] == "user" || args[1] == "room"):
+		change = func(rules *AutoAcceptRules) {
+			if args[1] == "user" {
+				rules.Senders = removeString(rules.Senders, args[2])
+			} else {
+				rules.Rooms = removeString(rules.Rooms, args[2])
+			}
+		}
+		done = "Removed the auto-accept rule for " + args[1] + " " + args[2]
+	default:
+		usage()
+		return
+	}
+
+	if err := updateAutoAccept(change); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error saving auto-accept rules:"), err)
+		return
+	}
+	fmt.Println(utils.SuccessColor("✅ " + done))
+}
+
+func printAutoAccept(rules *AutoAcceptRules) {
+	fmt.Println(utils.HeaderColor("📨 Auto-accept rules for this server:"))
+	if len(rules.Senders) == 0 && len(rules.Rooms) == 0 && rules.MaxSize == 0 {
+		fmt.Println(utils.InfoColor("  None, every incoming file asks for /accept"))
+		return
+	}
+	if len(rules.Senders) > 0 {
+		fmt.Printf("  Users: %s\n", utils.UserColor(strings.Join(rules.Senders, ", ")))
+	}
+	if len(rules.Rooms) > 0 {
+		fmt.Printf("  Rooms: %s\n", utils.InfoColor(strings.Join(rules.Rooms, ", ")))
+	}
+	if rules.MaxSize > 0 {
+		fmt.Printf("  Any file up to: %s\n", utils.InfoColor(formatSize(rules.MaxSize)))
+	}
+}
@@ -0,0 +1,210 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"time"
+)
+
+// HashChunks builds the manifest of file when the recipient can verify
+// chunks, leaving file at the start. The recipient checks each chunk as it
+// arrives, so the manifest has to go ahead of the data and costs a read of
+// the file of its own before it is sent. The checksum of the whole file is
+// not computed here but as the data is sent, see SendChecksum.
+func HashChunks(file io.ReadSeeker, size int64) (*protocol.Manifest, error) {
+	if !ServerSupports(protocol.FeatureChunks) {
+		return nil, nil
+	}
+	manifest, err := protocol.BuildManifest(file, size)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// SendChecksum ends the stream with the checksum of everything sent, which
+// digest computed on the way, and returns it as offers carry it
+func SendChecksum(stream io.Writer, digest hash.Hash) (string, error) {
+	sum := digest.Sum(nil)
+	if err := protocol.WriteStreamChecksum(stream, sum); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// ReceiveChecksum returns the checksum the data is verified against: the
+// one that follows it on the stream, or the one in the offer of a sender
+// that computed it before sending
+func ReceiveChecksum(stream io.Reader, offered string) (string, error) {
+	if offered != protocol.ChecksumFollows {
+		return offered, nil
+	}
+	return protocol.ReadStreamChecksum(stream)
+}
+
+// SendManifest writes the chunk hashes of the file to the stream ahead of
+// its data
+func SendManifest(stream io.Writer, manifest *protocol.Manifest) error {
+	if manifest == nil {
+		return nil
+	}
+	return protocol.WriteManifest(stream, manifest)
+}
+
+// ReceiveManifest reads the chunk hashes the sender put ahead of the data
+func ReceiveManifest(stream io.Reader, size int64) (*protocol.Manifest, error) {
+	if !ServerSupports(protocol.FeatureChunks) {
+		return nil, nil
+	}
+	return protocol.ReadManifest(stream, size)
+}
+
+// verifyingWriter returns w, also feeding a chunk verifier when the sender
+// sent a manifest. offset is where the data written to w starts.
+func verifyingWriter(w io.Writer, manifest *protocol.Manifest, offset int64) (io.Writer, *protocol.ChunkVerifier) {
+	if manifest == nil {
+		return w, nil
+	}
+	verifier := manifest.NewVerifier(offset)
+	return io.MultiWriter(w, verifier), verifier
+}
+
+// fillDamaged lets data sent as it is read past frames damaged on the way,
+// as zeros the chunk verifier then reports, rather than ending the transfer.
+// Compressed or delta data cannot be followed past a damaged frame; for it
+// skipDamaged gives up on the rest instead.
+func fillDamaged(readers []io.Reader, manifest *protocol.Manifest, transfer *Transfer) {
+	if manifest == nil || transfer.Compression != "" {
+		return
+	}
+	for _, reader := range readers {
+		if sealed, ok := reader.(*protocol.SealedReader); ok {
+			sealed.FillDamaged(true)
+		}
+	}
+}
+
+// skipDamaged recovers from a frame of the data on stream that failed
+// authentication, for data up to end: the rest of it is skipped and every
+// chunk from the one the frame fell in is reported as corrupt, to be sent
+// again. It reports whether the transfer can go on.
+func skipDamaged(err error, stream io.Reader, verifier *protocol.ChunkVerifier, end int64) bool {
+	sealed, ok := stream.(*protocol.SealedReader)
+	if !ok || verifier == nil || !errors.Is(err, protocol.ErrTampered) {
+		return false
+	}
+	if sealed.Skip() != nil {
+		return false
+	}
+	verifier.Abandon(end)
+	return true
+}
+
+// ServeResends sends the chunks the recipient asks for again, until it
+// reports that every chunk arrived intact. Its requests come back on the
+// data connection, which the relay forwards in both directions. An
+// encrypted stream first marks the end of the data, so a recipient that
+// lost track of it after a damaged frame knows where the resends start.
+func ServeResends(dataConn net.Conn, stream io.Writer, token string, file io.ReadSeeker, manifest *protocol.Manifest) error {
+	if manifest == nil {
+		return nil
+	}
+	if sealed, ok := stream.(*protocol.SealedWriter); ok {
+		if err := sealed.EndData(); err != nil {
+			return err
+		}
+	}
+	defer dataConn.SetReadDeadline(time.Time{})
+
+	for round := 0; ; round++ {
+		dataConn.SetReadDeadline(time.Now().Add(pairTimeout))
+		frame, err := protocol.ReadFrame(dataConn)
+		if err != nil {
+			return fmt.Errorf("recipient never confirmed the chunks it received: %v", err)
+		}
+		request, err := protocol.ParseResendRequest(string(frame.Payload))
+		if err != nil {
+			return err
+		}
+		if request.Token != token {
+			return fmt.Errorf("resend request for another transfer: %s", request.Token)
+		}
+
+		if len(request.Chunks) == 0 {
+			return nil
+		}
+		if round == protocol.MaxResendRounds {
+			return fmt.Errorf("%d chunks still corrupt after %d retries", len(request.Chunks), round)
+		}
+
+		fmt.Printf("\n%s Sending %d corrupted chunk(s) again\n", utils.WarningColor("🔁"), len(request.Chunks))
+		for _, index := range request.Chunks {
+			if index >= manifest.Chunks() {
+				return fmt.Errorf("recipient asked for chunk %d of %d", index, manifest.Chunks())
+			}
+			if _, err := file.Seek(manifest.ChunkOffset(index), io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(stream, file, manifest.ChunkLength(index)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RepairChunks asks the sender again for every chunk that failed
+// verification and writes the new copies in place. If chunks are still
+// corrupt after the last round the partial file is cut before the first of
+// them, so only verified data is kept for a later resume. On an encrypted
+// stream the chunks sent again may be damaged as well; they are verified
+// like the others.
+func RepairChunks(dataConn net.Conn, token string, stream io.Reader, partial *PartialFile, manifest *protocol.Manifest, corrupt []int) error {
+	if manifest == nil {
+		return nil
+	}
+	if sealed, ok := stream.(*protocol.SealedReader); ok {
+		if err := sealed.EndData(); err != nil {
+			return err
+		}
+		sealed.FillDamaged(true)
+	}
+
+	for round := 0; ; round++ {
+		if err := protocol.SendCommand(dataConn, protocol.ResendRequest{Token: token, Chunks: corrupt}.Encode()); err != nil {
+			return err
+		}
+		if len(corrupt) == 0 {
+			return nil
+		}
+		if round == protocol.MaxResendRounds {
+			partial.Truncate(manifest.ChunkOffset(corrupt[0]))
+			return fmt.Errorf("%d chunks still corrupt after %d retries", len(corrupt), round)
+		}
+
+		fmt.Printf("\n%s %d chunk(s) failed verification, asking for them again\n", utils.WarningColor("🔁"), len(corrupt))
+		var stillCorrupt []int
+		for _, index := range corrupt {
+			data := make([]byte, manifest.ChunkLength(index))
+			if _, err := io.ReadFull(stream, data); err != nil {
+				return err
+			}
+			if !manifest.VerifyChunk(index, data) {
+				stillCorrupt = append(stillCorrupt, index)
+				continue
+			}
+			if err := partial.repairAt(data, manifest.ChunkOffset(index)); err != nil {
+				return err
+			}
+		}
+		corrupt = stillCorrupt
+	}
+}
@@ -0,0 +1,188 @@
+package connection
+
+import (
+	"bytes"
+	"drizlink/protocol"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// minCompressSize is the smallest file worth compressing
+const minCompressSize = 1024
+
+// compression is what we compress the data we send with if it looks
+// compressible; "" sends everything as it is
+var compression = protocol.CompressFlate
+
+// SetCompression sets the compression we offer, e.g. from the -compress flag
+func SetCompression(value string) error {
+	switch strings.ToLower(value) {
+	case "off", "none":
+		compression = ""
+		return nil
+	}
+	if err := protocol.CheckCompression(strings.ToLower(value)); err != nil {
+		return err
+	}
+	compression = strings.ToLower(value)
+	return nil
+}
+
+// compressedExtensions are the file types whose contents are compressed
+// already, so compressing them again only costs time
+var compressedExtensions = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jar": true, ".apk": true, ".whl": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".epub": true,
+	".woff": true, ".woff2": true, ".dmg": true,
+}
+
+// compressedSignatures are the leading bytes of formats that are compressed
+// already, for files whose name does not give them away
+var compressedSignatures = [][]byte{
+	[]byte("PK\x03\x04"),         // zip and everything built on it
+	[]byte("\x1f\x8b"),           // gzip
+	[]byte("BZh"),                // bzip2
+	[]byte("\xfd7zXZ\x00"),       // xz
+	[]byte("\x28\xb5\x2f\xfd"),   // zstd
+	[]byte("7z\xbc\xaf\x27\x1c"), // 7-zip
+	[]byte("Rar!"),               // rar
+	[]byte("\x89PNG"),            // png
+	[]byte("\xff\xd8\xff"),       // jpeg
+	[]byte("GIF8"),               // gif
+	[]byte("OggS"),               // ogg
+	[]byte("fLaC"),               // flac
+	[]byte("ID3"),                // mp3
+	[]byte("\x1a\x45\xdf\xa3"),   // matroska and webm
+}
+
+// looksCompressed tells from a file's name and first bytes whether its
+// contents are compressed already
+func looksCompressed(name string, head []byte) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(name))] {
+		return true
+	}
+	for _, signature := range compressedSignatures {
+		if bytes.HasPrefix(head, signature) {
+			return true
+		}
+	}
+	// mp4, mov and heic name their brand after the box size; webp is a RIFF
+	return len(head) >= 12 && (string(head[4:8]) == "ftyp" ||
+		string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP")
+}
+
+// fileCompression returns the compression to send a file with, or "" if
+// the server cannot negotiate it or the file would not get any smaller
+func fileCompression(file io.ReaderAt, name string, size int64) string {
+	if compression == "" || !ServerSupports(protocol.FeatureCompression) || size < minCompressSize {
+		return ""
+	}
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	if looksCompressed(name, head[:n]) {
+		return ""
+	}
+	return compression
+}
+
+// folderCompression returns the compression to send a folder with. The
+// folder is compressed unless most of its bytes are compressed already.
+func folderCompression(folder *folderReader) string {
+	if compression == "" || !ServerSupports(protocol.FeatureCompression) || folder.Size() < minCompressSize {
+		return ""
+	}
+	var compressed int64
+	for _, entry := range folder.entries {
+		if compressedExtensions[strings.ToLower(filepath.Ext(entry.Path))] {
+			compressed += entry.Size
+		}
+	}
+	if compressed*2 > folder.Size() {
+		return ""
+	}
+	return compression
+}
+
+// wireWriter counts the bytes of a transfer's data as they go on the wire
+type wireWriter struct {
+	writer   io.Writer
+	transfer *Transfer
+}
+
+func (w *wireWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.AddInt64(&w.transfer.WireBytes, int64(n))
+	return n, err
+}
+
+// wireReader counts the bytes of a transfer's data as they come off the wire
+type wireReader struct {
+	reader   protocol.CompressedReader
+	transfer *Transfer
+}
+
+func (r *wireReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.transfer.WireBytes, int64(n))
+	return n, err
+}
+
+func (r *wireReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		atomic.AddInt64(&r.transfer.WireBytes, 1)
+	}
+	return b, err
+}
+
+// compressData returns the writer the data of a transfer goes through on its
+// way to stream. Close it once the data is written; stream stays open for
+// the chunks the recipient may ask for again, which are never compressed.
+func compressData(stream io.Writer, transfer *Transfer) (io.WriteCloser, error) {
+	wire := &wireWriter{writer: stream, transfer: transfer}
+	if transfer.Compression == "" {
+		return nopWriteCloser{wire}, nil
+	}
+	return protocol.NewCompressor(wire, transfer.Compression)
+}
+
+// decompressData returns the reader of the data of a transfer arriving on
+// stream, which must be one OpenReceiver or OpenStreams returned
+func decompressData(stream io.Reader, transfer *Transfer) (io.Reader, error) {
+	reader, ok := stream.(protocol.CompressedReader)
+	if !ok {
+		return nil, errors.New("data stream cannot be read a byte at a time")
+	}
+	wire := &wireReader{reader: reader, transfer: transfer}
+	if transfer.Compression == "" {
+		return wire, nil
+	}
+	return protocol.NewDecompressor(wire, transfer.Compression)
+}
+
+// finishData reads the end of the compressed data once all of it was read
+func finishData(data io.Reader, transfer *Transfer) error {
+	if transfer.Compression == "" {
+		return nil
+	}
+	return protocol.FinishDecompressing(data)
+}
+
+// formatWire describes how many bytes of a transfer went over the network
+// for how many it moved
+func formatWire(transfer *Transfer, moved int64) string {
+	wire := atomic.LoadInt64(&transfer.WireBytes)
+	text := fmt.Sprintf("%s on the wire for %s", formatSize(wire), formatSize(moved))
+	if transfer.Compression != "" {
+		text += ", " + transfer.Compression + " compressed"
+	}
+	return text
+}
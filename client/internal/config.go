@@ -0,0 +1,52 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/helper"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadAddressBook reads a file in the config directory made of
+// "<server address> <value>" lines
+func loadAddressBook(name string) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	dir, err := helper.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) == 2 {
+			entries[fields[0]] = fields[1]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// saveAddressBook writes the entries back; only we may read them
+func saveAddressBook(name string, entries map[string]string) error {
+	dir, err := helper.ConfigDir()
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	for address, value := range entries {
+		sb.WriteString(address + " " + value + "\n")
+	}
+	return os.WriteFile(filepath.Join(dir, name), []byte(sb.String()), 0600)
+}
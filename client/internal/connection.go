@@ -2,6 +2,7 @@ package connection
 
 import (
 	"bufio"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"errors"
 	"fmt"
@@ -17,13 +18,15 @@ var (
 	currentRoomID   string
 	currentRoomName string
 	myUserID        string
+	myStorePath     string
 )
 
 func Connect(address string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", address)
+	conn, err := dialServer(address)
 	if err != nil {
 		return nil, err
 	}
+	serverAddress = address
 	return conn, nil
 }
 
@@ -31,119 +34,106 @@ func Close(conn net.Conn) {
 	conn.Close()
 }
 
-func UserInput(attribute string, conn net.Conn) error {
-	// First check if we get a reconnection signal
-	buffer := make([]byte, 1024)
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	n, err := conn.Read(buffer)
-	conn.SetReadDeadline(time.Time{}) // Reset read deadline
-
-	if err == nil && n > 0 {
-		message := string(buffer[:n])
-		if strings.HasPrefix(message, "/RECONNECT") {
-			parts := strings.SplitN(message, " ", 4)
-			if len(parts) == 3 {
-				fmt.Printf("Welcome back %s!\n", parts[1])
-				return errors.New("reconnect")
-			}
-		}
-	}
-
-	// If no reconnection signal, proceed with normal user input
-	reader := bufio.NewReader(os.Stdin)
-
-	fmt.Println("Enter your " + attribute + ": ")
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-
-	// If it's a store file path, validate it
-	if attribute == "Store File Path" {
-		for {
-			// Check if path exists
-			if _, err := os.Stat(input); os.IsNotExist(err) {
-				fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist"))
-				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-				continue
-			}
-
-			// Check if it's a directory
-			fileInfo, err := os.Stat(input)
-			if err != nil || !fileInfo.IsDir() {
-				fmt.Println(utils.ErrorColor("❌ Error: Path is not a directory"))
-				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-				continue
-			}
-
-			break
-		}
-	}
-
-	_, err = conn.Write([]byte(input))
-	if err != nil {
-		fmt.Println("error in write " + attribute)
-		panic(err)
-	}
-
-	return nil
-}
-
 func ReadLoop(conn net.Conn) {
-	reader := bufio.NewReader(conn)
 	for {
-		message, err := reader.ReadString('\n')
+		frame, err := protocol.ReadFrame(conn)
 		if err != nil {
 			fmt.Println(utils.ErrorColor("❌ Connection lost:"), err)
 			return
 		}
-		message = strings.TrimSpace(message)
+
+		switch frame.Type {
+		case protocol.FrameData:
+			// Transfer bytes never travel on the control connection
+			continue
+		case protocol.FrameChat:
+			printChatMessage(string(frame.Payload))
+			continue
+		}
+
+		message := strings.TrimSpace(string(frame.Payload))
 		switch {
-		case strings.HasPrefix(message, "/USERID"):
-			parts := strings.SplitN(message, " ", 2)
-			if len(parts) == 2 {
-				myUserID = strings.TrimSpace(parts[1])
-				fmt.Println(utils.SuccessColor("[Info] Your user ID is: "), utils.CommandColor(myUserID))
+		case strings.HasPrefix(message, "/FILE_RESPONSE"), strings.HasPrefix(message, "/FOLDER_RESPONSE"):
+			transferType := FileTransfer
+			if strings.HasPrefix(message, "/FOLDER_RESPONSE") {
+				transferType = FolderTransfer
+			}
+			offer, err := ParseOffer(message, transferType)
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Invalid transfer offer:"), err)
+				continue
 			}
+			HandleOffer(conn, offer)
 			continue
-		case strings.HasPrefix(message, "/FILE_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 File transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
+		case strings.HasPrefix(message, "/TRANSFER_ACCEPT"), strings.HasPrefix(message, "/TRANSFER_DECLINE"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use:"), args[0], "<token>")
 				continue
 			}
-			recipientId := args[1]
-			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-			storeFilePath := args[4]
+			HandleTransferAnswer(args[1], args[0] == "/TRANSFER_ACCEPT")
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_PATH"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /TRANSFER_PATH <token> <direct|relay>"))
+				continue
+			}
+			HandleTransferPath(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/QUEUED_MESSAGE"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 {
+				continue
+			}
+			sent, err := strconv.ParseInt(args[1], 10, 64)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid fileSize. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
 				continue
 			}
-
-			HandleFileTransfer(reader, recipientId, fileName, int64(fileSize), storeFilePath)
+			fmt.Print(utils.InfoColor(time.Unix(sent, 0).Format("[2006-01-02 15:04] ")))
+			printChatMessage(args[2])
 			continue
-		case strings.HasPrefix(message, "/FOLDER_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 Folder transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+		case strings.HasPrefix(message, "/TRANSFER_KEY"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /TRANSFER_KEY <token> <publicKey>"))
 				continue
 			}
-			recipientId := args[1]
-			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-			storeFilePath := args[4]
+			HandleTransferKey(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_PAUSE"), strings.HasPrefix(message, "/TRANSFER_RESUME"),
+			strings.HasPrefix(message, "/TRANSFER_CANCEL"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use:"), args[0], "<userId> <token>")
+				continue
+			}
+			HandleTransferSignal(args[0], args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_OFFSET"):
+			offer, err := protocol.ParseResumeOffer(message)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid folderSize. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /TRANSFER_OFFSET <token> <offset> <proof>"))
+				continue
+			}
+			HandleTransferOffset(offer)
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_READY"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /TRANSFER_READY <transferId> <token>"))
+				continue
+			}
+			deliverTransferReply(args[1], transferReply{Token: args[2]})
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_FAILED"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 {
 				continue
 			}
-			HandleFolderTransfer(reader, recipientId, folderName, folderSize, storeFilePath)
+			if !deliverTransferReply(args[1], transferReply{Err: errors.New(args[2])}) {
+				fmt.Println(utils.ErrorColor("❌ Transfer "+args[1]+" failed:"), args[2])
+			}
 			continue
 		case strings.HasPrefix(message, "ONLINE_USERS_LIST"):
 			// Handle online users list for room creation
@@ -200,34 +190,17 @@ func ReadLoop(conn net.Conn) {
 			fmt.Println(utils.ErrorColor("❌ You are not a member of this room"))
 			continue
 		case strings.HasPrefix(message, "PING"):
-			_, err = conn.Write([]byte("PONG"))
+			err = protocol.SendCommand(conn, "PONG")
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error responding to heartbeat:"), err)
 				continue
 			}
-		case message == "USERS:":
-			// Improved approach to accumulate the complete user list
+		case strings.HasPrefix(message, "USERS:"):
 			fmt.Println(utils.HeaderColor("\n👥 Online Users:"))
 			fmt.Println(utils.InfoColor("-------------------"))
 
-			// Read the complete user list with timeout
-			userList := ""
-			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-
-			for {
-				line, err := reader.ReadString('\n')
-				if err != nil {
-					break // Break on error (likely timeout)
-				}
-				line = strings.TrimSpace(line)
-				if line == "" {
-					break // All data received
-				}
-				userList += line + "\n"
-			}
-
-			// Reset the deadline
-			conn.SetReadDeadline(time.Time{})
+			// The complete user list arrives in a single frame
+			userList := strings.TrimPrefix(message, "USERS:")
 
 			// Process users
 			userCount := 0
@@ -267,7 +240,7 @@ func ReadLoop(conn net.Conn) {
 		case strings.HasPrefix(message, "/LOOK_REQUEST"):
 			args := strings.SplitN(message, " ", 3)
 			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_REQUEST <storageFilePath> <userId>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_REQUEST <userId> <storageFilePath>"))
 				continue
 			}
 			storageFilePath := args[2]
@@ -282,7 +255,7 @@ func ReadLoop(conn net.Conn) {
 				continue
 			}
 			userId := args[1]
-			files := strings.Split(args[2], " ")
+			files := strings.Split(args[2], "\n")
 
 			fmt.Println(utils.HeaderColor("\n📂 Directory Listing for User:"), utils.UserColor(userId))
 			fmt.Println(utils.InfoColor("-------------------------------------------"))
@@ -310,7 +283,7 @@ func ReadLoop(conn net.Conn) {
 			userId := args[1]
 			filePath := args[2]
 			fmt.Println(utils.InfoColor("📤 Download request from"), utils.UserColor(userId), utils.InfoColor("for"), utils.InfoColor(filePath))
-			HandleDownloadResponse(conn, userId, filePath)
+			go HandleDownloadResponse(conn, userId, filePath)
 			continue
 		case strings.HasPrefix(message, "ROOM_MEMBERS_RESPONSE"):
 			args := strings.SplitN(message, " ", 3)
@@ -325,28 +298,35 @@ func ReadLoop(conn net.Conn) {
 					continue
 				}
 				fmt.Println(utils.InfoColor("[Debug] Sending file to userID:"), uid)
-				HandleSendFile(conn, uid, pendingRoomFileSend.filePath)
+				go HandleSendFile(conn, uid, pendingRoomFileSend.roomID, pendingRoomFileSend.filePath)
 			}
 			pendingRoomFileSend.roomID = ""
 			pendingRoomFileSend.filePath = ""
 			continue
 		default:
-			if strings.HasPrefix(message, "[Room ") {
-				// Room message
-				fmt.Println(utils.InfoColor(message))
-			} else if strings.Contains(message, "has joined the chat") {
-				fmt.Println(utils.WarningColor("👋 " + message))
-			} else if strings.Contains(message, "has rejoined the chat") {
-				fmt.Println(utils.WarningColor("🔄 " + message))
-			} else if strings.Contains(message, "is now offline") {
-				fmt.Println(utils.WarningColor("👋 " + message))
-			} else {
-				fmt.Println(message)
-			}
+			fmt.Println(message)
 		}
 	}
 }
 
+// printChatMessage displays a chat frame, highlighting room and presence messages
+func printChatMessage(message string) {
+	if strings.HasPrefix(message, "[Room ") {
+		// Room message
+		fmt.Println(utils.InfoColor(message))
+	} else if strings.HasPrefix(message, "[DM] ") {
+		fmt.Println(utils.UserColor("✉️  " + message))
+	} else if strings.Contains(message, "has joined the chat") {
+		fmt.Println(utils.WarningColor("👋 " + message))
+	} else if strings.Contains(message, "has rejoined the chat") {
+		fmt.Println(utils.WarningColor("🔄 " + message))
+	} else if strings.Contains(message, "is now offline") {
+		fmt.Println(utils.WarningColor("👋 " + message))
+	} else {
+		fmt.Println(message)
+	}
+}
+
 // 1. Update handleOnlineUsersList to only display users, not prompt for input
 func handleOnlineUsersList(message string) {
 	parts := strings.SplitN(message, " ", 2)
@@ -456,7 +436,7 @@ func WriteLoop(conn net.Conn) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		if pendingRoomCreation != "" {
-			_, err := conn.Write([]byte(pendingRoomCreation))
+			err := protocol.SendCommand(conn, pendingRoomCreation)
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error creating room:"), err)
 			}
@@ -480,10 +460,13 @@ func WriteLoop(conn net.Conn) {
 		case message == "/help":
 			utils.PrintHelp()
 			continue
+		case message == "/logout":
+			Logout(conn)
+			return
 		case message == "/createroom":
 			fmt.Println(utils.InfoColor("🏠 Fetching online users..."))
 			roomUserListReady = false
-			_, err := conn.Write([]byte("/GET_ONLINE_USERS"))
+			err := protocol.SendCommand(conn, "/GET_ONLINE_USERS")
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error fetching users:"), err)
 				continue
@@ -541,19 +524,19 @@ func WriteLoop(conn net.Conn) {
 				continue
 			}
 			roomID := strings.TrimSpace(args[1])
-			_, err := conn.Write([]byte(fmt.Sprintf("/JOIN_ROOM %s", roomID)))
+			err := protocol.SendCommand(conn, fmt.Sprintf("/JOIN_ROOM %s", roomID))
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error joining room:"), err)
 			}
 			continue
 		case message == "/leaveroom":
-			_, err := conn.Write([]byte("/LEAVE_ROOM"))
+			err := protocol.SendCommand(conn, "/LEAVE_ROOM")
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error leaving room:"), err)
 			}
 			continue
 		case message == "/rooms":
-			_, err := conn.Write([]byte("/LIST_ROOMS"))
+			err := protocol.SendCommand(conn, "/LIST_ROOMS")
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error fetching rooms:"), err)
 			}
@@ -567,7 +550,7 @@ func WriteLoop(conn net.Conn) {
 			recipientId := args[1]
 			filePath := args[2]
 			fmt.Println(utils.InfoColor("📤 Sending file to"), utils.UserColor(recipientId))
-			HandleSendFile(conn, recipientId, filePath)
+			go HandleSendFile(conn, recipientId, "", filePath)
 			continue
 		case strings.HasPrefix(message, "/sendfolder"):
 			args := strings.SplitN(message, " ", 3)
@@ -578,7 +561,7 @@ func WriteLoop(conn net.Conn) {
 			recipientId := args[1]
 			folderPath := args[2]
 			fmt.Println(utils.InfoColor("📤 Sending folder to"), utils.UserColor(recipientId))
-			HandleSendFolder(conn, recipientId, folderPath)
+			go HandleSendFolder(conn, recipientId, folderPath)
 			continue
 		case strings.HasPrefix(message, "/lookup"):
 			args := strings.SplitN(message, " ", 2)
@@ -590,9 +573,20 @@ func WriteLoop(conn net.Conn) {
 			fmt.Println(utils.InfoColor("🔍 Looking up files for user"), utils.UserColor(recipientId))
 			HandleLookupRequest(conn, recipientId)
 			continue
+		case strings.HasPrefix(message, "/msg"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /msg <userId> <message>"))
+				continue
+			}
+			err := protocol.SendCommand(conn, fmt.Sprintf("/DIRECT_MESSAGE %s %s", args[1], args[2]))
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error sending message:"), err)
+			}
+			continue
 		case strings.HasPrefix(message, "/status"):
 			fmt.Println(utils.InfoColor("👥 Fetching online users..."))
-			_, err := conn.Write([]byte(message))
+			err := protocol.SendCommand(conn, message)
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error checking status:"), err)
 				continue
@@ -619,7 +613,7 @@ func WriteLoop(conn net.Conn) {
 				continue
 			}
 			transferID := args[1]
-			HandlePauseTransfer(transferID)
+			HandlePauseTransfer(conn, transferID)
 			continue
 		case strings.HasPrefix(message, "/resume"):
 			args := strings.SplitN(message, " ", 2)
@@ -628,7 +622,48 @@ func WriteLoop(conn net.Conn) {
 				continue
 			}
 			transferID := args[1]
-			HandleResumeTransfer(transferID)
+			HandleResumeTransfer(conn, transferID)
+			continue
+		case strings.HasPrefix(message, "/accept"):
+			args := strings.Fields(message)
+			if len(args) != 2 && len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /accept <transferId> [rename|overwrite]"))
+				continue
+			}
+			choice := ""
+			if len(args) == 3 {
+				choice = args[2]
+			}
+			HandleAcceptOffer(conn, args[1], choice)
+			continue
+		case strings.HasPrefix(message, "/decline"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /decline <transferId>"))
+				continue
+			}
+			HandleDeclineOffer(conn, args[1])
+			continue
+		case strings.HasPrefix(message, "/autoaccept"):
+			HandleAutoAccept(strings.Fields(message)[1:])
+			continue
+		case strings.HasPrefix(message, "/history"):
+			HandleHistory(conn, strings.Fields(message)[1:])
+			continue
+		case strings.HasPrefix(message, "/queue"):
+			HandleQueue(strings.Fields(message)[1:])
+			continue
+		case strings.HasPrefix(message, "/limit"):
+			HandleLimit(strings.Fields(message)[1:])
+			continue
+		case strings.HasPrefix(message, "/cancel"):
+			args := strings.SplitN(message, " ", 2)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /cancel <transferId>"))
+				continue
+			}
+			transferID := args[1]
+			HandleCancelTransfer(conn, transferID)
 			continue
 		case strings.HasPrefix(message, "/sendfiletoroom"):
 			args := strings.SplitN(message, " ", 3)
@@ -640,18 +675,20 @@ func WriteLoop(conn net.Conn) {
 			filePath := args[2]
 			pendingRoomFileSend.roomID = roomID
 			pendingRoomFileSend.filePath = filePath
-			_, err := conn.Write([]byte("/ROOM_MEMBERS " + roomID + "\n"))
+			err := protocol.SendCommand(conn, "/ROOM_MEMBERS "+roomID)
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error requesting room members:"), err)
 			}
 			continue
 		default:
 			if message != "" {
+				var err error
 				// If in a room, send as room message
 				if currentRoomID != "" {
-					message = fmt.Sprintf("/ROOM_MESSAGE %s %s", currentRoomID, message)
+					err = protocol.SendCommand(conn, fmt.Sprintf("/ROOM_MESSAGE %s %s", currentRoomID, message))
+				} else {
+					err = protocol.SendChat(conn, message)
 				}
-				_, err := conn.Write([]byte(message))
 				if err != nil {
 					fmt.Println(utils.ErrorColor("❌ Error sending message:"), err)
 					return
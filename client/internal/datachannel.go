@@ -0,0 +1,144 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenTimeout bounds how long we wait for the server to accept a transfer request
+	tokenTimeout = 30 * time.Second
+	// pairTimeout bounds how long a data connection waits for the peer to show up
+	pairTimeout = 90 * time.Second
+)
+
+// serverAddress is remembered by Connect so transfers can open data connections
+var serverAddress string
+
+// transferReply is the server's answer to a transfer request: a token or an error
+type transferReply struct {
+	Token string
+	Err   error
+}
+
+var (
+	pendingRequests = make(map[string]chan transferReply)
+	pendingMutex    sync.Mutex
+)
+
+// RequestTransfer sends a FILE_REQUEST or FOLDER_REQUEST on the control
+// connection and waits for the server to hand out the transfer token
+func RequestTransfer(conn net.Conn, transferID, command string) (string, error) {
+	reply := make(chan transferReply, 1)
+	pendingMutex.Lock()
+	pendingRequests[transferID] = reply
+	pendingMutex.Unlock()
+
+	defer func() {
+		pendingMutex.Lock()
+		delete(pendingRequests, transferID)
+		pendingMutex.Unlock()
+	}()
+
+	if err := protocol.SendCommand(conn, command); err != nil {
+		return "", err
+	}
+
+	select {
+	case r := <-reply:
+		return r.Token, r.Err
+	case <-time.After(tokenTimeout):
+		return "", errors.New("timed out waiting for the server to accept the transfer")
+	}
+}
+
+// deliverTransferReply hands a TRANSFER_READY/TRANSFER_FAILED to the waiting
+// request; it returns false if nobody is waiting for that transfer
+func deliverTransferReply(transferID string, reply transferReply) bool {
+	pendingMutex.Lock()
+	ch, exists := pendingRequests[transferID]
+	pendingMutex.Unlock()
+	if !exists {
+		return false
+	}
+	ch <- reply
+	return true
+}
+
+// OpenDataConnection dials a dedicated connection for one transfer and waits
+// until the server has paired it with the peer's connection. The control
+// connection stays free for chat and commands while bytes flow here.
+func OpenDataConnection(token, role string) (net.Conn, error) {
+	conn, err := dialServer(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := protocol.DataHello{Token: token, Role: role}
+	if err := protocol.SendCommand(conn, hello.Encode()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pairTimeout))
+	frame, err := protocol.ReadFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("peer did not connect: %v", err)
+	}
+
+	message := string(frame.Payload)
+	if message != "/DATA_OK" {
+		conn.Close()
+		return nil, errors.New(strings.TrimSpace(strings.TrimPrefix(message, "/DATA_REJECTED")))
+	}
+	return conn, nil
+}
+
+// openDataConnections opens the relayed data connection of every stream of
+// a transfer at once, since the server pairs each one separately
+func openDataConnections(tokens []string, role string) ([]net.Conn, error) {
+	conns := make([]net.Conn, len(tokens))
+	errs := make([]error, len(tokens))
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			conns[i], errs[i] = OpenDataConnection(token, role)
+		}(i, token)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			closeAll(conns)
+			return nil, err
+		}
+	}
+	return conns, nil
+}
+
+// streamTokens returns the data connection token of every stream
+func streamTokens(token string, streams int) []string {
+	tokens := make([]string, streams)
+	for i := range tokens {
+		tokens[i] = protocol.StreamToken(token, i)
+	}
+	return tokens
+}
+
+// closeAll closes every connection that was opened
+func closeAll(conns []net.Conn) {
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
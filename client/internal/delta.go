@@ -0,0 +1,190 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// SignFolder signs the files of the copy of a folder we already hold, so the
+// sender only has to send what changed. There are no signatures if we hold
+// no such copy; files that cannot be read are simply sent again in full.
+func SignFolder(root string) []protocol.FileSignature {
+	if !ServerSupports(protocol.FeatureDelta) {
+		return nil
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil
+	}
+	fmt.Println(utils.InfoColor("🔍 Comparing with the copy you already have..."))
+
+	var signatures []protocol.FileSignature
+	blocks := int64(0)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		blockSize := protocol.SignatureBlockSize(info.Size())
+		if blocks += (info.Size() + blockSize - 1) / blockSize; blocks > protocol.MaxSignatureBlocks {
+			return filepath.SkipAll
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		if sig, err := protocol.SignFile(bufio.NewReader(file), filepath.ToSlash(relPath), info.Size()); err == nil {
+			signatures = append(signatures, sig)
+		}
+		return nil
+	})
+	return signatures
+}
+
+// SendSignatures sends our signatures back to the sender on the data
+// connection, sealed with a key of their own if the transfer is encrypted
+func SendSignatures(dataConn net.Conn, key []byte, signatures []protocol.FileSignature) error {
+	if !ServerSupports(protocol.FeatureDelta) {
+		return nil
+	}
+
+	var writer io.WriteCloser = nopWriteCloser{dataConn}
+	if key != nil {
+		sealed, err := protocol.NewSealedWriter(dataConn, protocol.ReplyKey(key))
+		if err != nil {
+			return err
+		}
+		writer = sealed
+	}
+	if err := protocol.WriteSignatures(writer, signatures); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// ReceiveSignatures reads the signatures of the files the recipient already
+// holds. It waits as long as the recipient takes to sign them.
+func ReceiveSignatures(dataConn net.Conn, key []byte) ([]protocol.FileSignature, error) {
+	if !ServerSupports(protocol.FeatureDelta) {
+		return nil, nil
+	}
+
+	var reader io.Reader = dataConn
+	if key != nil {
+		sealed, err := protocol.NewSealedReader(dataConn, protocol.ReplyKey(key))
+		if err != nil {
+			return nil, err
+		}
+		reader = sealed
+	}
+	signatures, err := protocol.ReadSignatures(reader)
+	if err != nil {
+		return nil, err
+	}
+	return signatures, VerifyReceived(reader)
+}
+
+// SendDelta streams the folder from offset as a delta stream, sending files
+// the recipient already holds a copy of as references to its blocks where
+// they match. data reads the folder from offset; the returned count is how
+// much of it was consumed.
+func SendDelta(stream io.Writer, folder *folderReader, data io.Reader, offset int64, signatures []protocol.FileSignature) (*protocol.DeltaWriter, int64, error) {
+	buffered := bufio.NewWriterSize(stream, 64*1024)
+	delta := protocol.NewDeltaWriter(buffered)
+
+	held := make(map[string]int, len(signatures))
+	for i, sig := range signatures {
+		held[sig.Path] = i
+	}
+
+	pos := offset
+	if header := int64(len(folder.header)); pos < header {
+		if err := delta.WriteLiteral(data, header-pos); err != nil {
+			return delta, pos - offset, err
+		}
+		pos = header
+	}
+	for i, entry := range folder.entries {
+		n := folder.starts[i] + entry.Size - pos
+		if n <= 0 {
+			continue
+		}
+		var err error
+		if index, ok := held[entry.Path]; ok {
+			err = delta.WriteFile(data, n, index, &signatures[index])
+		} else {
+			err = delta.WriteLiteral(data, n)
+		}
+		if err != nil {
+			return delta, pos - offset, err
+		}
+		pos += n
+	}
+
+	if err := delta.Flush(); err != nil {
+		return delta, pos - offset, err
+	}
+	return delta, pos - offset, buffered.Flush()
+}
+
+// deltaBasis opens the files of our own copy as a delta stream copies blocks
+// from them, keeping the last one open since runs of blocks come in order
+type deltaBasis struct {
+	root       string
+	signatures []protocol.FileSignature
+	reader     *protocol.DeltaReader
+	file       *os.File
+	fileIndex  int
+}
+
+// OpenDelta returns the reader of the folder data that follows on stream,
+// which is a delta stream against the files we signed if the server can
+// carry one. Close the basis once the data has been read.
+func OpenDelta(stream io.Reader, root string, signatures []protocol.FileSignature) (io.Reader, *deltaBasis) {
+	basis := &deltaBasis{root: root, signatures: signatures, fileIndex: -1}
+	if !ServerSupports(protocol.FeatureDelta) {
+		return stream, basis
+	}
+	basis.reader = protocol.NewDeltaReader(stream, signatures, basis.open)
+	return basis.reader, basis
+}
+
+func (b *deltaBasis) open(index int) (io.ReaderAt, error) {
+	if index == b.fileIndex {
+		return b.file, nil
+	}
+	b.Close()
+	file, err := os.Open(filepath.Join(b.root, filepath.FromSlash(b.signatures[index].Path)))
+	if err != nil {
+		return nil, err
+	}
+	b.file, b.fileIndex = file, index
+	return file, nil
+}
+
+// Reused returns how many bytes were copied from our own files
+func (b *deltaBasis) Reused() int64 {
+	if b.reader == nil {
+		return 0
+	}
+	return b.reader.Copied
+}
+
+func (b *deltaBasis) Close() error {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+		b.fileIndex = -1
+	}
+	return nil
+}
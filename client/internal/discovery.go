@@ -16,6 +16,7 @@ type DiscoveredServer struct {
 	Address string
 	IP      string
 	Port    string
+	TLS     bool
 }
 
 // DiscoverServers listens for UDP broadcast messages from DrizLink servers
@@ -56,10 +57,10 @@ func DiscoverServers(timeout time.Duration) ([]DiscoveredServer, error) {
 
 		message := string(buffer[:n])
 
-		// Parse broadcast message: DRIZLINK_SERVER:<server_ip>:<server_port>
+		// Parse broadcast message: DRIZLINK_SERVER:<server_ip>:<server_port>[:tls]
 		if strings.HasPrefix(message, "DRIZLINK_SERVER:") {
 			parts := strings.Split(message, ":")
-			if len(parts) == 3 {
+			if len(parts) == 3 || len(parts) == 4 {
 				serverIP := parts[1]
 				serverPort := parts[2]
 				serverAddress := fmt.Sprintf("%s:%s", serverIP, serverPort)
@@ -71,6 +72,7 @@ func DiscoverServers(timeout time.Duration) ([]DiscoveredServer, error) {
 						Address: serverAddress,
 						IP:      serverIP,
 						Port:    serverPort,
+						TLS:     len(parts) == 4 && parts[3] == "tls",
 					})
 
 					fmt.Printf("%s Found server: %s (from %s)\n",
@@ -86,19 +88,24 @@ func DiscoverServers(timeout time.Duration) ([]DiscoveredServer, error) {
 }
 
 // SelectServer prompts user to select from discovered servers
-func SelectServer(servers []DiscoveredServer) (string, error) {
+func SelectServer(servers []DiscoveredServer) (DiscoveredServer, error) {
 	if len(servers) == 0 {
-		return "", fmt.Errorf("no servers discovered")
+		return DiscoveredServer{}, fmt.Errorf("no servers discovered")
 	}
 
 	fmt.Println(utils.HeaderColor("\n📡 Discovered DrizLink Servers:"))
 	fmt.Println(utils.InfoColor("--------------------------------"))
 
 	for i, server := range servers {
-		fmt.Printf("%s %s %s\n",
+		security := ""
+		if server.TLS {
+			security = utils.SuccessColor(" 🔐 TLS")
+		}
+		fmt.Printf("%s %s %s%s\n",
 			utils.CommandColor(fmt.Sprintf("[%d]", i+1)),
 			utils.InfoColor("Server at"),
-			utils.SuccessColor(server.Address))
+			utils.SuccessColor(server.Address),
+			security)
 	}
 
 	fmt.Printf("%s %s\n",
@@ -113,15 +120,15 @@ func SelectServer(servers []DiscoveredServer) (string, error) {
 	input = strings.TrimSpace(input)
 	choice, err := strconv.Atoi(input)
 	if err != nil {
-		return "", fmt.Errorf("invalid input")
+		return DiscoveredServer{}, fmt.Errorf("invalid input")
 	}
 
 	if choice < 1 || choice > len(servers)+1 {
-		return "", fmt.Errorf("invalid choice")
+		return DiscoveredServer{}, fmt.Errorf("invalid choice")
 	}
 
 	if choice == len(servers)+1 {
-		return "", fmt.Errorf("manual_entry_requested")
+		return DiscoveredServer{}, fmt.Errorf("manual_entry_requested")
 	}
 
 	selectedServer := servers[choice-1]
@@ -129,5 +136,5 @@ func SelectServer(servers []DiscoveredServer) (string, error) {
 		utils.SuccessColor("✅"),
 		utils.InfoColor(selectedServer.Address))
 
-	return selectedServer.Address, nil
+	return selectedServer, nil
 }
@@ -0,0 +1,150 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	peerKeys      = make(map[string]chan string)
+	peerKeysMutex sync.Mutex
+)
+
+// peerKey returns the channel on which the recipient's public key for a
+// transfer is delivered; it is created by whichever side gets there first
+func peerKey(token string) chan string {
+	peerKeysMutex.Lock()
+	defer peerKeysMutex.Unlock()
+	ch, exists := peerKeys[token]
+	if !exists {
+		ch = make(chan string, 1)
+		peerKeys[token] = ch
+	}
+	return ch
+}
+
+func forgetPeerKey(token string) {
+	peerKeysMutex.Lock()
+	delete(peerKeys, token)
+	peerKeysMutex.Unlock()
+}
+
+// HandleTransferKey delivers a "/TRANSFER_KEY <token> <publicKey>" from the server
+func HandleTransferKey(token, publicKey string) {
+	select {
+	case peerKey(token) <- publicKey:
+	default:
+	}
+}
+
+// OfferEncryption creates the sender's ephemeral key for a transfer. It
+// returns a nil key and protocol.NoPublicKey if the server cannot forward
+// the key exchange, in which case the transfer goes unencrypted.
+func OfferEncryption() (*ecdh.PrivateKey, string) {
+	if !ServerSupports(protocol.FeatureEncryption) {
+		return nil, protocol.NoPublicKey
+	}
+	private, err := protocol.GenerateTransferKey()
+	if err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not create encryption key, sending unencrypted:"), err)
+		return nil, protocol.NoPublicKey
+	}
+	return private, protocol.EncodePublicKey(private.PublicKey())
+}
+
+// SealSender waits for the recipient's public key and wraps the data
+// connection so that only ciphertext leaves this client. The returned writer
+// must be closed once all bytes are written. The shared key is nil if the
+// transfer is not encrypted.
+func SealSender(dataConn net.Conn, token string, private *ecdh.PrivateKey) (io.WriteCloser, []byte, error) {
+	if private == nil {
+		printUnencrypted()
+		return nopWriteCloser{dataConn}, nil, nil
+	}
+	defer forgetPeerKey(token)
+
+	var peerPublic string
+	select {
+	case peerPublic = <-peerKey(token):
+	case <-time.After(pairTimeout):
+		return nil, nil, errors.New("recipient never sent its encryption key")
+	}
+	if peerPublic == protocol.NoPublicKey {
+		return nil, nil, errors.New("recipient refused to encrypt the transfer")
+	}
+
+	key, err := protocol.DeriveTransferKey(private, peerPublic, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	printEncrypted(key)
+	writer, err := protocol.NewSealedWriter(dataConn, key)
+	return writer, key, err
+}
+
+// AcceptEncryption answers the sender's public key with our own on the
+// control connection and returns the shared key. It returns a nil key if
+// the sender did not offer encryption.
+func AcceptEncryption(control net.Conn, token, senderPublic string) ([]byte, error) {
+	if senderPublic == protocol.NoPublicKey {
+		return nil, nil
+	}
+
+	private, err := protocol.GenerateTransferKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := protocol.DeriveTransferKey(private, senderPublic, token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = protocol.SendCommand(control, fmt.Sprintf("/TRANSFER_KEY %s %s", token, protocol.EncodePublicKey(private.PublicKey())))
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// OpenReceiver wraps the data connection so that reads return the decrypted
+// and authenticated stream. Either way the stream can be read a byte at a
+// time, so a decompressor takes no more of it than the compressed data.
+func OpenReceiver(dataConn net.Conn, key []byte) (io.Reader, error) {
+	if key == nil {
+		printUnencrypted()
+		return bufio.NewReaderSize(dataConn, 64*1024), nil
+	}
+	printEncrypted(key)
+	return protocol.NewSealedReader(dataConn, key)
+}
+
+// VerifyReceived checks that an encrypted stream ended exactly where the
+// sender said it would
+func VerifyReceived(reader io.Reader) error {
+	if sealed, ok := reader.(*protocol.SealedReader); ok {
+		return sealed.Verify()
+	}
+	return nil
+}
+
+func printEncrypted(key []byte) {
+	fmt.Println(utils.SuccessColor("🔐 End-to-end encrypted, key fingerprint:"), utils.CommandColor(protocol.KeyFingerprint(key)))
+}
+
+func printUnencrypted() {
+	fmt.Println(utils.WarningColor("⚠ This transfer is not end-to-end encrypted"))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,209 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits on the folders we extract, unless -max-folder-size or
+// -max-folder-entries say otherwise
+const (
+	DefaultMaxFolderSize    = 64 << 30
+	DefaultMaxFolderEntries = 100000
+)
+
+// errUnsafeFolder marks a folder we refuse to extract. Nothing of it is
+// kept, since sending it again would be refused just the same.
+var errUnsafeFolder = errors.New("refusing to extract the folder")
+
+// SymlinkPolicy says what happens to the symlinks of a folder we receive
+type SymlinkPolicy int
+
+const (
+	// SkipSymlinks leaves links out and reports them
+	SkipSymlinks SymlinkPolicy = iota
+	// KeepSymlinks creates links that resolve inside the folder
+	KeepSymlinks
+	// RefuseSymlinks fails a folder that contains any link
+	RefuseSymlinks
+)
+
+// String representation of SymlinkPolicy
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case KeepSymlinks:
+		return "keep"
+	case RefuseSymlinks:
+		return "refuse"
+	default:
+		return "skip"
+	}
+}
+
+var (
+	maxFolderSize    int64 = DefaultMaxFolderSize
+	maxFolderEntries       = DefaultMaxFolderEntries
+	symlinkPolicy          = SkipSymlinks
+)
+
+// SetMaxFolderSize caps the size of a folder we accept, e.g. "64GB"; 0 lifts it
+func SetMaxFolderSize(value string) error {
+	size, err := helper.ParseSize(value)
+	if err != nil {
+		return err
+	}
+	maxFolderSize = size
+	return nil
+}
+
+// SetMaxFolderEntries caps the files, directories and links of a folder we
+// extract; 0 lifts it
+func SetMaxFolderEntries(entries int) {
+	maxFolderEntries = entries
+}
+
+// SetSymlinkPolicy sets what happens to the symlinks of received folders
+func SetSymlinkPolicy(value string) error {
+	for _, policy := range []SymlinkPolicy{SkipSymlinks, KeepSymlinks, RefuseSymlinks} {
+		if strings.EqualFold(value, policy.String()) {
+			symlinkPolicy = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown symlink policy %q, use skip, keep or refuse", value)
+}
+
+// checkFolderSize refuses a folder larger than we extract
+func checkFolderSize(size int64) error {
+	if maxFolderSize > 0 && size > maxFolderSize {
+		return fmt.Errorf("the folder is %s, more than the %s allowed", formatSize(size), formatSize(maxFolderSize))
+	}
+	return nil
+}
+
+// skippedEntry is an entry of a received folder that was left out, and why
+type skippedEntry struct {
+	Path   string
+	Reason string
+}
+
+func (s *folderStore) skip(path, reason string) {
+	s.skipped = append(s.skipped, skippedEntry{Path: path, Reason: reason})
+}
+
+// checkListing holds a complete listing against our limits and symlink
+// policy before anything of it is created. The files have to add up to the
+// size that was offered, so the sender cannot make us write more than that.
+func (s *folderStore) checkListing(entries []protocol.FolderEntry) error {
+	if maxFolderEntries > 0 && len(entries) > maxFolderEntries {
+		return fmt.Errorf("the folder has %d entries, more than the %d allowed", len(entries), maxFolderEntries)
+	}
+	total := int64(len(s.header))
+	for _, entry := range entries {
+		if entry.Size > s.offered-total {
+			return fmt.Errorf("the folder listing holds more than the %d bytes offered", s.offered)
+		}
+		total += entry.Size
+	}
+	if total != s.offered {
+		return fmt.Errorf("the folder listing holds %d bytes, but %d were offered", total, s.offered)
+	}
+
+	s.skipped = nil
+	for _, entry := range entries {
+		if entry.Link == "" {
+			continue
+		}
+		switch symlinkPolicy {
+		case RefuseSymlinks:
+			return fmt.Errorf("the folder contains the symlink %q and symlinks are refused", entry.Path)
+		case SkipSymlinks:
+			s.skip(entry.Path, "symlink, left out by -symlinks skip")
+		}
+	}
+	return nil
+}
+
+// linkEntries creates the folder's symlinks once all its files are in
+// place, so nothing is ever written through one. A link is only kept if it
+// resolves to something inside the folder.
+func (s *folderStore) linkEntries() error {
+	if symlinkPolicy != KeepSymlinks || s.entries == nil {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var created []int
+	for i, entry := range s.entries {
+		if entry.Link == "" {
+			continue
+		}
+		target := filepath.FromSlash(entry.Link)
+		if filepath.IsAbs(target) || !filepath.IsLocal(filepath.Join(filepath.Dir(filepath.FromSlash(entry.Path)), target)) {
+			s.skip(entry.Path, "symlink pointing outside the folder")
+			continue
+		}
+		if err := os.Symlink(target, s.entryPath(i)); err != nil {
+			s.skip(entry.Path, "symlink could not be created: "+err.Error())
+			continue
+		}
+		created = append(created, i)
+	}
+
+	// A link can still lead outside through another one, as "a/b" -> ".."
+	// does for "c" -> "a/b/..", and removing one can leave others dangling
+	for removed := true; removed; {
+		removed = false
+		kept := created[:0]
+		for _, i := range created {
+			if s.resolvesInside(root, i) {
+				kept = append(kept, i)
+				continue
+			}
+			if err := os.Remove(s.entryPath(i)); err != nil {
+				return err
+			}
+			s.skip(s.entries[i].Path, "symlink not leading to anything inside the folder")
+			removed = true
+		}
+		created = kept
+	}
+	return nil
+}
+
+func (s *folderStore) resolvesInside(root string, index int) bool {
+	resolved, err := filepath.EvalSymlinks(s.entryPath(index))
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// Skipped returns the entries of a received folder that were left out
+func (p *PartialFile) Skipped() []skippedEntry {
+	if store, ok := p.partialStore.(*folderStore); ok {
+		return store.skipped
+	}
+	return nil
+}
+
+// printSkipped lists the entries of a received folder that were left out
+func printSkipped(skipped []skippedEntry) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Printf("%s %d entries of the folder were not extracted:\n", utils.WarningColor("⚠"), len(skipped))
+	for _, entry := range skipped {
+		fmt.Printf("   %s (%s)\n", entry.Path, entry.Reason)
+	}
+}
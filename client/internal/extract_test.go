@@ -0,0 +1,256 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// setLimits applies a symlink policy and entry cap for one test
+func setLimits(t *testing.T, policy SymlinkPolicy, entries int) {
+	oldPolicy, oldEntries := symlinkPolicy, maxFolderEntries
+	symlinkPolicy, maxFolderEntries = policy, entries
+	t.Cleanup(func() { symlinkPolicy, maxFolderEntries = oldPolicy, oldEntries })
+}
+
+// receiveFolder writes a folder stream of entries, with the given file
+// contents in listing order, into a new staging directory. offered is added
+// to the size the stream really has, to play a sender lying about it.
+func receiveFolder(t *testing.T, entries []protocol.FolderEntry, contents string, offered int64) (*folderStore, error) {
+	t.Helper()
+	header, err := protocol.EncodeFolderListing(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := append(header, contents...)
+
+	dir := filepath.Join(t.TempDir(), "folder.part")
+	store, err := openFolderStore(dir, dir+".listing", int64(len(stream))+offered, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.Write(stream); err != nil {
+		return store, err
+	}
+	return store, store.linkEntries()
+}
+
+func skippedPaths(store *folderStore) []string {
+	var paths []string
+	for _, entry := range store.skipped {
+		paths = append(paths, entry.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func fileEntry(path, contents string) protocol.FolderEntry {
+	return protocol.FolderEntry{Path: path, Size: int64(len(contents)), Mode: 0644}
+}
+
+func dirEntry(path string) protocol.FolderEntry {
+	return protocol.FolderEntry{Path: path, Mode: 0755, Dir: true}
+}
+
+func linkEntry(path, target string) protocol.FolderEntry {
+	return protocol.FolderEntry{Path: path, Mode: 0777, Link: target}
+}
+
+func TestExtractFolder(t *testing.T) {
+	setLimits(t, SkipSymlinks, DefaultMaxFolderEntries)
+	store, err := receiveFolder(t, []protocol.FolderEntry{dirEntry("docs"), fileEntry("docs/a.txt", "hello"), fileEntry("b.txt", "world")}, "helloworld", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"docs/a.txt": "hello", "b.txt": "world"} {
+		got, err := os.ReadFile(filepath.Join(store.dir, path))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+}
+
+func TestExtractRefusesUnsafeListings(t *testing.T) {
+	setLimits(t, SkipSymlinks, DefaultMaxFolderEntries)
+	for _, tc := range []struct {
+		name    string
+		entries []protocol.FolderEntry
+	}{
+		{"parent", []protocol.FolderEntry{fileEntry("../evil", "")}},
+		{"absolute", []protocol.FolderEntry{fileEntry("/tmp/evil", "")}},
+		{"duplicate", []protocol.FolderEntry{fileEntry("a", ""), fileEntry("a", "")}},
+		{"under a file", []protocol.FolderEntry{fileEntry("a", ""), fileEntry("a/b", "")}},
+		{"under a link", []protocol.FolderEntry{linkEntry("a", ".."), fileEntry("a/evil", "")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := receiveFolder(t, tc.entries, "", 0)
+			if !errors.Is(err, errUnsafeFolder) {
+				t.Fatalf("error = %v, want errUnsafeFolder", err)
+			}
+			names, _ := os.ReadDir(store.dir)
+			if len(names) != 0 {
+				t.Errorf("an unsafe folder created %d entries", len(names))
+			}
+			if _, err := os.Lstat(filepath.Join(filepath.Dir(store.dir), "evil")); err == nil {
+				t.Error("a file was written outside the folder")
+			}
+		})
+	}
+}
+
+func TestExtractEntryCap(t *testing.T) {
+	entries := []protocol.FolderEntry{dirEntry("a"), fileEntry("a/b", ""), fileEntry("c", "")}
+
+	setLimits(t, SkipSymlinks, 2)
+	if _, err := receiveFolder(t, entries, "", 0); !errors.Is(err, errUnsafeFolder) || !strings.Contains(err.Error(), "entries") {
+		t.Errorf("error = %v, want the entry cap", err)
+	}
+
+	setLimits(t, SkipSymlinks, 3)
+	if _, err := receiveFolder(t, entries, "", 0); err != nil {
+		t.Errorf("a folder at the cap was refused: %v", err)
+	}
+
+	setLimits(t, SkipSymlinks, 0)
+	if _, err := receiveFolder(t, entries, "", 0); err != nil {
+		t.Errorf("a folder without a cap was refused: %v", err)
+	}
+}
+
+func TestExtractSizeCap(t *testing.T) {
+	setLimits(t, SkipSymlinks, DefaultMaxFolderEntries)
+	entries := []protocol.FolderEntry{fileEntry("a", "12345"), fileEntry("b", "678")}
+
+	// The listing must not hold more or less than the offer announced
+	if _, err := receiveFolder(t, entries, "12345678", -1); !errors.Is(err, errUnsafeFolder) {
+		t.Errorf("a listing larger than the offer: error = %v, want errUnsafeFolder", err)
+	}
+	if _, err := receiveFolder(t, entries, "12345678", 1); !errors.Is(err, errUnsafeFolder) {
+		t.Errorf("a listing smaller than the offer: error = %v, want errUnsafeFolder", err)
+	}
+	// Sizes that overflow when added up must not sneak past the offer
+	huge := []protocol.FolderEntry{{Path: "a", Size: 1 << 62}, {Path: "b", Size: 1 << 62}, {Path: "c", Size: 1 << 62}}
+	if _, err := receiveFolder(t, huge, "", 0); !errors.Is(err, errUnsafeFolder) {
+		t.Errorf("a listing with huge files: error = %v, want errUnsafeFolder", err)
+	}
+
+	old := maxFolderSize
+	t.Cleanup(func() { maxFolderSize = old })
+	maxFolderSize = 100
+	if checkFolderSize(101) == nil || checkFolderSize(100) != nil {
+		t.Error("checkFolderSize does not hold folders to the cap")
+	}
+	maxFolderSize = 0
+	if checkFolderSize(1<<50) != nil {
+		t.Error("checkFolderSize capped a folder without a cap")
+	}
+}
+
+func TestExtractSymlinkPolicies(t *testing.T) {
+	entries := []protocol.FolderEntry{fileEntry("a.txt", "hi"), linkEntry("inside", "a.txt")}
+
+	t.Run("refuse", func(t *testing.T) {
+		setLimits(t, RefuseSymlinks, DefaultMaxFolderEntries)
+		if _, err := receiveFolder(t, entries, "hi", 0); !errors.Is(err, errUnsafeFolder) {
+			t.Errorf("error = %v, want errUnsafeFolder", err)
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		setLimits(t, SkipSymlinks, DefaultMaxFolderEntries)
+		store, err := receiveFolder(t, entries, "hi", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(store.dir, "inside")); err == nil {
+			t.Error("a skipped link was created")
+		}
+		if got := skippedPaths(store); len(got) != 1 || got[0] != "inside" {
+			t.Errorf("skipped = %v, want [inside]", got)
+		}
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		setLimits(t, KeepSymlinks, DefaultMaxFolderEntries)
+		store, err := receiveFolder(t, entries, "hi", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(store.dir, "inside"))
+		if err != nil || string(got) != "hi" {
+			t.Errorf("link reads %q, %v; want hi", got, err)
+		}
+		if len(store.skipped) != 0 {
+			t.Errorf("skipped = %v, want nothing", store.skipped)
+		}
+	})
+}
+
+func TestExtractKeepsOnlyLinksInside(t *testing.T) {
+	setLimits(t, KeepSymlinks, DefaultMaxFolderEntries)
+	root := filepath.Join(t.TempDir(), "folder.part")
+	// What the folder is staged in is known, which lets "back" climb out and
+	// come back in through the parent
+	back := "c/" + filepath.Base(root) + "/a.txt"
+
+	entries := []protocol.FolderEntry{
+		fileEntry("a.txt", "hi"),
+		dirEntry("a"),
+		dirEntry("docs"),
+		linkEntry("docs/up", "../a.txt"),
+		linkEntry("up", "../a.txt"),
+		linkEntry("absolute", "/etc/passwd"),
+		linkEntry("dangling", "missing"),
+		// Each is inside on its own, but together "c" leads out
+		linkEntry("a/b", ".."),
+		linkEntry("c", "a/b/.."),
+		// Only inside as long as "c" is there
+		linkEntry("back", back),
+		linkEntry("self", "."),
+	}
+	header, err := protocol.EncodeFolderListing(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openFolderStore(root, root+".listing", int64(len(header))+2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.Write(append(header, "hi"...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.linkEntries(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"absolute", "back", "c", "dangling", "up"}
+	if got := skippedPaths(store); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("skipped = %v, want %v", got, want)
+	}
+	for _, path := range want {
+		if _, err := os.Lstat(filepath.Join(root, path)); err == nil {
+			t.Errorf("%s was left in the folder", path)
+		}
+	}
+	for _, path := range []string{"docs/up", "a/b", "self"} {
+		if info, err := os.Lstat(filepath.Join(root, path)); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s was not kept as a link: %v", path, err)
+		}
+	}
+}
+
+func TestSetSymlinkPolicy(t *testing.T) {
+	setLimits(t, SkipSymlinks, DefaultMaxFolderEntries)
+	if err := SetSymlinkPolicy("KEEP"); err != nil || symlinkPolicy != KeepSymlinks {
+		t.Errorf("SetSymlinkPolicy(KEEP) = %v, policy %v", err, symlinkPolicy)
+	}
+	if err := SetSymlinkPolicy("follow"); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+}
@@ -2,7 +2,9 @@ package connection
 
 import (
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/utils"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,7 +15,27 @@ import (
 
 )
 
-func HandleSendFile(conn net.Conn, recipientId, filePath string) {
+// HandleSendFile queues a file for a user; it is offered once one of the
+// send slots is free
+func HandleSendFile(conn net.Conn, recipientId, roomID, filePath string) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening file:"), err)
+		return
+	}
+	scheduleSend(&QueuedSend{
+		Type:      FileTransfer,
+		Name:      fileInfo.Name(),
+		Recipient: recipientId,
+		run: func(transferID string) {
+			sendFile(conn, transferID, recipientId, roomID, filePath)
+		},
+	})
+}
+
+// sendFile offers a file to a user and sends it once accepted. A file sent
+// to a room carries the room ID so members can auto-accept it.
+func sendFile(conn net.Conn, transferID, recipientId, roomID, filePath string) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error opening file:"), err)
@@ -30,67 +52,158 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 	fileSize := fileInfo.Size()
 	fileName := fileInfo.Name()
 
-	// Calculate checksum of file
-	checksum, err := helper.CalculateFileChecksum(filePath)
+	// The chunk hashes go ahead of the data; the checksum follows it
+	manifest, err := HashChunks(file, fileSize)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error hashing chunks:"), err)
+		return
+	}
+	digest, err := protocol.NewChecksum(protocol.DefaultHash)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
 		return
 	}
 
-	transferID := GenerateTransferID()
+	// Data that is compressed already would only cost time to compress again
+	compression := fileCompression(file, fileName, fileSize)
+
 	fmt.Printf("%s Sending file '%s' to user %s (Transfer ID: %s)...\n",
 		utils.InfoColor("📤"),
 		utils.InfoColor(fileName),
 		utils.UserColor(recipientId),
 		utils.CommandColor(transferID))
 
-	// Send file request with file size, checksum, and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FILE_REQUEST %s %s %d %s %s\n",
-		recipientId, fileName, fileSize, checksum, transferID)))
+	// Offer the recipient a direct connection; the server relay remains the fallback
+	direct := ListenDirect()
+	defer direct.Close()
+
+	private, publicKey := OfferEncryption()
+
+	// A large file is split over several streams to fill high-latency links
+	streams := parallelStreams(fileSize)
+
+	// Send file request with transfer ID, file size, our direct addresses,
+	// public key and attributes; the checksum follows the data and the name
+	// goes last so it may contain spaces
+	offered := time.Now()
+	token, err := RequestTransfer(conn, transferID, fmt.Sprintf("/FILE_REQUEST %s %s %d %s %s %s %s %s",
+		recipientId, transferID, fileSize, protocol.ChecksumFollows, direct.Candidates(), publicKey, offerAttributes(roomID, streams, compression), fileName))
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error sending file request:"), err)
 		return
 	}
+	defer reportDone(conn, token)
+
+	if err := AwaitAnswer(token, recipientId); err != nil {
+		fmt.Println(utils.WarningColor("🚫 File not sent:"), err)
+		recordUnanswered(&Transfer{ID: transferID, Type: FileTransfer, Name: fileName, Size: fileSize,
+			Direction: "send", Recipient: recipientId, Path: filePath, StartTime: offered}, err)
+		return
+	}
+
+	// The bytes go over their own connections so chat keeps flowing meanwhile
+	dataConns, err := direct.AwaitStreams(token, streams)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data connection:"), err)
+		return
+	}
+	defer closeAll(dataConns)
+	dataConn := dataConns[0]
+
+	stream, key, err := SealSender(dataConn, token, private)
+	var extra []io.WriteCloser
+	if err == nil {
+		extra, err = SealStreams(dataConns[1:], key)
+	}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	// Skip whatever the recipient kept from an earlier attempt
+	offset, err := StartSending(stream, token, file, fileSize, key, digest)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error agreeing where to resume:"), err)
+		return
+	}
+
+	// Let the recipient check every chunk as it arrives
+	if err := SendManifest(stream, manifest); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error sending chunk hashes:"), err)
+		return
+	}
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(fileSize, "📤 Sending file")
 	bar.SetTransferId(transferID)
+	bar.SetProgress(offset)
 
 	transfer := &Transfer{
 		ID:            transferID,
+		Token:         token,
 		Type:          FileTransfer,
 		Name:          fileName,
 		Size:          fileSize,
-		BytesComplete: 0,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "send",
 		Recipient:     recipientId,
 		Path:          filePath,
-		Checksum:      checksum,
 		StartTime:     time.Now(),
 		File:          file,
-		Connection:    conn,
+		Connection:    dataConn,
+		Streams:       dataConns[1:],
+		Compression:   compression,
 		ProgressBar:   bar,
 	}
 
 	RegisterTransfer(transfer)
-
-	reader := NewCheckpointedReader(file, transfer, 32768) // 32KB chunks
-
-	n, err := io.CopyN(conn, io.TeeReader(reader, bar), fileSize)
+	printStreams(streams)
+
+	var n int64
+	if streams > 1 {
+		n, err = SendRanges(stream, extra, file, offset, fileSize, transfer, bar)
+		// The ranges are read side by side, so the checksum takes a read of its own
+		if err == nil {
+			_, err = io.Copy(digest, io.NewSectionReader(file, offset, fileSize-offset))
+		}
+	} else {
+		reader := NewCheckpointedReader(file, transfer, 32768) // 32KB chunks
+		reader.BytesRead = offset
+		var data io.WriteCloser
+		if data, err = compressData(stream, transfer); err == nil {
+			n, err = io.CopyN(data, io.TeeReader(reader, io.MultiWriter(bar, digest)), fileSize-offset)
+		}
+		if err == nil {
+			err = data.Close()
+		}
+	}
+	if err == nil {
+		err = ServeResends(dataConn, stream, token, file, manifest)
+	}
+	if err == nil {
+		transfer.Checksum, err = SendChecksum(stream, digest)
+	}
+	if err == nil {
+		err = stream.Close()
+	}
 
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error sending file:"), err)
-		RemoveTransfer(transferID)
+		if markFailed(transferID) {
+			fmt.Println(utils.WarningColor("\n🚫 Sending cancelled"))
+		} else {
+			fmt.Println(utils.ErrorColor("\n❌ Error sending file:"), err)
+			printResumeHint()
+		}
+		RetireTransfer(transferID, err)
 		return
 	}
 
-	if n != fileSize {
+	if n != fileSize-offset {
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n),
+		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(offset+n),
 			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
+		RetireTransfer(transferID, fmt.Errorf("sent %d bytes, expected %d", offset+n, fileSize))
 		return
 	}
 
@@ -100,31 +213,21 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 	fmt.Printf("%s File '%s' sent successfully!\n",
 		utils.SuccessColor("\n✅"),
 		utils.SuccessColor(fileName))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Println(utils.InfoColor("  "+strings.ToUpper(protocol.DefaultHash)+" Checksum:"), utils.InfoColor(transfer.Checksum))
+	if compression != "" {
+		fmt.Println(utils.InfoColor("🗜  Sent"), utils.InfoColor(formatWire(transfer, n)))
+	}
 
-	// Clean up the transfer
-	RemoveTransfer(transferID)
+	// Clean up the transfer; it stays in the history
+	RetireTransfer(transferID, nil)
 }
 
-func HandleFileTransfer(reader io.Reader, recipientId, fileName string, fileSize int64, storeFilePath string) {
-	// Get checksum and transfer ID from the split content
-	parts := strings.SplitN(fileName, "|", 3)
-	checksum := ""
-	transferID := ""
-
-	if len(parts) >= 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
-
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
-		transferID = GenerateTransferID()
-	}
+// HandleFileTransfer receives an accepted offer into the store path
+func HandleFileTransfer(conn net.Conn, offer *IncomingOffer, storeFilePath string) {
+	token, senderId, fileName, checksum := offer.Token, offer.SenderId, offer.Name, offer.Checksum
+	candidates, senderKey, fileSize := offer.Candidates, offer.SenderKey, offer.Size
+	transferID := offer.ID
+	defer reportDone(conn, token)
 
 	fmt.Printf("%s Receiving file: %s (Size: %s, Transfer ID: %s)\n",
 		utils.InfoColor("📥"),
@@ -132,74 +235,165 @@ func HandleFileTransfer(reader io.Reader, recipientId, fileName string, fileSize
 		utils.InfoColor(fmt.Sprintf("%d bytes", fileSize)),
 		utils.CommandColor(transferID))
 
-	filePath := filepath.Join(storeFilePath, fileName)
-	file, err := os.Create(filePath)
+	// Bytes go to "<name>.part" until the whole file has arrived, so an
+	// interrupted transfer can pick up where it stopped
+	filePath := filepath.Join(storeFilePath, offer.SaveAs)
+	defer releaseName(filePath)
+	partial, err := OpenPartial(filePath, senderId, fileSize, checksum, offer.Algorithm)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error creating file:"), err)
 		return
 	}
-	defer file.Close()
+
+	key, err := AcceptEncryption(conn, token, senderKey)
+	if err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	if err := OfferResume(conn, token, partial, key); err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error offering to resume:"), err)
+		return
+	}
+
+	dataConns, err := ConnectStreams(conn, token, candidates, offer.Streams)
+	if err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error opening data connection:"), err)
+		return
+	}
+	defer closeAll(dataConns)
+	dataConn := dataConns[0]
+
+	var manifest *protocol.Manifest
+	var extra []io.Reader
+	stream, err := OpenReceiver(dataConn, key)
+	if err == nil {
+		extra, err = OpenStreams(dataConns[1:], key)
+	}
+	if err == nil {
+		err = StartReceiving(stream, partial)
+	}
+	if err == nil {
+		manifest, err = ReceiveManifest(stream, fileSize)
+	}
+	if err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error setting up the transfer:"), err)
+		return
+	}
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(fileSize, "📥 Receiving file")
 	bar.SetTransferId(transferID)
+	bar.SetProgress(partial.Offset)
 
 	transfer := &Transfer{
 		ID:            transferID,
+		Token:         token,
 		Type:          FileTransfer,
 		Name:          fileName,
 		Size:          fileSize,
-		BytesComplete: 0,
+		BytesComplete: partial.Offset,
 		Status:        Active,
 		Direction:     "receive",
-		Recipient:     recipientId,
+		Recipient:     senderId,
 		Path:          filePath,
-		Checksum:      checksum,
+		Source:        offer.Source,
 		StartTime:     time.Now(),
-		File:          file,
-		Connection:    nil, // We don't need the connection for receiving
+		Connection:    dataConn,
+		Streams:       dataConns[1:],
+		Compression:   offer.Compression,
 		ProgressBar:   bar,
 	}
 
 	RegisterTransfer(transfer)
-
-	writer := NewCheckpointedWriter(file, transfer, 32768) // 32KB chunks
+	printStreams(len(dataConns))
 
 	// Write to file and update progress bar simultaneously
-	n, err := io.CopyN(writer, io.TeeReader(reader, bar), fileSize)
+	var n int64
+	var corrupt []int
+	if len(extra) > 0 {
+		n, corrupt, err = ReceiveRanges(stream, extra, partial, fileSize, manifest, transfer, bar)
+	} else {
+		writer := NewCheckpointedWriter(partial, transfer, 32768) // 32KB chunks
+		writer.BytesWritten = partial.Offset
+		destination, verifier := verifyingWriter(writer, manifest, partial.Offset)
+		fillDamaged([]io.Reader{stream}, manifest, transfer)
+		var data io.Reader
+		if data, err = decompressData(stream, transfer); err == nil {
+			n, err = io.CopyN(destination, io.TeeReader(data, bar), fileSize-partial.Offset)
+		}
+		if err == nil {
+			err = finishData(data, transfer)
+		}
+		if skipDamaged(err, stream, verifier, fileSize) {
+			n, err = fileSize-partial.Offset, nil
+		}
+		corrupt = verifier.Corrupt()
+	}
+	if err == nil {
+		err = RepairChunks(dataConn, token, stream, partial, manifest, corrupt)
+	}
+	if err == nil {
+		checksum, err = ReceiveChecksum(stream, checksum)
+		transfer.Checksum = checksum
+	}
+	if err == nil {
+		err = VerifyReceived(stream)
+	}
 
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error receiving file:"), err)
-		RemoveTransfer(transferID)
+		if markFailed(transferID) {
+			partial.Discard()
+			fmt.Println(utils.WarningColor("\n🚫 Receiving cancelled, partial data deleted"))
+		} else {
+			fmt.Println(utils.ErrorColor("\n❌ Error receiving file:"), err)
+			keepPartial(partial, senderId)
+		}
+		RetireTransfer(transferID, err)
 		return
 	}
 
-	if n != fileSize {
+	if n != fileSize-partial.Offset {
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n),
+		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(partial.Offset+n),
 			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
+		keepPartial(partial, senderId)
+		RetireTransfer(transferID, fmt.Errorf("received %d bytes, expected %d", partial.Offset+n, fileSize))
 		return
 	}
 
-	// Verify checksum if provided
+	// Verify checksum if provided; a corrupted file never gets its final name
 	if checksum != "" {
-		file.Close() // Close file before calculating checksum
-		receivedChecksum, err := helper.CalculateFileChecksum(filePath)
+		fmt.Println(utils.InfoColor("\n📋 Original "+offer.Algorithm+" checksum:"), utils.InfoColor(checksum))
+		receivedChecksum, err := partial.Checksum()
 		if err != nil {
-			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
+			fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
 		} else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+			fmt.Println(utils.InfoColor("📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
 
 			if helper.VerifyChecksum(checksum, receivedChecksum) {
 				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! File integrity confirmed."))
 			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! File may be corrupted."))
+				UpdateTransferStatus(transferID, Failed)
+				partial.Discard()
+				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! The corrupted file was deleted."))
+				RetireTransfer(transferID, errors.New("checksum verification failed"))
+				return
 			}
 		}
 	}
 
+	if err := partial.Complete(); err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Println(utils.ErrorColor("\n❌ Error saving file:"), err)
+		RetireTransfer(transferID, err)
+		return
+	}
+
 	// Mark transfer as completed
 	UpdateTransferStatus(transferID, Completed)
 
@@ -207,17 +401,22 @@ func HandleFileTransfer(reader io.Reader, recipientId, fileName string, fileSize
 		utils.SuccessColor("✅"),
 		utils.SuccessColor(fileName))
 	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(filePath))
+	if transfer.Compression != "" {
+		fmt.Println(utils.InfoColor("🗜  Received"), utils.InfoColor(formatWire(transfer, n)))
+	}
 
-	// Clean up the transfer
-	RemoveTransfer(transferID)
+	// Clean up the transfer; it stays in the history
+	RetireTransfer(transferID, nil)
 }
 
 func HandleDownloadRequest(conn net.Conn, recipientId, filePath string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+	err := protocol.SendCommand(conn, fmt.Sprintf("/DOWNLOAD_REQUEST %s %s", recipientId, filePath))
 	if err != nil {
 		fmt.Println("Error sending file request:", err)
 		return
 	}
+	// We asked for it, so the offer that follows needs no /accept
+	expectDownload(recipientId, filePath)
 	fmt.Println("File download request sent successfully")
 }
 
@@ -235,7 +434,7 @@ func HandleDownloadResponse(conn net.Conn, userId, filePath string) {
 		return
 	}
 	if !fileInfo.IsDir() {
-		HandleSendFile(conn, userId, absPath)
+		HandleSendFile(conn, userId, "", absPath)
 	} else {
 		HandleSendFolder(conn, userId, absPath)
 	}
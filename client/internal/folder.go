@@ -2,7 +2,9 @@ package connection
 
 import (
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/utils"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,44 +14,56 @@ import (
 	"time"
 )
 
+// HandleSendFolder queues a folder for a user; it is offered once one of
+// the send slots is free
 func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
-	fmt.Println(utils.InfoColor("📦 Preparing folder for transfer..."))
-
-	//Create a temporary zip file
-	tempZipPath := folderPath + ".zip"
-	err := helper.CreateZipFromFolder(folderPath, tempZipPath)
-	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating zip file:"), err)
+	if info, err := os.Stat(folderPath); err != nil || !info.IsDir() {
+		if err == nil {
+			err = fmt.Errorf("%s is not a folder", folderPath)
+		}
+		fmt.Println(utils.ErrorColor("❌ Error reading folder:"), err)
 		return
 	}
-	defer os.Remove(tempZipPath) //clean up temporary zip file
+	scheduleSend(&QueuedSend{
+		Type:      FolderTransfer,
+		Name:      filepath.Base(folderPath),
+		Recipient: recipientId,
+		run: func(transferID string) {
+			sendFolder(conn, transferID, recipientId, folderPath)
+		},
+	})
+}
 
-	//open zip file
-	zipFile, err := os.Open(tempZipPath)
-	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error opening temp zip file:"), err)
-		return
-	}
-	defer zipFile.Close()
+// sendFolder offers a folder to a user and streams it once accepted,
+// reading each file as its turn comes instead of building an archive first
+func sendFolder(conn net.Conn, transferID, recipientId, folderPath string) {
+	fmt.Println(utils.InfoColor("📦 Preparing folder for transfer..."))
 
-	//Get zip file info
-	zipInfo, err := zipFile.Stat()
+	folder, err := OpenFolderStream(folderPath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error getting zip file info:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error reading folder:"), err)
 		return
 	}
+	defer folder.Close()
 
-	zipSize := zipInfo.Size()
+	folderSize := folder.Size()
 	folderName := filepath.Base(folderPath)
 
-	// Calculate checksum of the zip file
-	checksum, err := helper.CalculateFileChecksum(tempZipPath)
+	// The chunk hashes go ahead of the data and take a read of the files of
+	// their own; the checksum is computed as the folder is sent and follows it
+	manifest, err := HashChunks(folder, folderSize)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error hashing chunks:"), err)
+		return
+	}
+	digest, err := protocol.NewChecksum(protocol.DefaultHash)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
 		return
 	}
 
-	transferID := GenerateTransferID()
+	// A folder of mostly archives and media would only cost time to compress
+	compression := folderCompression(folder)
 
 	fmt.Printf("%s Sending folder '%s' to user %s (Transfer ID: %s)...\n",
 		utils.InfoColor("📤"),
@@ -57,85 +71,152 @@ func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
 		utils.UserColor(recipientId),
 		utils.CommandColor(transferID))
 
-	// Send folder request with zip size, checksum and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FOLDER_REQUEST %s %s %d %s %s\n",
-		recipientId, folderName, zipSize, checksum, transferID)))
+	// Send folder request with stream size and transfer ID; the checksum follows the data
+	direct := ListenDirect()
+	defer direct.Close()
+
+	private, publicKey := OfferEncryption()
+
+	offered := time.Now()
+	token, err := RequestTransfer(conn, transferID, fmt.Sprintf("/FOLDER_REQUEST %s %s %d %s %s %s %s %s",
+		recipientId, transferID, folderSize, protocol.ChecksumFollows, direct.Candidates(), publicKey, offerAttributes("", 1, compression), folderName))
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error sending folder request:"), err)
 		return
 	}
+	defer reportDone(conn, token)
+
+	if err := AwaitAnswer(token, recipientId); err != nil {
+		fmt.Println(utils.WarningColor("🚫 Folder not sent:"), err)
+		recordUnanswered(&Transfer{ID: transferID, Type: FolderTransfer, Name: folderName, Size: folderSize,
+			Direction: "send", Recipient: recipientId, Path: folderPath, StartTime: offered}, err)
+		return
+	}
+
+	dataConn, err := direct.Await(token)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data connection:"), err)
+		return
+	}
+	defer dataConn.Close()
+
+	stream, key, err := SealSender(dataConn, token, private)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	// Skip whatever the recipient kept from an earlier attempt
+	offset, err := StartSending(stream, token, folder, folderSize, key, digest)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error agreeing where to resume:"), err)
+		return
+	}
+
+	// Let the recipient check every chunk as it arrives
+	if err := SendManifest(stream, manifest); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error sending chunk hashes:"), err)
+		return
+	}
+
+	// Files the recipient already holds a copy of only need their changes sent
+	signatures, err := ReceiveSignatures(dataConn, key)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error reading the recipient's signatures:"), err)
+		return
+	}
 
 	// Create progress bar with transfer ID
-	bar := utils.CreateProgressBar(zipSize, "📤 Sending folder")
+	bar := utils.CreateProgressBar(folderSize, "📤 Sending folder")
 	bar.SetTransferId(transferID)
+	bar.SetProgress(offset)
 
 	// Create transfer record
 	transfer := &Transfer{
 		ID:            transferID,
+		Token:         token,
 		Type:          FolderTransfer,
 		Name:          folderName,
-		Size:          zipSize,
-		BytesComplete: 0,
+		Size:          folderSize,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "send",
 		Recipient:     recipientId,
 		Path:          folderPath,
-		Checksum:      checksum,
 		StartTime:     time.Now(),
-		File:          zipFile,
-		Connection:    conn,
+		Connection:    dataConn,
+		Compression:   compression,
 		ProgressBar:   bar,
 	}
 
 	// Register the transfer
 	RegisterTransfer(transfer)
 
-	checkpointedReader := NewCheckpointedReader(zipFile, transfer, 32768) // 32KB chunks
-
-	// Stream zip file data using the checkpointed reader with progress bar
-	reader := io.TeeReader(checkpointedReader, bar)
-	n, err := io.CopyN(conn, reader, zipSize)
+	checkpointedReader := NewCheckpointedReader(folder, transfer, 32768) // 32KB chunks
+	checkpointedReader.BytesRead = offset
+
+	// Stream the folder using the checkpointed reader with progress bar
+	reader := io.TeeReader(checkpointedReader, io.MultiWriter(bar, digest))
+	// The delta stream is what gets compressed, so copied blocks cost nothing
+	var n int64
+	var delta *protocol.DeltaWriter
+	data, err := compressData(stream, transfer)
+	if err == nil && ServerSupports(protocol.FeatureDelta) {
+		delta, n, err = SendDelta(data, folder, reader, offset, signatures)
+	} else if err == nil {
+		n, err = io.CopyN(data, reader, folderSize-offset)
+	}
+	if err == nil {
+		err = data.Close()
+	}
+	if err == nil {
+		err = ServeResends(dataConn, stream, token, folder, manifest)
+	}
+	if err == nil {
+		transfer.Checksum, err = SendChecksum(stream, digest)
+	}
+	if err == nil {
+		err = stream.Close()
+	}
 
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error sending folder:"), err)
-		RemoveTransfer(transferID)
+		if markFailed(transferID) {
+			fmt.Println(utils.WarningColor("\n🚫 Sending cancelled"))
+		} else {
+			fmt.Println(utils.ErrorColor("\n❌ Error sending folder:"), err)
+			printResumeHint()
+		}
+		RetireTransfer(transferID, err)
 		return
 	}
-	if n != zipSize {
+	if n != folderSize-offset {
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(zipSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
+		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(offset+n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(folderSize), utils.ErrorColor("bytes"))
+		RetireTransfer(transferID, fmt.Errorf("sent %d bytes, expected %d", offset+n, folderSize))
 		return
 	}
 
 	UpdateTransferStatus(transferID, Completed)
 
 	fmt.Println(utils.SuccessColor("\n✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("sent successfully!"))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Println(utils.InfoColor("  "+strings.ToUpper(protocol.DefaultHash)+" Checksum:"), utils.InfoColor(transfer.Checksum))
+	if delta != nil && delta.Copied > 0 {
+		fmt.Printf("%s Only %s had to be sent, the recipient already had the other %s\n",
+			utils.InfoColor("♻"), utils.InfoColor(formatSize(delta.Literal)), utils.InfoColor(formatSize(delta.Copied)))
+	}
+	if compression != "" {
+		fmt.Println(utils.InfoColor("🗜  Sent"), utils.InfoColor(formatWire(transfer, n)))
+	}
 
-	RemoveTransfer(transferID)
+	RetireTransfer(transferID, nil)
 }
 
-func HandleFolderTransfer(reader io.Reader, recipientId, folderName string, folderSize int64, storeFilePath string) {
-	// Extract checksum and transfer ID if present
-	checksum := ""
-	transferID := ""
-
-	parts := strings.SplitN(folderName, "|", 3)
-	if len(parts) >= 2 {
-		folderName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
-
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
-		transferID = GenerateTransferID()
-	}
+// HandleFolderTransfer receives an accepted offer into the store path
+func HandleFolderTransfer(conn net.Conn, offer *IncomingOffer, storeFilePath string) {
+	token, senderId, folderName, checksum := offer.Token, offer.SenderId, offer.Name, offer.Checksum
+	candidates, senderKey, folderSize := offer.Candidates, offer.SenderKey, offer.Size
+	transferID := offer.ID
+	defer reportDone(conn, token)
 
 	fmt.Printf("%s Receiving folder: %s (Size: %s, Transfer ID: %s)\n",
 		utils.InfoColor("📥"),
@@ -143,107 +224,194 @@ func HandleFolderTransfer(reader io.Reader, recipientId, folderName string, fold
 		utils.InfoColor(fmt.Sprintf("%d bytes", folderSize)),
 		utils.CommandColor(transferID))
 
-	// Create temporary zip file to store received data
-	tempZipPath := filepath.Join(storeFilePath, folderName+".zip")
-	zipFile, err := os.Create(tempZipPath)
+	// Files are extracted into "<name>.part" as they arrive and the folder
+	// only gets its name once complete, so an interrupted transfer can resume
+	destPath := filepath.Join(storeFilePath, offer.SaveAs)
+	defer releaseName(destPath)
+	// Our copy of the folder by its own name is the basis of a delta, even
+	// when this one is saved next to it
+	basisPath := filepath.Join(storeFilePath, folderName)
+	partial, err := OpenPartialFolder(destPath, senderId, folderSize, checksum, offer.Algorithm)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error creating folder:"), err)
+		return
+	}
+
+	key, err := AcceptEncryption(conn, token, senderKey)
+	if err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+
+	if err := OfferResume(conn, token, partial, key); err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error offering to resume:"), err)
+		return
+	}
+
+	dataConn, err := ConnectToSender(conn, token, candidates)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating temporary zip file:"), err)
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error opening data connection:"), err)
+		return
+	}
+	defer dataConn.Close()
+
+	var manifest *protocol.Manifest
+	var signatures []protocol.FileSignature
+	stream, err := OpenReceiver(dataConn, key)
+	if err == nil {
+		err = StartReceiving(stream, partial)
+	}
+	if err == nil {
+		manifest, err = ReceiveManifest(stream, folderSize)
+	}
+	if err == nil {
+		signatures = SignFolder(basisPath)
+		err = SendSignatures(dataConn, key, signatures)
+	}
+	if err != nil {
+		keepPartial(partial, senderId)
+		fmt.Println(utils.ErrorColor("❌ Error setting up the transfer:"), err)
 		return
 	}
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(folderSize, "📥 Receiving folder")
 	bar.SetTransferId(transferID)
+	bar.SetProgress(partial.Offset)
 
 	// Create transfer record
 	transfer := &Transfer{
 		ID:            transferID,
+		Token:         token,
 		Type:          FolderTransfer,
 		Name:          folderName,
 		Size:          folderSize,
-		BytesComplete: 0,
+		BytesComplete: partial.Offset,
 		Status:        Active,
 		Direction:     "receive",
-		Recipient:     recipientId,
-		Path:          tempZipPath,
-		Checksum:      checksum,
+		Recipient:     senderId,
+		Path:          destPath,
+		Source:        offer.Source,
 		StartTime:     time.Now(),
-		File:          zipFile,
-		Connection:    nil, // We don't need the connection for receiving
+		Connection:    dataConn,
+		Compression:   offer.Compression,
 		ProgressBar:   bar,
 	}
 
 	RegisterTransfer(transfer)
 
-	writer := NewCheckpointedWriter(zipFile, transfer, 32768) // 32KB chunks
+	writer := NewCheckpointedWriter(partial, transfer, 32768) // 32KB chunks
+	writer.BytesWritten = partial.Offset
+	destination, verifier := verifyingWriter(writer, manifest, partial.Offset)
 
-	// Receive the zip file data with progress
-	n, err := io.CopyN(writer, io.TeeReader(reader, bar), folderSize)
-	zipFile.Close()
+	// Receive the folder with progress, writing each file as it arrives.
+	// Unchanged blocks are copied from the files we already have.
+	var n int64
+	if !ServerSupports(protocol.FeatureDelta) {
+		fillDamaged([]io.Reader{stream}, manifest, transfer)
+	}
+	data, err := decompressData(stream, transfer)
+	source, basis := OpenDelta(data, basisPath, signatures)
+	if err == nil {
+		n, err = io.CopyN(destination, io.TeeReader(source, bar), folderSize-partial.Offset)
+	}
+	basis.Close()
+	if err == nil {
+		err = finishData(data, transfer)
+	}
+	if skipDamaged(err, stream, verifier, folderSize) {
+		n, err = folderSize-partial.Offset, nil
+	}
+	if err == nil {
+		err = RepairChunks(dataConn, token, stream, partial, manifest, verifier.Corrupt())
+	}
+	if err == nil {
+		checksum, err = ReceiveChecksum(stream, checksum)
+		transfer.Checksum = checksum
+	}
+	if err == nil {
+		err = VerifyReceived(stream)
+	}
 
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("\n❌ Error receiving folder data:"), err)
-		RemoveTransfer(transferID)
+		if markFailed(transferID) {
+			partial.Discard()
+			fmt.Println(utils.WarningColor("\n🚫 Receiving cancelled, partial data deleted"))
+		} else if errors.Is(err, errUnsafeFolder) {
+			partial.Discard()
+			fmt.Println(utils.ErrorColor("\n❌ Error receiving folder:"), err)
+		} else {
+			fmt.Println(utils.ErrorColor("\n❌ Error receiving folder:"), err)
+			keepPartial(partial, senderId)
+		}
+		RetireTransfer(transferID, err)
 		return
 	}
 
-	if n != folderSize {
+	if n != folderSize-partial.Offset {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(folderSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
+		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(partial.Offset+n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(folderSize), utils.ErrorColor("bytes"))
+		keepPartial(partial, senderId)
+		RetireTransfer(transferID, fmt.Errorf("received %d bytes, expected %d", partial.Offset+n, folderSize))
 		return
 	}
 
-	// Verify checksum if provided
+	// Verify checksum if provided; a corrupted folder never gets its final name
 	if checksum != "" {
-		receivedChecksum, err := helper.CalculateFileChecksum(tempZipPath)
+		fmt.Println(utils.InfoColor("\n📋 Original "+offer.Algorithm+" checksum:"), utils.InfoColor(checksum))
+		receivedChecksum, err := partial.Checksum()
 		if err != nil {
-			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
+			fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
 		} else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+			fmt.Println(utils.InfoColor("📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
 
 			if helper.VerifyChecksum(checksum, receivedChecksum) {
 				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! Folder integrity confirmed."))
 			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! Folder may be corrupted."))
+				UpdateTransferStatus(transferID, Failed)
+				partial.Discard()
+				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! The corrupted folder was deleted."))
+				RetireTransfer(transferID, errors.New("checksum verification failed"))
+				return
 			}
 		}
 	}
 
-	fmt.Println(utils.InfoColor("\n📦 Extracting folder..."))
-	//Extract the zip file
-	destPath := filepath.Join(storeFilePath, folderName)
-	err = helper.ExtractZip(tempZipPath, destPath)
-	if err != nil {
+	if err := partial.Complete(); err != nil {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("❌ Error extracting folder:"), err)
-		RemoveTransfer(transferID)
+		fmt.Println(utils.ErrorColor("\n❌ Error saving folder:"), err)
+		RetireTransfer(transferID, err)
 		return
 	}
 
 	UpdateTransferStatus(transferID, Completed)
 
-	// Clean up the temporary zip file
-	os.Remove(tempZipPath)
-	fmt.Println(utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("received and extracted successfully!"))
+	fmt.Println(utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("received successfully!"))
 	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(destPath))
+	printRenamed(partial.Renamed())
+	printSkipped(partial.Skipped())
+	if reused := basis.Reused(); reused > 0 {
+		fmt.Println(utils.InfoColor("♻ Reused"), utils.InfoColor(formatSize(reused)), utils.InfoColor("from the copy you already had"))
+	}
+	if transfer.Compression != "" {
+		fmt.Println(utils.InfoColor("🗜  Received"), utils.InfoColor(formatWire(transfer, n)))
+	}
 
-	RemoveTransfer(transferID)
+	RetireTransfer(transferID, nil)
 }
 
 func HandleLookupRequest(conn net.Conn, userId string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/LOOK %s\n", userId)))
+	err := protocol.SendCommand(conn, fmt.Sprintf("/LOOK %s", userId))
 	if err != nil {
 		fmt.Printf("Error sending look request: %v\n", err)
 		return
 	}
 }
 
-func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
+func HandleLookupResponse(conn net.Conn, storeFilePath string, requesterId string) {
 	// Clean and normalize the path
 	cleanPath := filepath.Clean(strings.TrimSpace(storeFilePath))
 	absPath, err := filepath.Abs(cleanPath)
@@ -313,8 +481,8 @@ func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
 		allEntries = append(allEntries, "Directory is empty")
 	}
 
-	response := fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(allEntries, "\n"))
-	_, err = conn.Write([]byte(response))
+	response := fmt.Sprintf("/DIR_LISTING %s %s", requesterId, strings.Join(allEntries, "\n"))
+	err = protocol.SendCommand(conn, response)
 	if err != nil {
 		fmt.Printf("Error sending lookup response: %v\n", err)
 	}
@@ -0,0 +1,494 @@
+package connection
+
+import (
+	"bytes"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// folderLayout maps offsets in a folder stream to the listing at its start
+// and to the contents of the files that follow
+type folderLayout struct {
+	header  []byte
+	entries []protocol.FolderEntry
+	starts  []int64 // where the contents of each entry start in the stream
+	size    int64
+}
+
+func (l *folderLayout) setEntries(entries []protocol.FolderEntry) {
+	if entries == nil {
+		entries = []protocol.FolderEntry{}
+	}
+	l.entries = entries
+	l.starts = make([]int64, len(entries))
+	l.size = int64(len(l.header))
+	for i, entry := range entries {
+		l.starts[i] = l.size
+		l.size += entry.Size
+	}
+}
+
+// entryAt returns the entry whose contents hold offset, or -1 if offset is
+// in the listing or past the end
+func (l *folderLayout) entryAt(offset int64) int {
+	if offset < int64(len(l.header)) || offset >= l.size {
+		return -1
+	}
+	return sort.Search(len(l.entries), func(i int) bool {
+		return l.starts[i]+l.entries[i].Size > offset
+	})
+}
+
+// folderReader reads a folder as one stream straight from its files, so
+// nothing is written next to the folder being sent
+type folderReader struct {
+	folderLayout
+	root      string
+	pos       int64
+	file      *os.File
+	fileIndex int
+}
+
+// OpenFolderStream lists a folder for sending. Directories, regular files
+// and symlinks are sent, the recipient deciding whether to keep the links;
+// anything else is skipped with a warning.
+func OpenFolderStream(root string) (*folderReader, error) {
+	var entries []protocol.FolderEntry
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		entry := protocol.FolderEntry{Path: filepath.ToSlash(relPath), Mode: info.Mode().Perm()}
+		switch {
+		case info.IsDir():
+			entry.Dir = true
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.Link = filepath.ToSlash(target)
+		default:
+			fmt.Println(utils.WarningColor("⚠ Skipping"), relPath, utils.WarningColor("(not a regular file)"))
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := protocol.EncodeFolderListing(entries)
+	if err != nil {
+		return nil, err
+	}
+	reader := &folderReader{root: root, fileIndex: -1}
+	reader.header = header
+	reader.setEntries(entries)
+	return reader, nil
+}
+
+// Size returns the length of the whole stream
+func (r *folderReader) Size() int64 {
+	return r.size
+}
+
+// Files returns the number of files in the folder
+func (r *folderReader) Files() int {
+	files := 0
+	for _, entry := range r.entries {
+		if !entry.Dir && entry.Link == "" {
+			files++
+		}
+	}
+	return files
+}
+
+func (r *folderReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.pos < int64(len(r.header)) {
+		n := copy(p, r.header[r.pos:])
+		r.pos += int64(n)
+		return n, nil
+	}
+
+	index := r.entryAt(r.pos)
+	if index != r.fileIndex {
+		if r.file != nil {
+			r.file.Close()
+			r.file = nil
+		}
+		file, err := os.Open(filepath.Join(r.root, filepath.FromSlash(r.entries[index].Path)))
+		if err != nil {
+			return 0, err
+		}
+		r.file, r.fileIndex = file, index
+	}
+
+	end := r.starts[index] + r.entries[index].Size
+	want := min(int64(len(p)), end-r.pos)
+	n, err := r.file.ReadAt(p[:want], r.pos-r.starts[index])
+	r.pos += int64(n)
+	if int64(n) < want {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%s changed while it was being sent", r.entries[index].Path)
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+func (r *folderReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the folder")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *folderReader) Close() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return nil
+}
+
+// folderStore receives a folder stream into a staging directory, creating
+// every file as soon as the listing has arrived and filling it in as its
+// bytes follow. The listing is also kept on disk so a resumed transfer can
+// find its way back into the stream.
+type folderStore struct {
+	folderLayout
+	dir         string
+	listingPath string
+	offered     int64 // size of the whole stream, as the offer announced it
+	held        int64 // bytes of the stream received so far
+	pos         int64
+	file        *os.File
+	fileIndex   int
+	skipped     []skippedEntry
+	renamed     []renamedEntry
+}
+
+// openFolderStore opens the staging directory dir for a stream of size
+// bytes, keeping what an earlier attempt left in it if resume is set
+func openFolderStore(dir, listingPath string, size int64, resume bool) (*folderStore, error) {
+	store := &folderStore{dir: dir, listingPath: listingPath, offered: size, fileIndex: -1}
+	if !resume {
+		os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return store, os.WriteFile(listingPath, nil, 0644)
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	header, err := os.ReadFile(listingPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.appendListing(header); err != nil {
+		return nil, err
+	}
+	store.held = int64(len(store.header))
+	if store.entries == nil {
+		return store, nil
+	}
+
+	// Files are written in listing order, so the stream holds every file up
+	// to the first one that is not complete
+	for i, entry := range store.entries {
+		if entry.Dir || entry.Link != "" {
+			continue
+		}
+		info, err := os.Stat(store.entryPath(i))
+		if err != nil {
+			break
+		}
+		store.held += min(info.Size(), entry.Size)
+		if info.Size() < entry.Size {
+			break
+		}
+	}
+	return store, nil
+}
+
+func (s *folderStore) entryPath(index int) string {
+	return filepath.Join(s.dir, filepath.FromSlash(s.entries[index].Path))
+}
+
+// appendListing adds bytes of the listing, creating the folder's directories
+// and files once it is complete and passes our checks. Symlinks wait until
+// the folder is complete. It returns how many bytes belonged to it.
+func (s *folderStore) appendListing(p []byte) (int, error) {
+	n := 0
+	if len(s.header) < protocol.FolderListingHeaderSize {
+		n = min(len(p), protocol.FolderListingHeaderSize-len(s.header))
+		s.header = append(s.header, p[:n]...)
+		if len(s.header) < protocol.FolderListingHeaderSize {
+			return n, nil
+		}
+	}
+
+	length, err := protocol.FolderListingLength(s.header)
+	if err != nil {
+		return n, err
+	}
+	more := int(min(int64(len(p)-n), length-int64(len(s.header))))
+	s.header = append(s.header, p[n:n+more]...)
+	n += more
+	if int64(len(s.header)) < length {
+		return n, nil
+	}
+
+	entries, err := protocol.DecodeFolderListing(s.header)
+	if err == nil {
+		s.renamed, err = sanitizeListing(entries)
+	}
+	if err == nil {
+		err = s.checkListing(entries)
+	}
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", errUnsafeFolder, err)
+	}
+	s.setEntries(entries)
+	for i, entry := range entries {
+		path := s.entryPath(i)
+		if entry.Link != "" {
+			continue
+		}
+		if entry.Dir {
+			err = os.MkdirAll(path, entry.Mode.Perm()|0700)
+		} else if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			var file *os.File
+			file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, entry.Mode.Perm()|0600)
+			if err == nil {
+				file.Close()
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// openEntry returns the file of an entry, keeping the last one open since
+// writes arrive in order
+func (s *folderStore) openEntry(index int) (*os.File, error) {
+	if index == s.fileIndex {
+		return s.file, nil
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	file, err := os.OpenFile(s.entryPath(index), os.O_RDWR|os.O_CREATE, s.entries[index].Mode.Perm()|0600)
+	if err != nil {
+		return nil, err
+	}
+	s.file, s.fileIndex = file, index
+	return file, nil
+}
+
+func (s *folderStore) Write(p []byte) (int, error) {
+	n, err := s.WriteAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+// WriteAt writes stream bytes at offset. The listing can only grow at its
+// end; the contents of files may also be rewritten, as chunk repairs do.
+func (s *folderStore) WriteAt(p []byte, offset int64) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		var n int
+		var err error
+		if offset < int64(len(s.header)) {
+			// A repaired chunk rewrites the part of the listing we have with the same bytes
+			n = int(min(int64(len(p)), int64(len(s.header))-offset))
+			if !bytes.Equal(p[:n], s.header[offset:offset+int64(n)]) {
+				return written, errors.New("folder listing cannot change once it was received")
+			}
+		} else if s.entries == nil {
+			if offset != int64(len(s.header)) {
+				return written, errors.New("folder listing must arrive in order")
+			}
+			n, err = s.appendListing(p)
+			if err == nil {
+				err = s.saveListing()
+			}
+		} else {
+			index := s.entryAt(offset)
+			if index < 0 {
+				return written, errors.New("data past the end of the folder")
+			}
+			var file *os.File
+			if file, err = s.openEntry(index); err == nil {
+				end := s.starts[index] + s.entries[index].Size
+				n, err = file.WriteAt(p[:min(int64(len(p)), end-offset)], offset-s.starts[index])
+			}
+		}
+
+		written += n
+		offset += int64(n)
+		p = p[n:]
+		if offset > s.held {
+			s.held = offset
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *folderStore) saveListing() error {
+	return os.WriteFile(s.listingPath, s.header, 0644)
+}
+
+func (s *folderStore) Read(p []byte) (int, error) {
+	if s.pos >= s.held {
+		return 0, io.EOF
+	}
+	if s.pos < int64(len(s.header)) {
+		n := copy(p, s.header[s.pos:min(s.held, int64(len(s.header)))])
+		s.pos += int64(n)
+		return n, nil
+	}
+
+	index := s.entryAt(s.pos)
+	file, err := s.openEntry(index)
+	if err != nil {
+		return 0, err
+	}
+	end := min(s.starts[index]+s.entries[index].Size, s.held)
+	n, err := file.ReadAt(p[:min(int64(len(p)), end-s.pos)], s.pos-s.starts[index])
+	s.pos += int64(n)
+	if n == 0 && err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *folderStore) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.held
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the folder")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Truncate drops everything from size on, as when a resume starts over
+func (s *folderStore) Truncate(size int64) error {
+	if size >= s.held {
+		return nil
+	}
+
+	if s.entries == nil || size < int64(len(s.header)) {
+		s.Close()
+		os.RemoveAll(s.dir)
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return err
+		}
+		s.header = s.header[:size]
+		s.entries, s.starts = nil, nil
+		s.held = size
+		return s.saveListing()
+	}
+
+	for i, entry := range s.entries {
+		if entry.Dir || s.starts[i]+entry.Size <= size {
+			continue
+		}
+		if err := os.Truncate(s.entryPath(i), max(size-s.starts[i], 0)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.held = size
+	return nil
+}
+
+// Name returns the staging directory
+func (s *folderStore) Name() string {
+	return s.dir
+}
+
+func (s *folderStore) Close() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+		s.fileIndex = -1
+	}
+	return nil
+}
+
+// moveFolder moves a completed staging directory to dest. If dest already
+// exists the received files are moved into it, replacing files of the same
+// name. A symlink in dest where the folder has a directory is replaced too,
+// never followed.
+func moveFolder(staging, dest string) error {
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		return os.Rename(staging, dest)
+	}
+
+	err := filepath.Walk(staging, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, relPath)
+		if info.IsDir() {
+			if existing, err := os.Lstat(target); err == nil && existing.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		return os.Rename(path, target)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(staging)
+}
@@ -0,0 +1,78 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// handshakeTimeout bounds how long we wait for the server's WELCOME
+const handshakeTimeout = 10 * time.Second
+
+// SupportedFeatures lists the optional protocol features this client implements
+var SupportedFeatures = []string{
+	protocol.FeatureHashing,
+	protocol.FeatureEncryption,
+	protocol.FeatureDirect,
+	protocol.FeatureResume,
+	protocol.FeatureChunks,
+	protocol.FeatureDelta,
+	protocol.FeatureStreams,
+	protocol.FeatureCompression,
+}
+
+// Negotiated with the server during the handshake
+var (
+	serverVersion  int
+	serverFeatures []string
+)
+
+// ServerSupports reports whether a feature was negotiated with the server
+func ServerSupports(feature string) bool {
+	return protocol.HasFeature(serverFeatures, feature)
+}
+
+// Handshake announces our protocol version and features and waits for the
+// server's WELCOME
+func Handshake(conn net.Conn) error {
+	hello := protocol.Hello{Version: protocol.ProtocolVersion, Features: SupportedFeatures}
+	if err := protocol.SendCommand(conn, hello.Encode()); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	frame, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return fmt.Errorf("no handshake reply from server (is it running an older DrizLink?): %v", err)
+	}
+
+	message := string(frame.Payload)
+	if strings.HasPrefix(message, "/INCOMPATIBLE") {
+		return errors.New(strings.TrimSpace(strings.TrimPrefix(message, "/INCOMPATIBLE")))
+	}
+
+	welcome, err := protocol.ParseWelcome(message)
+	if err != nil {
+		return err
+	}
+	version, features, err := protocol.Negotiate(welcome.Version, SupportedFeatures, welcome.Features)
+	if err != nil {
+		return err
+	}
+	serverVersion = version
+	serverFeatures = features
+
+	featureList := strings.Join(serverFeatures, ", ")
+	if featureList == "" {
+		featureList = "none"
+	}
+	fmt.Println(utils.InfoColor("🤝 Protocol v"+fmt.Sprint(serverVersion)+", features:"), utils.CommandColor(featureList))
+
+	return nil
+}
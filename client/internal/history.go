@@ -0,0 +1,411 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/helper"
+	"drizlink/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// historyFile is the journal of finished transfers, one JSON entry per line
+	historyFile = "transfer_history.jsonl"
+	// maxHistoryEntries caps the journal; the oldest entries go first
+	maxHistoryEntries = 1000
+	// historyPageSize is how many entries /history shows unless told otherwise
+	historyPageSize = 20
+)
+
+// HistoryEntry is how one transfer ended. Entries are numbered in the order
+// they were recorded and keep their number for good.
+type HistoryEntry struct {
+	Number      int       `json:"number"`
+	Server      string    `json:"server"` // user IDs only mean something on the server that issued them
+	Direction   string    `json:"direction"`
+	Type        string    `json:"type"`
+	Name        string    `json:"name"`
+	Peer        string    `json:"peer"`
+	Path        string    `json:"path"`             // the file we sent, or where the one we received was saved
+	Source      string    `json:"source,omitempty"` // the path we asked the sender for with /download
+	Size        int64     `json:"size"`
+	WireBytes   int64     `json:"wire_bytes,omitempty"` // what went over the network, after delta and compression
+	Compression string    `json:"compression,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Duration    float64   `json:"duration_seconds"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var historyMutex sync.Mutex
+
+func historyPath() (string, error) {
+	dir, err := helper.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, historyFile), nil
+}
+
+// loadHistory reads every entry of the journal, oldest first. Lines that
+// cannot be parsed, e.g. one cut short by a crash, are skipped.
+func loadHistory() ([]HistoryEntry, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// appendHistory numbers the entry and adds it to the journal. Once the
+// journal is full it is rewritten without its oldest entries.
+func appendHistory(entry HistoryEntry) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	entries, err := loadHistory()
+	if err != nil {
+		return err
+	}
+	entry.Number = 1
+	if len(entries) > 0 {
+		entry.Number = entries[len(entries)-1].Number + 1
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) >= maxHistoryEntries {
+		var sb strings.Builder
+		for _, kept := range append(entries[len(entries)-maxHistoryEntries+1:], entry) {
+			data, err := json.Marshal(kept)
+			if err != nil {
+				return err
+			}
+			sb.Write(data)
+			sb.WriteByte('\n')
+		}
+		return replaceHistory(path, []byte(sb.String()))
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// replaceHistory writes the trimmed journal to a temporary file and renames
+// it over the old one, so a crash halfway leaves one or the other intact
+func replaceHistory(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// recordHistory journals how a transfer ended. A failure to write the
+// journal is reported but never fails the transfer itself.
+func recordHistory(transfer *Transfer, status TransferStatus, err error) {
+	entry := HistoryEntry{
+		Server:      serverAddress,
+		Direction:   transfer.Direction,
+		Type:        strings.ToLower(formatTransferType(transfer.Type)),
+		Name:        transfer.Name,
+		Peer:        transfer.Recipient,
+		Path:        transfer.Path,
+		Source:      transfer.Source,
+		Size:        transfer.Size,
+		WireBytes:   atomic.LoadInt64(&transfer.WireBytes),
+		Compression: transfer.Compression,
+		Checksum:    transfer.Checksum,
+		FinishedAt:  time.Now(),
+		Duration:    time.Since(transfer.StartTime).Seconds(),
+		Status:      status.String(),
+	}
+	if err != nil && status != Completed && status != Cancelled {
+		entry.Error = err.Error()
+	}
+	if err := appendHistory(entry); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error saving transfer history:"), err)
+	}
+}
+
+// recordUnanswered journals an offer that was declined or never answered
+func recordUnanswered(transfer *Transfer, err error) {
+	status := Failed
+	if errors.Is(err, errDeclined) {
+		status = Declined
+	}
+	recordHistory(transfer, status, err)
+}
+
+// historyFilter selects the entries /history shows
+type historyFilter struct {
+	peer   string
+	status string
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+func (f *historyFilter) matches(entry HistoryEntry) bool {
+	switch {
+	case entry.Server != serverAddress:
+		return false
+	case f.peer != "" && entry.Peer != f.peer:
+		return false
+	case f.status != "" && !strings.EqualFold(entry.Status, f.status):
+		return false
+	case !f.since.IsZero() && entry.FinishedAt.Before(f.since):
+		return false
+	case !f.until.IsZero() && !entry.FinishedAt.Before(f.until):
+		return false
+	}
+	return true
+}
+
+// parseHistoryFilter reads "peer <id>", "status <status>", "since <when>",
+// "until <date>" and "last <n>" in any order
+func parseHistoryFilter(args []string) (*historyFilter, error) {
+	filter := &historyFilter{limit: historyPageSize}
+	if len(args)%2 != 0 {
+		return nil, errors.New("every filter needs a value")
+	}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch args[i] {
+		case "peer":
+			filter.peer = value
+		case "status":
+			switch strings.ToLower(value) {
+			case "completed", "failed", "cancelled", "declined":
+				filter.status = value
+			default:
+				return nil, fmt.Errorf("unknown status %q", value)
+			}
+		case "since":
+			since, err := parseHistoryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			filter.since = since
+		case "until":
+			day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q, use YYYY-MM-DD", value)
+			}
+			filter.until = day.AddDate(0, 0, 1)
+		case "last":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid number of entries %q", value)
+			}
+			filter.limit = limit
+		default:
+			return nil, fmt.Errorf("unknown filter %q", args[i])
+		}
+	}
+	return filter, nil
+}
+
+// parseHistoryTime reads a date such as "2024-05-01" or how long ago, such
+// as "12h" or "7d"
+func parseHistoryTime(value string) (time.Time, error) {
+	if day, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return day, nil
+	}
+	if days, found := strings.CutSuffix(value, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return time.Now().Add(-ago), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DD or e.g. 12h or 7d", value)
+}
+
+// HandleHistory handles "/history [filters]", which lists finished transfers,
+// and "/history retry <number>", which sends an entry again or asks its
+// sender for it again
+func HandleHistory(conn net.Conn, args []string) {
+	if len(args) > 0 && args[0] == "retry" {
+		if len(args) != 2 {
+			fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /history retry <number>"))
+			return
+		}
+		retryHistory(conn, args[1])
+		return
+	}
+
+	filter, err := parseHistoryFilter(args)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Invalid filter:"), err)
+		fmt.Println(utils.InfoColor("Use: /history [peer <userId>] [status completed|failed|cancelled|declined] [since <YYYY-MM-DD|12h|7d>] [until <YYYY-MM-DD>] [last <n>]"))
+		return
+	}
+
+	historyMutex.Lock()
+	entries, err := loadHistory()
+	historyMutex.Unlock()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error reading transfer history:"), err)
+		return
+	}
+
+	var matched []HistoryEntry
+	for _, entry := range entries {
+		if filter.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	if len(matched) == 0 {
+		fmt.Println(utils.InfoColor("📜 No transfers in the history match"))
+		return
+	}
+
+	shown := matched[max(len(matched)-filter.limit, 0):]
+	fmt.Printf("%s %d of %d\n", utils.HeaderColor("📜 Transfer history:"), len(shown), len(matched))
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+	for _, entry := range shown {
+		printHistoryEntry(entry)
+	}
+	fmt.Printf("  %s - Send it again, or ask its sender for it again\n", utils.CommandColor("/history retry <number>"))
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+}
+
+func printHistoryEntry(entry HistoryEntry) {
+	statusColor, statusIcon := utils.SuccessColor, "✅"
+	switch entry.Status {
+	case Failed.String():
+		statusColor, statusIcon = utils.ErrorColor, "❌"
+	case Cancelled.String(), Declined.String():
+		statusColor, statusIcon = utils.WarningColor, "🚫"
+	}
+	directionIcon, relation := "📤", "To"
+	if entry.Direction == "receive" {
+		directionIcon, relation = "📥", "From"
+	}
+
+	fmt.Printf("%s %s %s %s (%s, %s) %s\n",
+		utils.CommandColor(fmt.Sprintf("#%d", entry.Number)),
+		statusColor(statusIcon),
+		directionIcon,
+		utils.InfoColor(entry.Name),
+		entry.Type,
+		formatSize(entry.Size),
+		statusColor(entry.Status))
+	fmt.Printf("   %s: %s | %s | Took: %s\n",
+		relation,
+		utils.UserColor(entry.Peer),
+		entry.FinishedAt.Local().Format("2006-01-02 15:04"),
+		formatDuration(time.Duration(entry.Duration*float64(time.Second))))
+	if entry.Checksum != "" {
+		fmt.Printf("   Checksum: %s\n", entry.Checksum)
+	}
+	if entry.Compression != "" {
+		fmt.Printf("   Wire: %s, %s compressed\n", formatSize(entry.WireBytes), entry.Compression)
+	}
+	if entry.Error != "" {
+		fmt.Printf("   %s %s\n", utils.ErrorColor("Error:"), entry.Error)
+	}
+}
+
+// retryHistory sends an entry of ours again, or asks the sender of an entry
+// we received to send it again
+func retryHistory(conn net.Conn, number string) {
+	historyMutex.Lock()
+	entries, err := loadHistory()
+	historyMutex.Unlock()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error reading transfer history:"), err)
+		return
+	}
+
+	var entry *HistoryEntry
+	for i := range entries {
+		if strconv.Itoa(entries[i].Number) == strings.TrimPrefix(number, "#") {
+			entry = &entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		fmt.Println(utils.ErrorColor("❌ No history entry"), utils.CommandColor(number))
+		return
+	}
+	if entry.Server != serverAddress {
+		fmt.Println(utils.ErrorColor("❌ That transfer went through another server:"), entry.Server)
+		return
+	}
+
+	if entry.Direction == "send" {
+		fmt.Println(utils.InfoColor("📤 Sending"), utils.InfoColor(entry.Name), utils.InfoColor("again to"), utils.UserColor(entry.Peer))
+		if entry.Type == "folder" {
+			HandleSendFolder(conn, entry.Peer, entry.Path)
+		} else {
+			HandleSendFile(conn, entry.Peer, "", entry.Path)
+		}
+		return
+	}
+
+	// Without the path we downloaded it from, the sender can only look for the name
+	source := entry.Source
+	if source == "" {
+		source = entry.Name
+	}
+	fmt.Println(utils.InfoColor("📥 Asking"), utils.UserColor(entry.Peer), utils.InfoColor("for"), utils.InfoColor(entry.Name), utils.InfoColor("again"))
+	HandleDownloadRequest(conn, entry.Peer, source)
+}
@@ -0,0 +1,39 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryTrimsOldestEntries(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+
+	for i := 0; i < maxHistoryEntries+5; i++ {
+		if err := appendHistory(HistoryEntry{Name: "file"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != maxHistoryEntries || entries[0].Number != 6 || entries[len(entries)-1].Number != maxHistoryEntries+5 {
+		t.Fatalf("kept %d entries numbered %d to %d", len(entries), entries[0].Number, entries[len(entries)-1].Number)
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Name() != historyFile {
+		t.Errorf("config directory holds %d files, want only the journal", len(left))
+	}
+}
@@ -0,0 +1,197 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// sessionsFile keeps one "<server address> <username> <token>" line per server
+const sessionsFile = "sessions"
+
+// Login authenticates with the server and tells it where our shared files
+// live. A saved session token is tried first; otherwise the user is asked
+// for a password. A username the server has not seen before is registered
+// with the given password; afterwards only that password gets the account back.
+func Login(conn net.Conn) error {
+	frame, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if message := string(frame.Payload); message != "/LOGIN" {
+		return fmt.Errorf("unexpected message during login: %q", message)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+
+	username, token := savedSession()
+
+	var lastStorePath string
+	for {
+		if token != "" {
+			fmt.Println(utils.InfoColor("🔄 Resuming saved session as"), utils.UserColor(username))
+			if err := protocol.SendCommand(conn, "/RECONNECT "+token); err != nil {
+				return err
+			}
+		} else {
+			username = promptLine(reader, "Username")
+			password, err := promptPassword(reader)
+			if err != nil {
+				return err
+			}
+			if err := protocol.SendCommand(conn, fmt.Sprintf("/AUTH %s %s", username, password)); err != nil {
+				return err
+			}
+		}
+
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return fmt.Errorf("server closed the connection: %v", err)
+		}
+
+		message := string(frame.Payload)
+		if strings.HasPrefix(message, "/AUTH_FAILED") {
+			reason := strings.TrimSpace(strings.TrimPrefix(message, "/AUTH_FAILED"))
+			if token != "" {
+				// Fall back to the password once the saved session is gone
+				fmt.Println(utils.WarningColor("⚠ Saved session not accepted:"), reason)
+				forgetSession()
+				token = ""
+				continue
+			}
+			fmt.Println(utils.ErrorColor("❌ Login failed:"), reason)
+			continue
+		}
+
+		// /AUTH_OK <userId> <registered|returning|resumed> <token> <lastStorePath>
+		parts := strings.SplitN(message, " ", 5)
+		if len(parts) != 5 || parts[0] != "/AUTH_OK" {
+			return fmt.Errorf("unexpected message during login: %q", message)
+		}
+		myUserID = parts[1]
+		switch parts[2] {
+		case "registered":
+			fmt.Println(utils.SuccessColor("🆕 Account " + username + " created"))
+		default:
+			fmt.Println(utils.SuccessColor("👋 Welcome back " + username + "!"))
+		}
+		fmt.Println(utils.SuccessColor("[Info] Your user ID is: "), utils.CommandColor(myUserID))
+		saveSession(username, parts[3])
+		if parts[4] != "-" {
+			lastStorePath = parts[4]
+		}
+		break
+	}
+
+	// Reuse the folder shared last time if it is still there
+	storePath := lastStorePath
+	if info, err := os.Stat(storePath); storePath == "" || err != nil || !info.IsDir() {
+		storePath = promptStorePath(reader)
+	} else {
+		fmt.Println(utils.InfoColor("📂 Sharing"), utils.InfoColor(storePath))
+	}
+	myStorePath = storePath
+
+	return protocol.SendCommand(conn, "/STORE_PATH "+storePath)
+}
+
+// Logout revokes this device's session on the server so the next start asks
+// for the password again
+func Logout(conn net.Conn) {
+	if _, token := savedSession(); token != "" {
+		protocol.SendCommand(conn, "/LOGOUT "+token)
+	}
+	forgetSession()
+	fmt.Println(utils.InfoColor("👋 Logged out, you will need your password next time"))
+	conn.Close()
+}
+
+// savedSession returns the username and token stored for the current server
+func savedSession() (string, string) {
+	sessions, err := loadAddressBook(sessionsFile)
+	if err != nil {
+		return "", ""
+	}
+	fields := strings.Fields(sessions[serverAddress])
+	if len(fields) != 2 {
+		return "", ""
+	}
+	return fields[0], fields[1]
+}
+
+func saveSession(username, token string) {
+	updateSessions(func(sessions map[string]string) {
+		sessions[serverAddress] = username + " " + token
+	})
+}
+
+func forgetSession() {
+	updateSessions(func(sessions map[string]string) {
+		delete(sessions, serverAddress)
+	})
+}
+
+func updateSessions(update func(map[string]string)) {
+	sessions, err := loadAddressBook(sessionsFile)
+	if err == nil {
+		update(sessions)
+		err = saveAddressBook(sessionsFile, sessions)
+	}
+	if err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not update saved session:"), err)
+	}
+}
+
+func promptLine(reader *bufio.Reader, attribute string) string {
+	for {
+		fmt.Println("Enter your " + attribute + ": ")
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input != "" && !strings.ContainsAny(input, " \t") {
+			return input
+		}
+		fmt.Println(utils.ErrorColor("❌ Error: " + attribute + " must be a single word"))
+	}
+}
+
+// promptPassword reads a password without echoing it when stdin is a terminal
+func promptPassword(reader *bufio.Reader) (string, error) {
+	fmt.Println("Enter your Password: ")
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(password), err
+	}
+
+	password, err := reader.ReadString('\n')
+	if err != nil && password == "" {
+		return "", errors.New("no password given")
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+func promptStorePath(reader *bufio.Reader) string {
+	fmt.Println("Enter your Store File Path: ")
+	for {
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+
+		fileInfo, err := os.Stat(input)
+		if os.IsNotExist(err) {
+			fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist"))
+		} else if err != nil || !fileInfo.IsDir() {
+			fmt.Println(utils.ErrorColor("❌ Error: Path is not a directory"))
+		} else {
+			return input
+		}
+		fmt.Println("Enter a valid Store File Path: ")
+	}
+}
@@ -0,0 +1,259 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest name most filesystems allow, in bytes
+const maxNameLength = 255
+
+// CollisionPolicy says what happens when an offer has the name of something
+// already in the store path
+type CollisionPolicy int
+
+const (
+	// RenameOnCollision saves it as "name (1).ext", "name (2).ext", ...
+	RenameOnCollision CollisionPolicy = iota
+	// SkipOnCollision declines the offer
+	SkipOnCollision
+	// OverwriteOnCollision replaces the file, or adds to the folder
+	OverwriteOnCollision
+	// AskOnCollision waits for /accept <id> rename|overwrite or /decline
+	AskOnCollision
+)
+
+// String representation of CollisionPolicy
+func (p CollisionPolicy) String() string {
+	switch p {
+	case SkipOnCollision:
+		return "skip"
+	case OverwriteOnCollision:
+		return "overwrite"
+	case AskOnCollision:
+		return "ask"
+	default:
+		return "rename"
+	}
+}
+
+var collisionPolicy = RenameOnCollision
+
+// SetCollisionPolicy sets what happens to offers whose name is taken, e.g.
+// from the -on-collision flag
+func SetCollisionPolicy(value string) error {
+	for _, policy := range []CollisionPolicy{RenameOnCollision, SkipOnCollision, OverwriteOnCollision, AskOnCollision} {
+		if strings.EqualFold(value, policy.String()) {
+			collisionPolicy = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown collision policy %q, use rename, skip, overwrite or ask", value)
+}
+
+// reservedNames cannot be used as file names on Windows, with any extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName turns the name a sender gave a file or folder into one that
+// is safe to create in the store path: a safe element, as sanitizeElement
+// makes it, that cannot be mistaken for the partial download of another
+func sanitizeName(name string) string {
+	name = sanitizeElement(name)
+	for _, suffix := range []string{partialSuffix, partialInfoSuffix, partialListingSuffix} {
+		if strings.HasSuffix(strings.ToLower(name), suffix) {
+			return truncateName(name+"_", maxNameLength)
+		}
+	}
+	return name
+}
+
+// sanitizeElement turns one element of a path from the sender into a single
+// path element without control characters or characters Windows forbids,
+// that is not a reserved device name
+func sanitizeElement(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`/\<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows drops trailing dots and spaces, which could turn "a." into "a"
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "unnamed"
+	}
+	if stem, _, _ := strings.Cut(name, "."); reservedNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+	return truncateName(name, maxNameLength)
+}
+
+// renamedEntry is an entry of a received folder saved under a safe name
+type renamedEntry struct {
+	Path string
+	As   string
+}
+
+// sanitizeListing makes every element of the paths in a folder listing safe
+// to create here, as sanitizeElement does, and returns the entries it
+// renamed. Links are pointed at the renamed entries too. A listing whose
+// names only differ in what was made safe is refused.
+func sanitizeListing(entries []protocol.FolderEntry) ([]renamedEntry, error) {
+	var renamed []renamedEntry
+	for i := range entries {
+		entry := &entries[i]
+		safe := sanitizePath(entry.Path, false)
+		if safe != entry.Path {
+			renamed = append(renamed, renamedEntry{Path: entry.Path, As: safe})
+			entry.Path = safe
+		}
+		if entry.Link != "" {
+			entry.Link = sanitizePath(entry.Link, true)
+		}
+	}
+	if err := protocol.CheckFolderListing(entries); err != nil {
+		return nil, fmt.Errorf("%v once its names are made safe", err)
+	}
+	return renamed, nil
+}
+
+// sanitizePath applies sanitizeElement to every element of a slash separated
+// path. A link target keeps its "." and ".." elements and a leading slash.
+func sanitizePath(p string, link bool) string {
+	elements := strings.Split(p, "/")
+	for i, element := range elements {
+		if link && (element == "" || element == "." || element == "..") {
+			continue
+		}
+		elements[i] = sanitizeElement(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// truncateName shortens a name to at most limit bytes, keeping its extension
+func truncateName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > limit/2 {
+		ext = ""
+	}
+	stem := name[:limit-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// namesInUse are the paths incoming transfers are being saved to, so two
+// offers of the same name never write to the same place
+var (
+	namesInUse      = make(map[string]bool)
+	namesInUseMutex sync.Mutex
+)
+
+// nameTaken reports whether something of that name is in the store path
+// already or on its way there
+func nameTaken(storePath, name string) bool {
+	path := filepath.Join(storePath, name)
+	if namesInUse[path] {
+		return true
+	}
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// collides reports whether an offer's name is taken in the store path
+func collides(storePath string, offer *IncomingOffer) bool {
+	namesInUseMutex.Lock()
+	defer namesInUseMutex.Unlock()
+	return nameTaken(storePath, offer.Name)
+}
+
+// claimName decides the name an accepted offer is saved under and holds it
+// until releaseName. It returns false if the policy skips the offer.
+func claimName(storePath string, offer *IncomingOffer, policy CollisionPolicy) bool {
+	namesInUseMutex.Lock()
+	defer namesInUseMutex.Unlock()
+
+	offer.SaveAs = offer.Name
+	if nameTaken(storePath, offer.Name) {
+		switch policy {
+		case SkipOnCollision:
+			return false
+		case OverwriteOnCollision:
+			// A file cannot replace a folder, nor can a folder be added to a file
+			info, err := os.Stat(filepath.Join(storePath, offer.Name))
+			if namesInUse[filepath.Join(storePath, offer.Name)] || err != nil || info.IsDir() != (offer.Type == FolderTransfer) {
+				offer.SaveAs = freeName(storePath, offer)
+			}
+		default:
+			offer.SaveAs = freeName(storePath, offer)
+		}
+	}
+	namesInUse[filepath.Join(storePath, offer.SaveAs)] = true
+	return true
+}
+
+// releaseName lets other offers use the name a transfer was saved under
+func releaseName(path string) {
+	namesInUseMutex.Lock()
+	delete(namesInUse, path)
+	namesInUseMutex.Unlock()
+}
+
+// freeName returns the first of "name (1).ext", "name (2).ext", ... that is
+// not taken. Call with namesInUseMutex held.
+func freeName(storePath string, offer *IncomingOffer) string {
+	stem, ext := offer.Name, ""
+	if offer.Type != FolderTransfer {
+		ext = filepath.Ext(offer.Name)
+		stem = strings.TrimSuffix(offer.Name, ext)
+		if stem == "" || len(ext) > maxNameLength/2 {
+			stem, ext = offer.Name, ""
+		}
+	}
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		name := truncateName(stem, maxNameLength-len(suffix)-len(ext)) + suffix + ext
+		if !nameTaken(storePath, name) {
+			return name
+		}
+	}
+}
+
+// Renamed returns the entries of a received folder saved under a safe name
+func (p *PartialFile) Renamed() []renamedEntry {
+	if store, ok := p.partialStore.(*folderStore); ok {
+		return store.renamed
+	}
+	return nil
+}
+
+// printRenamed lists the entries of a received folder saved under a safe name
+func printRenamed(renamed []renamedEntry) {
+	if len(renamed) == 0 {
+		return
+	}
+	fmt.Printf("%s %d entries of the folder were renamed to be safe here:\n", utils.InfoColor("📝"), len(renamed))
+	for _, entry := range renamed {
+		fmt.Printf("   %q saved as '%s'\n", entry.Path, entry.As)
+	}
+}
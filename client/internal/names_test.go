@@ -0,0 +1,140 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{`C:\Windows\evil.exe`, "C__Windows_evil.exe"},
+		{"a\x00b\x1fc\x7f.txt", "abc.txt"},
+		{"what?<>|*\".txt", "what______.txt"},
+		{"trailing. . ", "trailing"},
+		{"  spaced  ", "spaced"},
+		{"CON", "_CON"},
+		{"aux.txt", "_aux.txt"},
+		{"Com1.tar.gz", "_Com1.tar.gz"},
+		{"LPT9 .log", "_LPT9 .log"},
+		{"CONSOLE", "CONSOLE"},
+		{"", "unnamed"},
+		{"..", "unnamed"},
+		{"...", "unnamed"},
+		{"\x01\x02", "unnamed"},
+		{"movie.part", "movie.part_"},
+		{"movie.PART", "movie.PART_"},
+		{"bad\xffutf8", "bad_utf8"},
+	} {
+		if got := sanitizeName(tc.name); got != tc.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	long := strings.Repeat("é", 200) + ".txt"
+	got := sanitizeName(long)
+	if len(got) > maxNameLength || !strings.HasSuffix(got, ".txt") || !strings.HasPrefix(got, "éé") {
+		t.Errorf("sanitizeName of a %d byte name = %q (%d bytes)", len(long), got, len(got))
+	}
+}
+
+func TestSanitizeListing(t *testing.T) {
+	entries := []protocol.FolderEntry{
+		{Path: "docs", Dir: true},
+		{Path: "docs/aux.txt", Size: 1},
+		{Path: "docs/note. ", Size: 1},
+		{Path: "con", Dir: true},
+		{Path: "con/a\tb", Size: 1},
+		{Path: "fine.part", Size: 1},
+		{Path: "link", Link: "docs/aux.txt"},
+		{Path: "up", Link: "../docs/./aux.txt"},
+	}
+	renamed, err := sanitizeListing(entries)
+	if err != nil {
+		t.Fatalf("sanitizeListing: %v", err)
+	}
+
+	want := []string{"docs", "docs/_aux.txt", "docs/note", "_con", "_con/ab", "fine.part", "link", "up"}
+	for i, entry := range entries {
+		if entry.Path != want[i] {
+			t.Errorf("entry %d = %q, want %q", i, entry.Path, want[i])
+		}
+	}
+	if entries[6].Link != "docs/_aux.txt" || entries[7].Link != "../docs/./_aux.txt" {
+		t.Errorf("links point to %q and %q, want the renamed file", entries[6].Link, entries[7].Link)
+	}
+	if len(renamed) != 4 || renamed[0].Path != "docs/aux.txt" || renamed[0].As != "docs/_aux.txt" {
+		t.Errorf("renamed = %+v", renamed)
+	}
+}
+
+func TestSanitizeListingRefusesMerges(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []protocol.FolderEntry
+	}{
+		{"same name", []protocol.FolderEntry{{Path: "a."}, {Path: "a"}}},
+		{"same after mapping", []protocol.FolderEntry{{Path: "a:b"}, {Path: "a_b"}}},
+		{"under a file", []protocol.FolderEntry{{Path: "a"}, {Path: "a. /b"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := sanitizeListing(tc.entries); err == nil {
+				t.Errorf("accepted %+v", tc.entries)
+			}
+		})
+	}
+}
+
+func TestExtractSanitizesNames(t *testing.T) {
+	setLimits(t, KeepSymlinks, DefaultMaxFolderEntries)
+	entries := []protocol.FolderEntry{
+		dirEntry("NUL"),
+		fileEntry("NUL/aux.txt", "hi"),
+		fileEntry("bell\a. ", "!"),
+		linkEntry("link", "NUL/aux.txt"),
+	}
+	store, err := receiveFolder(t, entries, "hi!", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{"_NUL/_aux.txt": "hi", "bell": "!", "link": "hi"} {
+		got, err := os.ReadFile(filepath.Join(store.dir, filepath.FromSlash(path)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"NUL", "bell\a. "} {
+		if _, err := os.Lstat(filepath.Join(store.dir, path)); err == nil {
+			t.Errorf("%q was created as sent", path)
+		}
+	}
+	if len(store.renamed) != 3 || len(store.skipped) != 0 {
+		t.Errorf("renamed %+v, skipped %+v", store.renamed, store.skipped)
+	}
+
+	// A resumed transfer finds the same names again
+	resumed, err := openFolderStore(store.dir, store.listingPath, store.offered, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if resumed.held != store.offered || len(resumed.renamed) != 3 {
+		t.Errorf("resumed store holds %d of %d bytes with %d renamed", resumed.held, store.offered, len(resumed.renamed))
+	}
+}
+
+func TestExtractRefusesMergedNames(t *testing.T) {
+	setLimits(t, SkipSymlinks, DefaultMaxFolderEntries)
+	if _, err := receiveFolder(t, []protocol.FolderEntry{fileEntry("a?", "1"), fileEntry("a_", "2")}, "12", 0); !errors.Is(err, errUnsafeFolder) {
+		t.Errorf("error = %v, want errUnsafeFolder", err)
+	}
+}
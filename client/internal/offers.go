@@ -0,0 +1,431 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offerTimeout bounds how long an offer waits for /accept or /decline
+const offerTimeout = 5 * time.Minute
+
+// errDeclined is why an offer the recipient refused was not sent
+var errDeclined = errors.New("the recipient declined")
+
+// IncomingOffer is a file or folder someone wants to send us. Nothing is
+// written to the store path until the offer is accepted.
+type IncomingOffer struct {
+	ID          string // the transfer ID it keeps once accepted
+	Type        TransferType
+	Token       string
+	SenderId    string
+	SenderName  string
+	RoomID      string
+	Name        string
+	Size        int64
+	Checksum    string
+	Algorithm   string // what Checksum was computed with
+	Streams     int    // data connections the sender splits the file over
+	Compression string // what the sender compresses the data with, if anything
+	Candidates  string
+	SenderKey   string
+	ReceivedAt  time.Time
+	Source      string // the path we asked the sender for, if we sent a /download
+	SaveAs      string // the name it is saved under once accepted, see claimName
+}
+
+// requestedDownload is a /download waiting for the offer it leads to
+type requestedDownload struct {
+	Path string
+	At   time.Time
+}
+
+var (
+	pendingOffers      = make(map[string]*IncomingOffer)
+	pendingOffersMutex sync.Mutex
+
+	// requestedDownloads remembers the names we asked for with /download so
+	// the matching offer is accepted without asking again
+	requestedDownloads      = make(map[string]requestedDownload)
+	requestedDownloadsMutex sync.Mutex
+)
+
+// offerAttributes returns the attributes we attach to an outgoing offer
+func offerAttributes(roomID string, streams int, compression string) string {
+	attributes := map[string]string{protocol.AttrHash: protocol.DefaultHash}
+	if roomID != "" {
+		attributes[protocol.AttrRoom] = roomID
+	}
+	if streams > 1 {
+		attributes[protocol.AttrStreams] = strconv.Itoa(streams)
+	}
+	if compression != "" {
+		attributes[protocol.AttrCompress] = compression
+	}
+	return protocol.EncodeAttributes(attributes)
+}
+
+// ParseOffer reads a "/FILE_RESPONSE" or "/FOLDER_RESPONSE" from the server:
+// "<command> <token> <senderId> <senderName> <size> <checksum> <candidates> <publicKey> <attributes> <name>"
+func ParseOffer(message string, transferType TransferType) (*IncomingOffer, error) {
+	args := strings.SplitN(message, " ", 10)
+	if len(args) != 10 {
+		return nil, errors.New("wrong number of arguments")
+	}
+	size, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid size %q", args[4])
+	}
+
+	attributes := protocol.DecodeAttributes(args[8])
+	return &IncomingOffer{
+		Type:        transferType,
+		Token:       args[1],
+		SenderId:    args[2],
+		SenderName:  args[3],
+		RoomID:      attributes[protocol.AttrRoom],
+		Name:        args[9],
+		Size:        size,
+		Checksum:    args[5],
+		Algorithm:   attributes[protocol.AttrHash], // see offerChecksum when empty
+		Streams:     protocol.OfferStreams(attributes),
+		Compression: attributes[protocol.AttrCompress],
+		Candidates:  args[6],
+		SenderKey:   args[7],
+		ReceivedAt:  time.Now(),
+	}, nil
+}
+
+// HandleOffer starts an incoming transfer right away if an auto-accept rule
+// allows it, and otherwise asks the user
+func HandleOffer(conn net.Conn, offer *IncomingOffer) {
+	offer.ID = GenerateTransferID()
+
+	// Whatever the sender calls it, it may only ever land in our store path
+	if safe := sanitizeName(offer.Name); safe != offer.Name {
+		fmt.Printf("%s %q from %s is offered as '%s' instead, a name safe to use here\n",
+			utils.WarningColor("⚠"),
+			offer.Name,
+			utils.UserColor(offer.SenderName),
+			safe)
+		offer.Name = safe
+	}
+
+	// We could never verify, read or safely extract what arrives, so refuse it outright
+	err := offerChecksum(offer)
+	if err == nil {
+		err = protocol.CheckCompression(offer.Compression)
+	}
+	if err == nil && offer.Type == FolderTransfer {
+		err = checkFolderSize(offer.Size)
+	}
+	if err != nil {
+		fmt.Printf("%s Refusing '%s' from %s: %v\n",
+			utils.ErrorColor("🚫"),
+			offer.Name,
+			utils.UserColor(offer.SenderName),
+			err)
+		if err := protocol.SendCommand(conn, "/TRANSFER_DECLINE "+offer.Token); err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error declining offer:"), err)
+		}
+		return
+	}
+
+	reason := autoAcceptReason(offer)
+	asking := false
+	if collides(myStorePath, offer) {
+		switch collisionPolicy {
+		case SkipOnCollision:
+			skipOffer(conn, offer)
+			return
+		case AskOnCollision:
+			// Only the user can say what happens to what they already have
+			asking, reason = true, ""
+		}
+	}
+
+	if reason != "" {
+		fmt.Printf("%s Accepting %s '%s' from %s automatically (%s)\n",
+			utils.SuccessColor("📨"),
+			strings.ToLower(formatTransferType(offer.Type)),
+			utils.InfoColor(offer.Name),
+			utils.UserColor(offer.SenderName),
+			reason)
+		startOffer(conn, offer, collisionPolicy)
+		return
+	}
+
+	pendingOffersMutex.Lock()
+	pendingOffers[offer.ID] = offer
+	pendingOffersMutex.Unlock()
+
+	// Forget the offer once the sender has given up waiting
+	time.AfterFunc(offerTimeout, func() {
+		if takeOffer(offer.ID) != nil {
+			fmt.Printf("%s Offer %s of '%s' from %s expired\n",
+				utils.WarningColor("⌛"),
+				utils.CommandColor(offer.ID),
+				offer.Name,
+				utils.UserColor(offer.SenderName))
+		}
+	})
+
+	fmt.Printf("\n%s %s wants to send you a %s (Transfer ID: %s)\n",
+		utils.HeaderColor("📨"),
+		utils.UserColor(fmt.Sprintf("%s (%s)", offer.SenderName, offer.SenderId)),
+		strings.ToLower(formatTransferType(offer.Type)),
+		utils.CommandColor(offer.ID))
+	printOfferDetails(offer)
+	if asking {
+		printCollision(offer)
+		return
+	}
+	fmt.Printf("   %s to receive it or %s to refuse\n",
+		utils.CommandColor("/accept "+offer.ID),
+		utils.CommandColor("/decline "+offer.ID))
+}
+
+// printCollision asks what to do with an offer whose name is taken
+func printCollision(offer *IncomingOffer) {
+	fmt.Printf("   %s '%s' already exists: %s keeps both, %s replaces it, %s refuses it\n",
+		utils.WarningColor("⚠"),
+		offer.Name,
+		utils.CommandColor("/accept "+offer.ID+" rename"),
+		utils.CommandColor("/accept "+offer.ID+" overwrite"),
+		utils.CommandColor("/decline "+offer.ID))
+}
+
+// offerChecksum checks that we can verify an offer with the algorithm it
+// names. Only clients that predate the hash attribute leave it out, and
+// their offers are checked with MD5. A server that announced hashing passes
+// the attribute on, so there an offer without it is refused: the attribute
+// was stripped on the way to force the weaker check.
+func offerChecksum(offer *IncomingOffer) error {
+	if offer.Algorithm != "" {
+		_, err := protocol.NewChecksum(offer.Algorithm)
+		return err
+	}
+	if ServerSupports(protocol.FeatureHashing) {
+		return errors.New("the offer names no checksum algorithm, although this server passes it on")
+	}
+	fmt.Printf("%s '%s' from %s can only be checked with MD5, the sender predates SHA-256 checksums\n",
+		utils.WarningColor("⚠"),
+		offer.Name,
+		utils.UserColor(offer.SenderName))
+	offer.Algorithm = protocol.HashMD5
+	return nil
+}
+
+func printOfferDetails(offer *IncomingOffer) {
+	fmt.Printf("   Name: %s | Size: %s\n", utils.InfoColor(offer.Name), utils.InfoColor(formatSize(offer.Size)))
+	if offer.Checksum == protocol.ChecksumFollows {
+		fmt.Printf("   Checksum (%s): sent after the data\n", offer.Algorithm)
+	} else {
+		fmt.Printf("   Checksum (%s): %s\n", offer.Algorithm, utils.InfoColor(offer.Checksum))
+	}
+	if offer.Compression != "" {
+		fmt.Printf("   Compressed with: %s\n", offer.Compression)
+	}
+	if offer.RoomID != "" {
+		fmt.Printf("   Sent to room: %s\n", utils.InfoColor(offer.RoomID))
+	}
+}
+
+// takeOffer removes a pending offer and returns it, or nil if there is none
+func takeOffer(id string) *IncomingOffer {
+	pendingOffersMutex.Lock()
+	defer pendingOffersMutex.Unlock()
+	offer, exists := pendingOffers[id]
+	if !exists {
+		return nil
+	}
+	delete(pendingOffers, id)
+	return offer
+}
+
+// ListOffers returns the offers still waiting for an answer, oldest first
+func ListOffers() []*IncomingOffer {
+	pendingOffersMutex.Lock()
+	defer pendingOffersMutex.Unlock()
+
+	offers := make([]*IncomingOffer, 0, len(pendingOffers))
+	for _, offer := range pendingOffers {
+		offers = append(offers, offer)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].ReceivedAt.Before(offers[j].ReceivedAt) })
+	return offers
+}
+
+// HandleAcceptOffer handles "/accept <id> [rename|overwrite]". Without a
+// choice, an offer whose name is taken follows the collision policy, and
+// under "ask" stays pending until the user makes one.
+func HandleAcceptOffer(conn net.Conn, id, choice string) {
+	policy := collisionPolicy
+	switch choice {
+	case "":
+	case "rename":
+		policy = RenameOnCollision
+	case "overwrite":
+		policy = OverwriteOnCollision
+	default:
+		fmt.Println(utils.ErrorColor("❌ Invalid choice. Use: /accept <transferId> [rename|overwrite]"))
+		return
+	}
+
+	pendingOffersMutex.Lock()
+	offer, exists := pendingOffers[id]
+	pendingOffersMutex.Unlock()
+	if exists && policy == AskOnCollision && collides(myStorePath, offer) {
+		printCollision(offer)
+		return
+	}
+
+	if offer = takeOffer(id); offer == nil {
+		fmt.Println(utils.ErrorColor("❌ No pending offer with ID:"), utils.CommandColor(id))
+		return
+	}
+	startOffer(conn, offer, policy)
+}
+
+// HandleDeclineOffer handles the /decline command
+func HandleDeclineOffer(conn net.Conn, id string) {
+	offer := takeOffer(id)
+	if offer == nil {
+		fmt.Println(utils.ErrorColor("❌ No pending offer with ID:"), utils.CommandColor(id))
+		return
+	}
+	if err := protocol.SendCommand(conn, "/TRANSFER_DECLINE "+offer.Token); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error declining offer:"), err)
+		return
+	}
+	fmt.Printf("%s Declined '%s' from %s\n",
+		utils.WarningColor("🚫"),
+		offer.Name,
+		utils.UserColor(offer.SenderName))
+}
+
+// startOffer decides the name the offer is saved under, tells the sender we
+// accept and starts receiving
+func startOffer(conn net.Conn, offer *IncomingOffer, policy CollisionPolicy) {
+	if !claimName(myStorePath, offer, policy) {
+		skipOffer(conn, offer)
+		return
+	}
+	if err := protocol.SendCommand(conn, "/TRANSFER_ACCEPT "+offer.Token); err != nil {
+		releaseName(filepath.Join(myStorePath, offer.SaveAs))
+		fmt.Println(utils.ErrorColor("❌ Error accepting offer:"), err)
+		return
+	}
+	if offer.SaveAs != offer.Name {
+		fmt.Printf("%s '%s' already exists, saving as '%s'\n",
+			utils.InfoColor("📝"),
+			offer.Name,
+			utils.InfoColor(offer.SaveAs))
+	}
+	if offer.Type == FolderTransfer {
+		go HandleFolderTransfer(conn, offer, myStorePath)
+	} else {
+		go HandleFileTransfer(conn, offer, myStorePath)
+	}
+}
+
+// skipOffer declines an offer of something we already have
+func skipOffer(conn net.Conn, offer *IncomingOffer) {
+	fmt.Printf("%s Skipping '%s' from %s, it already exists\n",
+		utils.WarningColor("⏭"),
+		offer.Name,
+		utils.UserColor(offer.SenderName))
+	if err := protocol.SendCommand(conn, "/TRANSFER_DECLINE "+offer.Token); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error declining offer:"), err)
+	}
+}
+
+// expectDownload records a /download so the offer it leads to is accepted
+func expectDownload(userId, filePath string) {
+	requestedDownloadsMutex.Lock()
+	defer requestedDownloadsMutex.Unlock()
+	requestedDownloads[downloadKey(userId, filePath)] = requestedDownload{Path: filePath, At: time.Now()}
+}
+
+// takeExpectedDownload reports whether we asked the sender for this offer and
+// if so notes what we asked for
+func takeExpectedDownload(offer *IncomingOffer) bool {
+	requestedDownloadsMutex.Lock()
+	defer requestedDownloadsMutex.Unlock()
+	key := downloadKey(offer.SenderId, offer.Name)
+	requested, exists := requestedDownloads[key]
+	if !exists {
+		return false
+	}
+	delete(requestedDownloads, key)
+	if time.Since(requested.At) >= offerTimeout {
+		return false
+	}
+	offer.Source = requested.Path
+	return true
+}
+
+// downloadKey matches a requested path against the name in an offer; the
+// sender may use either kind of path separator, and the offer's name has
+// been made safe to use here
+func downloadKey(userId, filePath string) string {
+	name := path.Base(strings.ReplaceAll(strings.TrimSpace(filePath), "\\", "/"))
+	return userId + " " + sanitizeName(name)
+}
+
+var (
+	transferAnswers      = make(map[string]chan bool)
+	transferAnswersMutex sync.Mutex
+)
+
+// transferAnswer returns the channel on which the recipient's answer to an
+// offer is delivered; it is created by whichever side gets there first
+func transferAnswer(token string) chan bool {
+	transferAnswersMutex.Lock()
+	defer transferAnswersMutex.Unlock()
+	ch, exists := transferAnswers[token]
+	if !exists {
+		ch = make(chan bool, 1)
+		transferAnswers[token] = ch
+	}
+	return ch
+}
+
+func forgetTransferAnswer(token string) {
+	transferAnswersMutex.Lock()
+	delete(transferAnswers, token)
+	transferAnswersMutex.Unlock()
+}
+
+// HandleTransferAnswer delivers a "/TRANSFER_ACCEPT" or "/TRANSFER_DECLINE"
+func HandleTransferAnswer(token string, accepted bool) {
+	select {
+	case transferAnswer(token) <- accepted:
+	default:
+	}
+}
+
+// AwaitAnswer waits for the recipient to accept our offer
+func AwaitAnswer(token, recipientId string) error {
+	defer forgetTransferAnswer(token)
+
+	fmt.Println(utils.InfoColor("⏳ Waiting for"), utils.UserColor(recipientId), utils.InfoColor("to accept..."))
+	select {
+	case accepted := <-transferAnswer(token):
+		if !accepted {
+			return errDeclined
+		}
+		return nil
+	case <-time.After(offerTimeout):
+		return errors.New("the recipient did not answer")
+	}
+}
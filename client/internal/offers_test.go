@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"testing"
+)
+
+func TestParseOffer(t *testing.T) {
+	offer, err := ParseOffer("/FILE_RESPONSE tok 7 bob 1024 abc - - hash=sha256,room=r1 my file.txt", FileTransfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.Token != "tok" || offer.SenderId != "7" || offer.SenderName != "bob" || offer.Size != 1024 ||
+		offer.Checksum != "abc" || offer.Algorithm != protocol.HashSHA256 || offer.RoomID != "r1" || offer.Name != "my file.txt" {
+		t.Errorf("ParseOffer = %+v", offer)
+	}
+
+	for _, message := range []string{
+		"/FILE_RESPONSE tok 7 bob 1024 abc - -",
+		"/FILE_RESPONSE tok 7 bob -1 abc - - - a",
+		"/FILE_RESPONSE tok 7 bob big abc - - - a",
+	} {
+		if _, err := ParseOffer(message, FileTransfer); err == nil {
+			t.Errorf("ParseOffer(%q) accepted it", message)
+		}
+	}
+}
+
+func TestOfferChecksum(t *testing.T) {
+	old := serverFeatures
+	t.Cleanup(func() { serverFeatures = old })
+
+	parse := func(attributes string) *IncomingOffer {
+		offer, err := ParseOffer("/FILE_RESPONSE tok 7 bob 1 abc - - "+attributes+" a", FileTransfer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return offer
+	}
+
+	serverFeatures = []string{protocol.FeatureHashing}
+	if offer := parse("hash=sha256"); offerChecksum(offer) != nil || offer.Algorithm != protocol.HashSHA256 {
+		t.Errorf("a SHA-256 offer was not accepted: %+v", offer)
+	}
+	if err := offerChecksum(parse("hash=crc32")); err == nil {
+		t.Error("an unknown algorithm was accepted")
+	}
+	// The server passes the attribute on, so losing it means it was stripped
+	if err := offerChecksum(parse("-")); err == nil {
+		t.Error("an offer without an algorithm fell back to MD5 on a server that announced hashing")
+	}
+
+	serverFeatures = nil
+	if offer := parse("-"); offerChecksum(offer) != nil || offer.Algorithm != protocol.HashMD5 {
+		t.Errorf("an offer on an older server did not fall back to MD5: %+v", offer)
+	}
+}
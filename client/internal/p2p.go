@@ -0,0 +1,323 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// directDialTimeout bounds each attempt to reach a sender directly
+const directDialTimeout = 3 * time.Second
+
+// DirectListener accepts the recipient's direct connection for one transfer
+type DirectListener struct {
+	listener   net.Listener
+	candidates []string
+}
+
+var (
+	relaySignals = make(map[string]chan struct{})
+	relayMutex   sync.Mutex
+)
+
+// relaySignal returns the channel on which the recipient's request to use the
+// relay is delivered; it is created by whichever side gets there first
+func relaySignal(token string) chan struct{} {
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+	ch, exists := relaySignals[token]
+	if !exists {
+		ch = make(chan struct{}, 1)
+		relaySignals[token] = ch
+	}
+	return ch
+}
+
+func forgetRelaySignal(token string) {
+	relayMutex.Lock()
+	delete(relaySignals, token)
+	relayMutex.Unlock()
+}
+
+// HandleTransferPath delivers a "/TRANSFER_PATH <token> relay" from the server
+func HandleTransferPath(token, path string) {
+	if path != protocol.PathRelay {
+		return
+	}
+	select {
+	case relaySignal(token) <- struct{}{}:
+	default:
+	}
+}
+
+// ListenDirect opens an ephemeral listener the recipient can dial for a
+// direct transfer. It returns nil if the server cannot broker direct
+// transfers or no usable address is found, in which case the relay is used.
+func ListenDirect() *DirectListener {
+	if !ServerSupports(protocol.FeatureDirect) {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	var candidates []string
+	for _, ip := range localAddresses() {
+		candidates = append(candidates, net.JoinHostPort(ip, fmt.Sprint(port)))
+	}
+	if len(candidates) == 0 {
+		listener.Close()
+		return nil
+	}
+
+	return &DirectListener{listener: listener, candidates: candidates}
+}
+
+// Candidates returns the encoded address list for a transfer request
+func (d *DirectListener) Candidates() string {
+	if d == nil {
+		return protocol.NoCandidates
+	}
+	return protocol.EncodeCandidates(d.candidates)
+}
+
+// Close stops accepting direct connections
+func (d *DirectListener) Close() {
+	if d != nil {
+		d.listener.Close()
+	}
+}
+
+// Await returns the data connection for the sending side of a transfer:
+// either the recipient dials us directly, or it asks for the relay and we
+// connect to the server instead
+func (d *DirectListener) Await(token string) (net.Conn, error) {
+	conns, err := d.AwaitStreams(token, 1)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
+}
+
+// AwaitStreams returns the data connections of a transfer sent over several
+// streams. The first one decides the path and the others follow it.
+func (d *DirectListener) AwaitStreams(token string, streams int) ([]net.Conn, error) {
+	tokens := streamTokens(token, streams)
+	if d == nil {
+		return openDataConnections(tokens, protocol.RoleSend)
+	}
+	defer d.Close()
+	defer forgetRelaySignal(token)
+
+	type acceptedStream struct {
+		conn  net.Conn
+		index int
+	}
+	accepted := make(chan acceptedStream, streams)
+	go func() {
+		seen := make(map[int]bool)
+		for {
+			conn, err := d.listener.Accept()
+			if err != nil {
+				return
+			}
+			if index := acceptDirect(conn, tokens, seen); index >= 0 {
+				accepted <- acceptedStream{conn, index}
+			}
+		}
+	}()
+
+	conns := make([]net.Conn, streams)
+	select {
+	case stream := <-accepted:
+		conns[stream.index] = stream.conn
+	case <-relaySignal(token):
+		fmt.Println(utils.WarningColor("↪ Direct connection not possible, using the server relay"))
+		return openDataConnections(tokens, protocol.RoleSend)
+	case <-time.After(pairTimeout):
+		return nil, errors.New("recipient never connected")
+	}
+
+	timeout := time.After(pairTimeout)
+	for received := 1; received < streams; received++ {
+		select {
+		case stream := <-accepted:
+			conns[stream.index] = stream.conn
+		case <-timeout:
+			closeAll(conns)
+			return nil, errors.New("recipient never opened all of its streams")
+		}
+	}
+	fmt.Println(utils.SuccessColor("🔗 Recipient connected directly, bypassing the server"))
+	return conns, nil
+}
+
+// acceptDirect checks that an incoming direct connection carries the token
+// of one of our streams and returns which, or -1 if it does not
+func acceptDirect(conn net.Conn, tokens []string, seen map[int]bool) int {
+	conn.SetReadDeadline(time.Now().Add(directDialTimeout))
+	frame, err := protocol.ReadFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return -1
+	}
+
+	hello, err := protocol.ParseDataHello(string(frame.Payload))
+	index := -1
+	if err == nil && hello.Role == protocol.RoleReceive {
+		for i, token := range tokens {
+			if hello.Token == token && !seen[i] {
+				index = i
+			}
+		}
+	}
+	if index < 0 {
+		protocol.SendCommand(conn, "/DATA_REJECTED unknown transfer token")
+		conn.Close()
+		return -1
+	}
+
+	if err := protocol.SendCommand(conn, "/DATA_OK"); err != nil {
+		conn.Close()
+		return -1
+	}
+	seen[index] = true
+	return index
+}
+
+// ConnectToSender returns the data connection for the receiving side of a
+// transfer. It tries every candidate address of the sender in parallel and
+// falls back to the server relay if none of them answers.
+func ConnectToSender(control net.Conn, token, candidates string) (net.Conn, error) {
+	conns, err := ConnectStreams(control, token, candidates, 1)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
+}
+
+// ConnectStreams returns the data connections of a transfer sent over
+// several streams. The others take the path the first one found.
+func ConnectStreams(control net.Conn, token, candidates string, streams int) ([]net.Conn, error) {
+	tokens := streamTokens(token, streams)
+	addresses := protocol.DecodeCandidates(candidates)
+	if len(addresses) == 0 {
+		return openDataConnections(tokens, protocol.RoleReceive)
+	}
+
+	if conn, address := dialDirect(token, addresses); conn != nil {
+		conns := []net.Conn{conn}
+		for _, streamToken := range tokens[1:] {
+			extra, _ := dialDirect(streamToken, []string{address})
+			if extra == nil {
+				closeAll(conns)
+				return nil, errors.New("could not open every stream to the sender")
+			}
+			conns = append(conns, extra)
+		}
+		protocol.SendCommand(control, fmt.Sprintf("/TRANSFER_PATH %s %s", token, protocol.PathDirect))
+		fmt.Println(utils.SuccessColor("🔗 Connected directly to the sender"))
+		return conns, nil
+	}
+
+	fmt.Println(utils.WarningColor("↪ Sender not reachable directly, using the server relay"))
+	if err := protocol.SendCommand(control, fmt.Sprintf("/TRANSFER_PATH %s %s", token, protocol.PathRelay)); err != nil {
+		return nil, err
+	}
+	return openDataConnections(tokens, protocol.RoleReceive)
+}
+
+// reportDone tells the server a transfer ended on our side. A server that
+// brokered it as a direct transfer stops passing signals for it on.
+func reportDone(control net.Conn, token string) {
+	if ServerSupports(protocol.FeatureDirect) {
+		protocol.SendCommand(control, "/TRANSFER_DONE "+token)
+	}
+}
+
+// dialDirect races connections to all addresses and keeps the first one the
+// sender accepts, returning the address it reached
+func dialDirect(token string, addresses []string) (net.Conn, string) {
+	type dialResult struct {
+		conn    net.Conn
+		address string
+	}
+	results := make(chan dialResult, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			conn, err := net.DialTimeout("tcp", address, directDialTimeout)
+			if err != nil {
+				results <- dialResult{}
+				return
+			}
+
+			hello := protocol.DataHello{Token: token, Role: protocol.RoleReceive}
+			conn.SetDeadline(time.Now().Add(directDialTimeout))
+			if err := protocol.SendCommand(conn, hello.Encode()); err != nil {
+				conn.Close()
+				results <- dialResult{}
+				return
+			}
+			frame, err := protocol.ReadFrame(conn)
+			conn.SetDeadline(time.Time{})
+			if err != nil || string(frame.Payload) != "/DATA_OK" {
+				conn.Close()
+				results <- dialResult{}
+				return
+			}
+			results <- dialResult{conn, address}
+		}(address)
+	}
+
+	for i := range addresses {
+		if result := <-results; result.conn != nil {
+			// Close any slower attempt that still succeeds
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if late := <-results; late.conn != nil {
+						late.conn.Close()
+					}
+				}
+			}(len(addresses) - i - 1)
+			return result.conn, result.address
+		}
+	}
+	return nil, ""
+}
+
+// localAddresses lists the IPv4 addresses of our active, non-loopback interfaces
+func localAddresses() []string {
+	var addresses []string
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return addresses
+	}
+
+	for _, iface := range interfaces {
+		// Skip loopback and down interfaces
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+				addresses = append(addresses, ipnet.IP.String())
+			}
+		}
+	}
+	return addresses
+}
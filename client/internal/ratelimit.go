@@ -0,0 +1,127 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/utils"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultRateLimit is the bytes per second each transfer may move unless it
+// has a limit of its own; 0 is unlimited
+var defaultRateLimit int64
+
+// SetDefaultRateLimit sets the limit every transfer follows unless /limit
+// gives it one of its own, e.g. from the -limit flag
+func SetDefaultRateLimit(value string) error {
+	rate, err := parseRate(value)
+	if err != nil {
+		return err
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	atomic.StoreInt64(&defaultRateLimit, rate)
+	return nil
+}
+
+// parseRate reads a rate such as "512KB", "2MB/s" or "off". It returns -1
+// for "off", which lifts any limit, and 0 for "default".
+func parseRate(value string) (int64, error) {
+	switch strings.ToLower(value) {
+	case "off", "none", "unlimited":
+		return -1, nil
+	case "default":
+		return 0, nil
+	}
+	rate, err := helper.ParseSize(strings.TrimSuffix(strings.ToUpper(value), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	if rate == 0 {
+		return -1, nil
+	}
+	return rate, nil
+}
+
+// formatRate formats a rate in bytes per second
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return formatSize(rate) + "/s"
+}
+
+// HandleLimit handles "/limit", which lists the limits in effect, and
+// "/limit <transferId>|default <rate>", which change them. A rate of "off"
+// lifts the limit; a transfer set to "default" follows the default again.
+func HandleLimit(args []string) {
+	usage := func() {
+		fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /limit [<transferId>|default <rate>], where rate is e.g. 2MB or off"))
+	}
+
+	if len(args) == 0 {
+		printLimits()
+		return
+	}
+	if len(args) != 2 {
+		usage()
+		return
+	}
+	rate, err := parseRate(args[1])
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Invalid rate limit:"), err)
+		return
+	}
+
+	if args[0] == "default" {
+		if rate < 0 {
+			rate = 0
+		}
+		atomic.StoreInt64(&defaultRateLimit, rate)
+		done := "limited to " + formatRate(rate)
+		if rate == 0 {
+			done = "no longer limited"
+		}
+		fmt.Println(utils.SuccessColor("✅ Transfers without a limit of their own are now " + done))
+		return
+	}
+
+	transfer, exists := GetTransfer(args[0])
+	if !exists {
+		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(args[0]))
+		return
+	}
+	atomic.StoreInt64(&transfer.RateLimit, rate)
+
+	done := "limited to " + formatRate(transfer.rateLimit())
+	switch {
+	case transfer.rateLimit() == 0:
+		done = "no longer limited"
+	case rate == 0:
+		done += " (the default)"
+	}
+	fmt.Printf("%s Transfer %s is now %s\n",
+		utils.SuccessColor("✅"),
+		utils.CommandColor(transfer.ID),
+		utils.InfoColor(done))
+}
+
+func printLimits() {
+	fmt.Println(utils.HeaderColor("🚦 Bandwidth limits:"))
+	fmt.Printf("  Default per transfer: %s\n", utils.InfoColor(formatRate(atomic.LoadInt64(&defaultRateLimit))))
+
+	transfers := ListTransfers()
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].StartTime.Before(transfers[j].StartTime) })
+	for _, transfer := range transfers {
+		if atomic.LoadInt64(&transfer.RateLimit) == 0 {
+			continue
+		}
+		fmt.Printf("  Transfer %s (%s): %s\n",
+			utils.CommandColor(transfer.ID),
+			utils.InfoColor(transfer.Name),
+			utils.InfoColor(formatRate(transfer.rateLimit())))
+	}
+}
@@ -0,0 +1,368 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// partialSuffix marks a file or folder that is still being received
+	partialSuffix = ".part"
+	// partialInfoSuffix names the sidecar describing a partial download
+	partialInfoSuffix = ".part.json"
+	// partialListingSuffix names the copy of a partial folder's listing
+	partialListingSuffix = ".part.listing"
+)
+
+// partialInfo is the sidecar kept next to a partial download so that a later
+// transfer of the same file can continue where this one stopped
+type partialInfo struct {
+	Name      string    `json:"name"`
+	Sender    string    `json:"sender"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	Algorithm string    `json:"algorithm"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// partialStore holds a download until it is complete: a "<path>.part" file,
+// or for a folder a "<path>.part" directory it is extracted into as it arrives
+type partialStore interface {
+	io.ReadWriteSeeker
+	io.WriterAt
+	io.Closer
+	Name() string
+	Truncate(size int64) error
+}
+
+// PartialFile is a download kept under "<path>.part" until it is complete.
+// Its checksum is computed as the bytes are written, so the finished file
+// does not have to be read again.
+type PartialFile struct {
+	partialStore
+	Path   string // where the download goes once complete
+	Offset int64  // bytes kept from an earlier attempt
+
+	algorithm string
+	digest    hash.Hash
+	stale     bool         // bytes were written out of order, so digest no longer matches
+	finish    func() error // moves the completed download to Path
+}
+
+// OpenPartial opens the partial file for path. Bytes left behind by an
+// earlier attempt are kept if its sidecar describes the same file.
+func OpenPartial(path, senderId string, size int64, checksum, algorithm string) (*PartialFile, error) {
+	partial, err := openPartial(path, senderId, size, checksum, algorithm, func(resume bool) (partialStore, error) {
+		if resume {
+			return os.OpenFile(path+partialSuffix, os.O_RDWR, 0644)
+		}
+		return os.Create(path + partialSuffix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	partial.finish = func() error {
+		return os.Rename(path+partialSuffix, path)
+	}
+	return partial, nil
+}
+
+// OpenPartialFolder opens the staging directory a folder stream is extracted
+// into on its way to path
+func OpenPartialFolder(path, senderId string, size int64, checksum, algorithm string) (*PartialFile, error) {
+	partial, err := openPartial(path, senderId, size, checksum, algorithm, func(resume bool) (partialStore, error) {
+		return openFolderStore(path+partialSuffix, path+partialListingSuffix, size, resume)
+	})
+	if err != nil {
+		return nil, err
+	}
+	partial.finish = func() error {
+		if err := partial.partialStore.(*folderStore).linkEntries(); err != nil {
+			return err
+		}
+		if err := moveFolder(path+partialSuffix, path); err != nil {
+			return err
+		}
+		os.Remove(path + partialListingSuffix)
+		return nil
+	}
+	return partial, nil
+}
+
+func openPartial(path, senderId string, size int64, checksum, algorithm string, open func(resume bool) (partialStore, error)) (*PartialFile, error) {
+	digest, err := protocol.NewChecksum(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	infoPath := path + partialInfoSuffix
+
+	// A checksum that follows the data cannot tell files apart; the proof
+	// the sender checks before resuming does
+	var info partialInfo
+	if data, err := os.ReadFile(infoPath); err == nil && json.Unmarshal(data, &info) == nil &&
+		checksum != "" && (checksum == protocol.ChecksumFollows || info.Checksum == checksum) &&
+		info.Algorithm == algorithm && info.Size == size {
+		if store, err := open(true); err == nil {
+			offset, err := store.Seek(0, io.SeekEnd)
+			if err == nil {
+				if offset > size {
+					offset = size
+				}
+				return &PartialFile{partialStore: store, Path: path, Offset: offset, algorithm: algorithm, digest: digest}, nil
+			}
+			store.Close()
+		}
+	}
+
+	store, err := open(false)
+	if err != nil {
+		return nil, err
+	}
+	info = partialInfo{
+		Name:      filepath.Base(path),
+		Sender:    senderId,
+		Size:      size,
+		Checksum:  checksum,
+		Algorithm: algorithm,
+		StartedAt: time.Now(),
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err == nil {
+		err = os.WriteFile(infoPath, data, 0644)
+	}
+	if err != nil {
+		store.Close()
+		discardPartial(path)
+		return nil, err
+	}
+	return &PartialFile{partialStore: store, Path: path, algorithm: algorithm, digest: digest}, nil
+}
+
+// Write appends to the download and adds the bytes to its checksum
+func (p *PartialFile) Write(b []byte) (int, error) {
+	n, err := p.partialStore.Write(b)
+	p.digest.Write(b[:n])
+	return n, err
+}
+
+// repairAt replaces a corrupted chunk with a verified copy
+func (p *PartialFile) repairAt(b []byte, offset int64) error {
+	p.stale = true
+	_, err := p.WriteAt(b, offset)
+	return err
+}
+
+// writerAt returns a writer for the bytes from offset on, for ranges that
+// arrive side by side
+func (p *PartialFile) writerAt(offset int64) io.Writer {
+	p.stale = true
+	return io.NewOffsetWriter(p.partialStore, offset)
+}
+
+// Checksum returns the checksum of everything written. Only a download
+// whose chunks were repaired or that arrived in ranges is read again to
+// compute it.
+func (p *PartialFile) Checksum() (string, error) {
+	if p.stale {
+		if _, err := p.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		return helper.CalculateDataChecksum(p.partialStore, p.algorithm)
+	}
+	return hex.EncodeToString(p.digest.Sum(nil)), nil
+}
+
+// Complete moves the finished download to its final name and drops the sidecar
+func (p *PartialFile) Complete() error {
+	p.Close()
+	if err := p.finish(); err != nil {
+		return err
+	}
+	os.Remove(p.Path + partialInfoSuffix)
+	return nil
+}
+
+// Discard removes the partial download and its sidecar
+func (p *PartialFile) Discard() {
+	p.Close()
+	discardPartial(p.Path)
+}
+
+// discardPartial removes the partial download kept for path and its sidecars
+func discardPartial(path string) {
+	os.RemoveAll(path + partialSuffix)
+	os.Remove(path + partialInfoSuffix)
+	os.Remove(path + partialListingSuffix)
+}
+
+// startAt positions the file where the sender continues from. The sender
+// either accepts our offset or starts over from the beginning.
+func (p *PartialFile) startAt(offset int64) error {
+	if offset != 0 && offset != p.Offset {
+		return fmt.Errorf("sender resumed at byte %d, but we hold %d", offset, p.Offset)
+	}
+	if err := p.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := p.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// The digest already holds the kept bytes, read while offering to resume
+	if offset == 0 {
+		p.digest.Reset()
+	}
+	p.Offset = offset
+	return nil
+}
+
+var (
+	resumeOffers      = make(map[string]chan protocol.ResumeOffer)
+	resumeOffersMutex sync.Mutex
+)
+
+// resumeOffer returns the channel on which the recipient's resume offer for
+// a transfer is delivered; it is created by whichever side gets there first
+func resumeOffer(token string) chan protocol.ResumeOffer {
+	resumeOffersMutex.Lock()
+	defer resumeOffersMutex.Unlock()
+	ch, exists := resumeOffers[token]
+	if !exists {
+		ch = make(chan protocol.ResumeOffer, 1)
+		resumeOffers[token] = ch
+	}
+	return ch
+}
+
+func forgetResumeOffer(token string) {
+	resumeOffersMutex.Lock()
+	delete(resumeOffers, token)
+	resumeOffersMutex.Unlock()
+}
+
+// HandleTransferOffset delivers a "/TRANSFER_OFFSET" from the server
+func HandleTransferOffset(offer protocol.ResumeOffer) {
+	select {
+	case resumeOffer(offer.Token) <- offer:
+	default:
+	}
+}
+
+// OfferResume tells the sender how much of the file we already hold, with
+// a proof over those bytes so it can check they match its own copy
+func OfferResume(control net.Conn, token string, partial *PartialFile, key []byte) error {
+	if !ServerSupports(protocol.FeatureResume) {
+		return nil
+	}
+
+	// Chunks are verified whole, so resume from the last complete one
+	if ServerSupports(protocol.FeatureChunks) {
+		partial.Offset -= partial.Offset % protocol.ChunkSize
+	}
+
+	if _, err := partial.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// The kept bytes count towards the checksum if the sender resumes after them
+	proof, err := protocol.PrefixProof(io.TeeReader(partial.partialStore, partial.digest), partial.Offset, key)
+	if err != nil {
+		return err
+	}
+	return protocol.SendCommand(control, protocol.ResumeOffer{Token: token, Offset: partial.Offset, Proof: proof}.Encode())
+}
+
+// StartSending waits for the recipient's resume offer, positions file at the
+// offset we continue from and announces it at the start of the stream. The
+// offset is 0 unless the recipient proved it holds the same leading bytes,
+// which are then added to digest as they are read for the proof.
+func StartSending(stream io.Writer, token string, file io.ReadSeeker, size int64, key []byte, digest hash.Hash) (int64, error) {
+	if !ServerSupports(protocol.FeatureResume) {
+		return 0, nil
+	}
+	defer forgetResumeOffer(token)
+
+	var offer protocol.ResumeOffer
+	select {
+	case offer = <-resumeOffer(token):
+	case <-time.After(pairTimeout):
+		return 0, errors.New("recipient never said where to resume from")
+	}
+
+	offset := int64(0)
+	if offer.Offset > 0 && offer.Offset <= size {
+		proof, err := protocol.PrefixProof(io.TeeReader(file, digest), offer.Offset, key)
+		if err != nil {
+			return 0, err
+		}
+		if proof == offer.Proof {
+			offset = offer.Offset
+		} else {
+			digest.Reset()
+			fmt.Println(utils.WarningColor("⚠ Recipient's partial copy does not match, sending from the start"))
+		}
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		fmt.Printf("%s Resuming at %s of %s\n", utils.InfoColor("⏩"),
+			utils.InfoColor(formatSize(offset)), utils.InfoColor(formatSize(size)))
+	}
+	return offset, protocol.WriteStreamOffset(stream, offset)
+}
+
+// StartReceiving reads where the sender continues from and positions the
+// partial file there
+func StartReceiving(stream io.Reader, partial *PartialFile) error {
+	offset := int64(0)
+	if ServerSupports(protocol.FeatureResume) {
+		var err error
+		if offset, err = protocol.ReadStreamOffset(stream); err != nil {
+			return err
+		}
+	}
+	if err := partial.startAt(offset); err != nil {
+		return err
+	}
+	if offset > 0 {
+		fmt.Printf("%s Resuming at %s of the partial file\n", utils.InfoColor("⏩"),
+			utils.InfoColor(formatSize(offset)))
+	}
+	return nil
+}
+
+// keepPartial closes a download that failed. Bytes already received stay
+// on disk so the next attempt can resume; an empty partial file is removed.
+func keepPartial(partial *PartialFile, senderId string) {
+	held, err := partial.Seek(0, io.SeekEnd)
+	if err != nil || held == 0 {
+		partial.Discard()
+		return
+	}
+	partial.Close()
+	fmt.Printf("%s Kept %s in %s, it resumes when %s sends it again\n",
+		utils.InfoColor("💾"),
+		utils.InfoColor(formatSize(held)),
+		utils.InfoColor(partial.Name()),
+		utils.UserColor(senderId))
+}
+
+// printResumeHint tells the sender of a failed transfer how to finish it
+func printResumeHint() {
+	if ServerSupports(protocol.FeatureResume) {
+		fmt.Println(utils.InfoColor("💾 Send it again to continue where it stopped"))
+	}
+}
@@ -0,0 +1,299 @@
+package connection
+
+import (
+	"drizlink/utils"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxTransfers is how many sends run at once until -max-transfers or
+// /queue max says otherwise
+const DefaultMaxTransfers = 3
+
+// Priority orders the sends waiting in the queue
+type Priority int
+
+const (
+	LowPriority Priority = iota
+	NormalPriority
+	HighPriority
+)
+
+// String representation of Priority
+func (p Priority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case HighPriority:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// QueuedSend is a file or folder waiting for a free slot before it is
+// offered. It keeps its transfer ID once it starts.
+type QueuedSend struct {
+	ID        string
+	Type      TransferType
+	Name      string
+	Recipient string
+	Priority  Priority
+	Held      bool // stays in the queue until released
+	QueuedAt  time.Time
+	run       func(transferID string)
+}
+
+// The queue is kept in the order sends start in: by priority, then oldest first
+var (
+	sendQueue      []*QueuedSend
+	runningSends   = make(map[string]*QueuedSend)
+	maxTransfers   = DefaultMaxTransfers
+	schedulerMutex sync.Mutex
+)
+
+// SetMaxTransfers sets how many sends may run at once; 0 lifts the limit
+func SetMaxTransfers(max int) {
+	schedulerMutex.Lock()
+	maxTransfers = max
+	schedulerMutex.Unlock()
+	dispatchSends()
+}
+
+// scheduleSend queues a send and starts it as soon as a slot is free. A
+// send holds its slot from the offer until it is done.
+func scheduleSend(item *QueuedSend) {
+	item.ID = GenerateTransferID()
+	item.Priority = NormalPriority
+	item.QueuedAt = time.Now()
+
+	schedulerMutex.Lock()
+	insertQueued(item)
+	schedulerMutex.Unlock()
+
+	dispatchSends()
+
+	schedulerMutex.Lock()
+	position := queuePosition(item.ID)
+	schedulerMutex.Unlock()
+	if position > 0 {
+		fmt.Printf("%s Queued '%s' for %s (Transfer ID: %s, position %d)\n",
+			utils.InfoColor("⏳"),
+			utils.InfoColor(item.Name),
+			utils.UserColor(item.Recipient),
+			utils.CommandColor(item.ID),
+			position)
+	}
+}
+
+// dispatchSends starts queued sends while slots are free, skipping held ones
+func dispatchSends() {
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+
+	for maxTransfers <= 0 || len(runningSends) < maxTransfers {
+		next := -1
+		for i, item := range sendQueue {
+			if !item.Held {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return
+		}
+
+		item := sendQueue[next]
+		sendQueue = append(sendQueue[:next], sendQueue[next+1:]...)
+		runningSends[item.ID] = item
+		go func() {
+			item.run(item.ID)
+
+			schedulerMutex.Lock()
+			delete(runningSends, item.ID)
+			schedulerMutex.Unlock()
+			dispatchSends()
+		}()
+	}
+}
+
+// insertQueued puts item behind everything of the same or higher priority.
+// Call with schedulerMutex held.
+func insertQueued(item *QueuedSend) {
+	at := len(sendQueue)
+	for i, queued := range sendQueue {
+		if queued.Priority < item.Priority {
+			at = i
+			break
+		}
+	}
+	sendQueue = append(sendQueue, nil)
+	copy(sendQueue[at+1:], sendQueue[at:])
+	sendQueue[at] = item
+}
+
+// takeQueued removes a send from the queue. Call with schedulerMutex held.
+func takeQueued(id string) (*QueuedSend, bool) {
+	for i, item := range sendQueue {
+		if item.ID == id {
+			sendQueue = append(sendQueue[:i], sendQueue[i+1:]...)
+			return item, true
+		}
+	}
+	return nil, false
+}
+
+// queuePosition returns where a send waits, counting from 1, or 0 if it is
+// not queued. Call with schedulerMutex held.
+func queuePosition(id string) int {
+	for i, item := range sendQueue {
+		if item.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// ListQueue returns the queued sends in the order they start in
+func ListQueue() []*QueuedSend {
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+	return append([]*QueuedSend(nil), sendQueue...)
+}
+
+// cancelQueued drops a send that has not started yet
+func cancelQueued(id string) (*QueuedSend, bool) {
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+	return takeQueued(id)
+}
+
+// HandleQueue handles "/queue", which lists the queue, and "/queue max <n>",
+// "/queue front <id>", "/queue priority <id> high|normal|low",
+// "/queue hold <id>" and "/queue release <id>", which change it
+func HandleQueue(args []string) {
+	usage := func() {
+		fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /queue [max <n> | front <id> | priority <id> high|normal|low | hold <id> | release <id>]"))
+	}
+
+	if len(args) == 0 {
+		printQueue()
+		return
+	}
+
+	if len(args) == 2 && args[0] == "max" {
+		max, err := strconv.Atoi(args[1])
+		if err != nil || max < 0 {
+			fmt.Println(utils.ErrorColor("❌ Invalid number of transfers:"), args[1])
+			return
+		}
+		SetMaxTransfers(max)
+		if max == 0 {
+			fmt.Println(utils.SuccessColor("✅ Any number of sends may now run at once"))
+		} else {
+			fmt.Println(utils.SuccessColor(fmt.Sprintf("✅ Up to %d sends now run at once", max)))
+		}
+		return
+	}
+
+	var priority Priority
+	switch {
+	case len(args) == 2 && (args[0] == "front" || args[0] == "hold" || args[0] == "release"):
+	case len(args) == 3 && args[0] == "priority":
+		switch args[2] {
+		case "high":
+			priority = HighPriority
+		case "normal":
+			priority = NormalPriority
+		case "low":
+			priority = LowPriority
+		default:
+			usage()
+			return
+		}
+	default:
+		usage()
+		return
+	}
+
+	schedulerMutex.Lock()
+	position := queuePosition(args[1])
+	if position == 0 {
+		schedulerMutex.Unlock()
+		fmt.Println(utils.ErrorColor("❌ No queued send with ID"), utils.CommandColor(args[1]))
+		return
+	}
+	item := sendQueue[position-1]
+
+	var done string
+	switch args[0] {
+	case "front":
+		// It jumps the queue, so it takes the priority of what was first
+		takeQueued(item.ID)
+		if len(sendQueue) > 0 && sendQueue[0].Priority > item.Priority {
+			item.Priority = sendQueue[0].Priority
+		}
+		sendQueue = append([]*QueuedSend{item}, sendQueue...)
+		done = "moved to the front of the queue"
+	case "priority":
+		takeQueued(item.ID)
+		item.Priority = priority
+		insertQueued(item)
+		done = "now has " + priority.String() + " priority"
+	case "hold":
+		// A held send keeps its place, so it starts in turn once released
+		item.Held = true
+		done = "held until you release it"
+	case "release":
+		item.Held = false
+		done = "released"
+	}
+	position = queuePosition(item.ID)
+	schedulerMutex.Unlock()
+
+	fmt.Printf("%s '%s' (ID: %s) %s, position %d\n",
+		utils.SuccessColor("✅"),
+		utils.InfoColor(item.Name),
+		utils.CommandColor(item.ID),
+		done,
+		position)
+	dispatchSends()
+}
+
+func printQueue() {
+	schedulerMutex.Lock()
+	running, max := len(runningSends), maxTransfers
+	queue := append([]*QueuedSend(nil), sendQueue...)
+	schedulerMutex.Unlock()
+
+	limit := "no limit"
+	if max > 0 {
+		limit = fmt.Sprintf("at most %d at once", max)
+	}
+	fmt.Printf("%s %d running, %s\n", utils.HeaderColor("📋 Send queue:"), running, limit)
+	if len(queue) == 0 {
+		fmt.Println(utils.InfoColor("  Nothing is waiting"))
+		return
+	}
+	printQueued(queue)
+}
+
+// printQueued lists queued sends with their position
+func printQueued(queue []*QueuedSend) {
+	for i, item := range queue {
+		state := item.Priority.String() + " priority"
+		if item.Held {
+			state += ", held"
+		}
+		fmt.Printf("  %d. %s %s (%s) to %s | %s | queued %s ago\n",
+			i+1,
+			utils.CommandColor("ID: "+item.ID),
+			utils.InfoColor(item.Name),
+			formatTransferType(item.Type),
+			utils.UserColor(item.Recipient),
+			state,
+			formatDuration(time.Since(item.QueuedAt)))
+	}
+}
@@ -0,0 +1,193 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// parallelStreams returns how many streams a file of size bytes is sent over
+func parallelStreams(size int64) int {
+	if !ServerSupports(protocol.FeatureStreams) || size < protocol.MinParallelSize {
+		return 1
+	}
+	return protocol.DefaultStreams
+}
+
+// SealStreams wraps the further data connections of a transfer the way
+// SealSender wrapped the first, each sealed with a key of its own
+func SealStreams(conns []net.Conn, key []byte) ([]io.WriteCloser, error) {
+	writers := make([]io.WriteCloser, len(conns))
+	for i, conn := range conns {
+		if key == nil {
+			writers[i] = nopWriteCloser{conn}
+			continue
+		}
+		sealed, err := protocol.NewSealedWriter(conn, protocol.StreamKey(key, i+1))
+		if err != nil {
+			return nil, err
+		}
+		writers[i] = sealed
+	}
+	return writers, nil
+}
+
+// OpenStreams wraps the further data connections of a transfer the way
+// OpenReceiver wrapped the first
+func OpenStreams(conns []net.Conn, key []byte) ([]io.Reader, error) {
+	readers := make([]io.Reader, len(conns))
+	for i, conn := range conns {
+		if key == nil {
+			readers[i] = bufio.NewReaderSize(conn, 64*1024)
+			continue
+		}
+		sealed, err := protocol.NewSealedReader(conn, protocol.StreamKey(key, i+1))
+		if err != nil {
+			return nil, err
+		}
+		readers[i] = sealed
+	}
+	return readers, nil
+}
+
+// printStreams tells the user a transfer is split over several streams
+func printStreams(streams int) {
+	if streams > 1 {
+		fmt.Printf("%s Using %d parallel streams\n", utils.InfoColor("🔀"), streams)
+	}
+}
+
+// closeStreams closes every data connection of a transfer, so that one
+// broken stream does not leave the others waiting
+func closeStreams(transfer *Transfer) {
+	transfer.Connection.Close()
+	closeAll(transfer.Streams)
+}
+
+// SendRanges sends the file from offset over all streams at once, stream
+// carrying the first range and each of extra one of the others. The extra
+// streams are closed once their range is sent; stream stays open for the
+// chunks the recipient may ask for again. It returns the bytes sent.
+func SendRanges(stream io.Writer, extra []io.WriteCloser, file io.ReaderAt, offset, size int64, transfer *Transfer, bar io.Writer) (int64, error) {
+	ranges := protocol.SplitRanges(offset, size, 1+len(extra))
+	sent := make([]int64, len(ranges))
+	failed := &streamFailure{transfer: transfer}
+
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r protocol.Range) {
+			defer wg.Done()
+			reader := NewCheckpointedReader(io.NewSectionReader(file, r.Start, r.Length), transfer, 32768) // 32KB chunks
+			out := stream
+			if i > 0 {
+				out = extra[i-1]
+			}
+			// Each range is compressed on its own, as it arrives on its own
+			data, err := compressData(out, transfer)
+			if err == nil {
+				sent[i], err = io.CopyN(data, io.TeeReader(reader, bar), r.Length)
+			}
+			if err == nil {
+				err = data.Close()
+			}
+			if err == nil && i > 0 {
+				err = extra[i-1].Close()
+			}
+			failed.set(err)
+		}(i, r)
+	}
+	wg.Wait()
+
+	total := int64(0)
+	for i := range ranges {
+		total += sent[i]
+	}
+	return total, failed.err
+}
+
+// ReceiveRanges writes the ranges arriving on stream and extra into the
+// partial file side by side, verifying each against the manifest. It
+// returns the bytes received and the chunks that failed verification. If a
+// stream breaks, the partial file is cut after the bytes that arrived
+// without a gap, so a later attempt can resume from there.
+func ReceiveRanges(stream io.Reader, extra []io.Reader, partial *PartialFile, size int64, manifest *protocol.Manifest, transfer *Transfer, bar io.Writer) (int64, []int, error) {
+	ranges := protocol.SplitRanges(partial.Offset, size, 1+len(extra))
+	readers := append([]io.Reader{stream}, extra...)
+	received := make([]int64, len(ranges))
+	failed := &streamFailure{transfer: transfer}
+	verifiers := make([]*protocol.ChunkVerifier, len(ranges))
+	fillDamaged(readers, manifest, transfer)
+
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		writer := NewCheckpointedWriter(partial.writerAt(r.Start), transfer, 32768) // 32KB chunks
+		var destination io.Writer
+		destination, verifiers[i] = verifyingWriter(writer, manifest, r.Start)
+
+		wg.Add(1)
+		go func(i int, r protocol.Range) {
+			defer wg.Done()
+			data, err := decompressData(readers[i], transfer)
+			if err == nil {
+				received[i], err = io.CopyN(destination, io.TeeReader(data, bar), r.Length)
+			}
+			if err == nil {
+				err = finishData(data, transfer)
+			}
+			if skipDamaged(err, readers[i], verifiers[i], r.Start+r.Length) {
+				received[i], err = r.Length, nil
+			}
+			if err == nil && i > 0 {
+				err = VerifyReceived(readers[i])
+			}
+			failed.set(err)
+		}(i, r)
+	}
+	wg.Wait()
+
+	total := int64(0)
+	var corrupt []int
+	for i := range ranges {
+		total += received[i]
+		corrupt = append(corrupt, verifiers[i].Corrupt()...)
+	}
+
+	if failed.err != nil {
+		held := ranges[0].Start
+		for i, r := range ranges {
+			held = r.Start + received[i]
+			if received[i] < r.Length {
+				break
+			}
+		}
+		for _, index := range corrupt {
+			held = min(held, manifest.ChunkOffset(index))
+		}
+		partial.Truncate(held)
+		return total, corrupt, failed.err
+	}
+	return total, corrupt, nil
+}
+
+// streamFailure keeps the error of the first stream of a transfer to break.
+// It closes all the others, whose own errors only follow from that.
+type streamFailure struct {
+	transfer *Transfer
+	once     sync.Once
+	err      error
+}
+
+func (f *streamFailure) set(err error) {
+	if err == nil {
+		return
+	}
+	f.once.Do(func() {
+		f.err = err
+		closeStreams(f.transfer)
+	})
+}
@@ -0,0 +1,130 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"drizlink/protocol"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// pipeStreams connects a sender and a recipient over streams data connections
+func pipeStreams(streams int) (senders, recipients []net.Conn) {
+	for i := 0; i < streams; i++ {
+		send, receive := net.Pipe()
+		senders = append(senders, send)
+		recipients = append(recipients, receive)
+	}
+	return senders, recipients
+}
+
+// damagingWriter flips a bit of the first byte written through it, as a
+// faulty link would
+type damagingWriter struct {
+	io.WriteCloser
+	done bool
+}
+
+func (w *damagingWriter) Write(p []byte) (int, error) {
+	if !w.done && len(p) > 0 {
+		w.done = true
+		p = bytes.Clone(p)
+		p[0] ^= 1
+	}
+	return w.WriteCloser.Write(p)
+}
+
+func TestRangesRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int
+		streams int
+		key     []byte
+		damage  bool
+		corrupt []int
+	}{
+		{"plain", 3*protocol.ChunkSize + 12345, 4, nil, false, nil},
+		{"encrypted", 3*protocol.ChunkSize + 12345, 4, bytes.Repeat([]byte{7}, 32), false, nil},
+		{"fewer chunks than streams", protocol.ChunkSize + 1, 4, bytes.Repeat([]byte{7}, 32), false, nil},
+		{"damaged second range", 3*protocol.ChunkSize + 12345, 4, nil, true, []int{1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([]byte, tc.size)
+			for i := range data {
+				data[i] = byte(i * 31)
+			}
+			manifest, err := protocol.BuildManifest(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			senders, recipients := pipeStreams(tc.streams)
+			defer closeAll(senders)
+			defer closeAll(recipients)
+
+			sent := make(chan error, 1)
+			go func() {
+				var stream io.WriteCloser = nopWriteCloser{senders[0]}
+				if tc.key != nil {
+					stream, _ = protocol.NewSealedWriter(senders[0], tc.key)
+				}
+				extra, err := SealStreams(senders[1:], tc.key)
+				if tc.damage {
+					extra[0] = &damagingWriter{WriteCloser: extra[0]}
+				}
+				if err == nil {
+					transfer := &Transfer{ID: "send", Connection: senders[0], Streams: senders[1:]}
+					_, err = SendRanges(stream, extra, bytes.NewReader(data), 0, int64(len(data)), transfer, io.Discard)
+				}
+				if err == nil {
+					err = stream.Close()
+				}
+				sent <- err
+			}()
+
+			partial, err := OpenPartial(filepath.Join(t.TempDir(), "file"), "sender", int64(len(data)), protocol.ChecksumFollows, protocol.DefaultHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer partial.Close()
+			stream, err := OpenReceiver(recipients[0], tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extra, err := OpenStreams(recipients[1:], tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transfer := &Transfer{ID: "receive", Connection: recipients[0], Streams: recipients[1:]}
+			n, corrupt, err := ReceiveRanges(stream, extra, partial, int64(len(data)), manifest, transfer, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyReceived(stream); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-sent; err != nil {
+				t.Fatalf("sending: %v", err)
+			}
+
+			if n != int64(len(data)) || !reflect.DeepEqual(corrupt, tc.corrupt) {
+				t.Errorf("received %d of %d bytes, corrupt chunks %v, want %v", n, len(data), corrupt, tc.corrupt)
+			}
+			if tc.damage {
+				return
+			}
+			got, err := os.ReadFile(partial.Name())
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("partial file holds %d bytes that differ from the %d sent (%v)", len(got), len(data), err)
+			}
+			sum := sha256.Sum256(data)
+			if checksum, err := partial.Checksum(); err != nil || checksum != hex.EncodeToString(sum[:]) {
+				t.Errorf("checksum = %s, %v", checksum, err)
+			}
+		})
+	}
+}
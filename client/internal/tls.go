@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"drizlink/helper"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	useTLS               bool
+	acceptNewFingerprint bool
+	knownServersMutex    sync.Mutex
+)
+
+// EnableTLS makes every connection to the server use TLS. The server
+// certificate is pinned on first use; if acceptChanged is set a changed
+// fingerprint replaces the pinned one instead of aborting the connection.
+func EnableTLS(acceptChanged bool) {
+	useTLS = true
+	acceptNewFingerprint = acceptChanged
+}
+
+// dialServer opens a control or data connection to the server, over TLS when enabled
+func dialServer(address string) (net.Conn, error) {
+	if !useTLS {
+		return net.Dial("tcp", address)
+	}
+
+	config := &tls.Config{
+		// Servers use self-signed certificates, trust comes from the pin check below
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			return verifyPinnedFingerprint(address, helper.CertificateFingerprint(rawCerts[0]))
+		},
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+// verifyPinnedFingerprint implements trust on first use: the first fingerprint
+// seen for an address is remembered and any later change is refused
+func verifyPinnedFingerprint(address, fingerprint string) error {
+	knownServersMutex.Lock()
+	defer knownServersMutex.Unlock()
+
+	known, err := loadAddressBook("known_servers")
+	if err != nil {
+		return fmt.Errorf("failed to read known servers: %v", err)
+	}
+
+	pinned, exists := known[address]
+	if exists && pinned == fingerprint {
+		return nil
+	}
+
+	if !exists {
+		fmt.Println(utils.WarningColor("🔐 First TLS connection to " + address + ", trusting its certificate:"))
+		fmt.Println("   " + utils.CommandColor(fingerprint))
+		fmt.Println(utils.InfoColor("   Compare it with the fingerprint printed by the server."))
+	} else {
+		fmt.Println(utils.ErrorColor("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@"))
+		fmt.Println(utils.ErrorColor("@   WARNING: SERVER CERTIFICATE HAS CHANGED!               @"))
+		fmt.Println(utils.ErrorColor("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@"))
+		fmt.Println(utils.ErrorColor("Someone could be intercepting your connection to " + address + "."))
+		fmt.Println(utils.ErrorColor("Pinned fingerprint:   ") + pinned)
+		fmt.Println(utils.ErrorColor("Presented fingerprint:") + " " + fingerprint)
+		if !acceptNewFingerprint {
+			fmt.Println(utils.InfoColor("If the server was legitimately reinstalled, reconnect with --accept-new-fingerprint."))
+			return errors.New("server certificate fingerprint does not match the pinned one")
+		}
+		fmt.Println(utils.WarningColor("⚠ --accept-new-fingerprint given, replacing the pinned fingerprint"))
+	}
+
+	known[address] = fingerprint
+	if err := saveAddressBook("known_servers", known); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not save server fingerprint:"), err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/utils"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +30,8 @@ const (
 	Paused
 	Completed
 	Failed
+	Cancelled
+	Declined // the recipient refused the offer or never answered it
 )
 
 // String representation of TransferStatus
@@ -41,6 +45,10 @@ func (s TransferStatus) String() string {
 		return "Completed"
 	case Failed:
 		return "Failed"
+	case Cancelled:
+		return "Cancelled"
+	case Declined:
+		return "Declined"
 	default:
 		return "Unknown"
 	}
@@ -49,6 +57,7 @@ func (s TransferStatus) String() string {
 // Transfer represents an active file or folder transfer
 type Transfer struct {
 	ID            string
+	Token         string // shared with the peer, identifies the transfer on the wire
 	Type          TransferType
 	Name          string
 	Size          int64
@@ -57,15 +66,28 @@ type Transfer struct {
 	Direction     string // "send" or "receive"
 	Recipient     string
 	Path          string
+	Source        string // the path we asked the sender for with /download
 	Checksum      string
 	StartTime     time.Time
 	File          *os.File
 	Connection    net.Conn
+	Streams       []net.Conn // further data connections of a file sent in parallel
+	Compression   string     // what the data is compressed with on the wire, if anything
+	WireBytes     int64      // bytes of data that went over the network, after delta and compression
 	ProgressBar   *utils.ProgressBar
 	PauseLock     sync.Mutex
 	IsPaused      bool
+	RateLimit     int64 // bytes per second set with /limit: 0 follows the default, -1 lifts it
+	limiter       protocol.RateLimiter // shared by all of the transfer's streams
 }
 
+const (
+	// finishedTransferTTL is how long failed and cancelled transfers stay listed
+	finishedTransferTTL = time.Minute
+	// cancelGrace is how long a broken stream waits for the peer's cancel
+	cancelGrace = time.Second
+)
+
 // ActiveTransfers tracks all ongoing transfers
 var (
 	ActiveTransfers   = make(map[string]*Transfer)
@@ -97,6 +119,19 @@ func GetTransfer(id string) (*Transfer, bool) {
 	return transfer, exists
 }
 
+// FindTransferByToken looks up the transfer with the given token that we
+// have with peerId
+func FindTransferByToken(token, peerId string) (*Transfer, bool) {
+	TransfersMutex.RLock()
+	defer TransfersMutex.RUnlock()
+	for _, transfer := range ActiveTransfers {
+		if transfer.Token == token && transfer.Recipient == peerId {
+			return transfer, true
+		}
+	}
+	return nil, false
+}
+
 // RemoveTransfer removes a completed or failed transfer
 func RemoveTransfer(id string) {
 	TransfersMutex.Lock()
@@ -104,6 +139,28 @@ func RemoveTransfer(id string) {
 	delete(ActiveTransfers, id)
 }
 
+// RetireTransfer removes a transfer once its handler is done with it and
+// records how it ended, and why if err says it failed, in the history.
+// Failed and cancelled transfers stay listed for a while so /transfers can
+// show them.
+func RetireTransfer(id string, err error) {
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		return
+	}
+
+	transfer.PauseLock.Lock()
+	status := transfer.Status
+	transfer.PauseLock.Unlock()
+	recordHistory(transfer, status, err)
+
+	if status == Failed || status == Cancelled {
+		time.AfterFunc(finishedTransferTTL, func() { RemoveTransfer(id) })
+		return
+	}
+	RemoveTransfer(id)
+}
+
 // ListTransfers returns all active transfers
 func ListTransfers() []*Transfer {
 	TransfersMutex.RLock()
@@ -166,6 +223,58 @@ func ResumeTransfer(id string) error {
 	return nil
 }
 
+// CancelTransfer stops a transfer for good. Closing its data connection
+// unblocks a stream waiting on the network.
+func CancelTransfer(id string) error {
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		return fmt.Errorf("transfer with ID %s not found", id)
+	}
+
+	transfer.PauseLock.Lock()
+	if transfer.Status == Completed || transfer.Status == Cancelled {
+		status := transfer.Status
+		transfer.PauseLock.Unlock()
+		return fmt.Errorf("cannot cancel transfer with status: %s", status)
+	}
+	transfer.Status = Cancelled
+	transfer.IsPaused = false
+	transfer.PauseLock.Unlock()
+
+	if transfer.Connection != nil {
+		transfer.Connection.Close()
+	}
+	closeAll(transfer.Streams)
+	return nil
+}
+
+// markFailed marks a transfer whose stream broke as failed and reports
+// whether it broke because it was cancelled. The peer's cancel travels via
+// the server and may arrive just after the stream closed, so wait for it a
+// moment before calling the transfer failed.
+func markFailed(id string) bool {
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		return false
+	}
+
+	deadline := time.Now().Add(cancelGrace)
+	for {
+		transfer.PauseLock.Lock()
+		if transfer.Status == Cancelled {
+			transfer.PauseLock.Unlock()
+			return true
+		}
+		if time.Now().After(deadline) {
+			transfer.Status = Failed
+			transfer.PauseLock.Unlock()
+			return false
+		}
+		transfer.PauseLock.Unlock()
+		time.Sleep(pausePollInterval)
+	}
+}
+
 // UpdateTransferStatus updates the status of a transfer
 func UpdateTransferStatus(id string, status TransferStatus) {
 	transfer, exists := GetTransfer(id)
@@ -204,21 +313,66 @@ func NewCheckpointedReader(reader io.Reader, transfer *Transfer, chunkSize int)
 	}
 }
 
-// Read implements io.Reader and supports pausing
+// addProgress counts bytes moved by one of the transfer's streams
+func (t *Transfer) addProgress(n int64) {
+	atomic.AddInt64(&t.BytesComplete, n)
+}
+
+// Progress returns the bytes moved so far, across all streams
+func (t *Transfer) Progress() int64 {
+	return atomic.LoadInt64(&t.BytesComplete)
+}
+
+// throttle waits until the transfer may move some of n bytes and returns
+// how many, keeping all of its streams together under its rate limit
+func (t *Transfer) throttle(n int) int {
+	t.limiter.SetRate(t.rateLimit())
+	return t.limiter.Take(n)
+}
+
+// rateLimit returns the bytes per second the transfer may move, 0 if unlimited
+func (t *Transfer) rateLimit() int64 {
+	switch limit := atomic.LoadInt64(&t.RateLimit); {
+	case limit < 0:
+		return 0
+	case limit > 0:
+		return limit
+	}
+	return atomic.LoadInt64(&defaultRateLimit)
+}
+
+// pausePollInterval is how often a paused stream checks whether it may continue
+const pausePollInterval = 200 * time.Millisecond
+
+// aborted reports whether the transfer has been marked as failed or cancelled
+func (t *Transfer) aborted() bool {
+	t.PauseLock.Lock()
+	defer t.PauseLock.Unlock()
+	return t.Status == Failed || t.Status == Cancelled
+}
+
+// Read implements io.Reader. While the transfer is paused it blocks, so no
+// bytes are read until the transfer is resumed, and it reads no faster than
+// the transfer's rate limit allows.
 func (cr *CheckpointedReader) Read(p []byte) (n int, err error) {
-	// Check if transfer is paused
-	if cr.PauseCheck() {
+	for {
+		// Stop streaming once the transfer has been marked as failed or cancelled
+		if cr.Transfer.aborted() {
+			return 0, fmt.Errorf("transfer %s aborted", cr.Transfer.ID)
+		}
+		if !cr.PauseCheck() {
+			break
+		}
 		// Sleep a bit and check again to avoid CPU spinning
-		time.Sleep(500 * time.Millisecond)
-		return 0, nil
+		time.Sleep(pausePollInterval)
 	}
 	
 	// Perform actual read
-	n, err = cr.Reader.Read(p)
+	n, err = cr.Reader.Read(p[:cr.Transfer.throttle(len(p))])
 	
 	if n > 0 {
 		cr.BytesRead += int64(n)
-		cr.Transfer.BytesComplete = cr.BytesRead
+		cr.Transfer.addProgress(int64(n))
 	}
 	
 	return n, err
@@ -249,25 +403,35 @@ func NewCheckpointedWriter(writer io.Writer, transfer *Transfer, chunkSize int)
 	}
 }
 
-// Write implements io.Writer and supports pausing
+// Write implements io.Writer. While the transfer is paused it blocks and
+// then writes all of p, since a short write would abort the copy. Bytes are
+// written in slices no faster than the transfer's rate limit allows.
 func (cw *CheckpointedWriter) Write(p []byte) (n int, err error) {
-	if cw.PauseCheck() {
-		time.Sleep(500 * time.Millisecond)
-		return 0, nil
-	}
-	
-	n, err = cw.Writer.Write(p)
-	
-	if n > 0 {
-		cw.BytesWritten += int64(n)
-		cw.Transfer.BytesComplete = cw.BytesWritten
+	for n < len(p) {
+		for cw.PauseCheck() {
+			if cw.Transfer.aborted() {
+				return n, fmt.Errorf("transfer %s aborted", cw.Transfer.ID)
+			}
+			time.Sleep(pausePollInterval)
+		}
+
+		slice := cw.Transfer.throttle(len(p) - n)
+		written, err := cw.Writer.Write(p[n : n+slice])
+		if written > 0 {
+			n += written
+			cw.BytesWritten += int64(written)
+			cw.Transfer.addProgress(int64(written))
+		}
+		if err != nil {
+			return n, err
+		}
 	}
-	
-	return n, err
+	return n, nil
 }
 
-// HandlePauseTransfer handles the /pause command
-func HandlePauseTransfer(transferID string) {
+// HandlePauseTransfer handles the /pause command. The peer is told to
+// pause as well so the stream halts on both ends.
+func HandlePauseTransfer(conn net.Conn, transferID string) {
 	transfer, exists := GetTransfer(transferID)
 	if !exists {
 		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
@@ -287,6 +451,7 @@ func HandlePauseTransfer(transferID string) {
 		fmt.Println(utils.ErrorColor("❌ Failed to pause transfer:"), err)
 		return
 	}
+	signalPeer(conn, transfer, "/TRANSFER_PAUSE")
 	
 	fmt.Printf("%s Transfer %s paused\n", 
 		utils.WarningColor("⏸"),
@@ -299,13 +464,14 @@ func HandlePauseTransfer(transferID string) {
 		
 	fmt.Printf("  %s: %s / %s (%.1f%%)\n", 
 		utils.InfoColor("Progress"),
-		utils.InfoColor(formatSize(transfer.BytesComplete)),
+		utils.InfoColor(formatSize(transfer.Progress())),
 		utils.InfoColor(formatSize(transfer.Size)),
-		float64(transfer.BytesComplete) / float64(transfer.Size) * 100)
+		float64(transfer.Progress()) / float64(transfer.Size) * 100)
 }
 
-// HandleResumeTransfer handles the /resume command
-func HandleResumeTransfer(transferID string) {
+// HandleResumeTransfer handles the /resume command. The peer resumes too
+// and the stream continues from where it was halted.
+func HandleResumeTransfer(conn net.Conn, transferID string) {
 	transfer, exists := GetTransfer(transferID)
 	if !exists {
 		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
@@ -325,6 +491,7 @@ func HandleResumeTransfer(transferID string) {
 		fmt.Println(utils.ErrorColor("❌ Failed to resume transfer:"), err)
 		return
 	}
+	signalPeer(conn, transfer, "/TRANSFER_RESUME")
 	
 	fmt.Printf("%s Transfer %s resumed\n", 
 		utils.SuccessColor("▶"),
@@ -337,25 +504,137 @@ func HandleResumeTransfer(transferID string) {
 		
 	fmt.Printf("  %s: %s / %s (%.1f%%)\n", 
 		utils.InfoColor("Progress"),
-		utils.InfoColor(formatSize(transfer.BytesComplete)),
+		utils.InfoColor(formatSize(transfer.Progress())),
 		utils.InfoColor(formatSize(transfer.Size)),
-		float64(transfer.BytesComplete) / float64(transfer.Size) * 100)
+		float64(transfer.Progress()) / float64(transfer.Size) * 100)
+}
+
+// signalPeer relays a pause or resume to the other side of a transfer
+func signalPeer(conn net.Conn, transfer *Transfer, command string) {
+	if transfer.Token == "" {
+		return
+	}
+	err := protocol.SendCommand(conn, fmt.Sprintf("%s %s %s", command, transfer.Recipient, transfer.Token))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Could not notify the other side:"), err)
+	}
+}
+
+// HandleCancelTransfer handles the /cancel command. The peer is told to stop
+// as well, and a partially received file is deleted.
+func HandleCancelTransfer(conn net.Conn, transferID string) {
+	transfer, exists := GetTransfer(transferID)
+	if !exists {
+		// A queued send was never offered, so only we know about it
+		if queued, ok := cancelQueued(transferID); ok {
+			fmt.Printf("%s Removed '%s' from the queue\n",
+				utils.WarningColor("🚫"),
+				utils.InfoColor(queued.Name))
+			return
+		}
+		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
+		return
+	}
+
+	// Tell the peer first so it knows why the stream is about to close
+	signalPeer(conn, transfer, "/TRANSFER_CANCEL")
+	if err := CancelTransfer(transferID); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Failed to cancel transfer:"), err)
+		return
+	}
+	if transfer.Direction == "receive" {
+		discardPartial(transfer.Path)
+	}
+
+	fmt.Printf("%s Transfer %s cancelled\n",
+		utils.WarningColor("🚫"),
+		utils.CommandColor(transferID))
+}
+
+// HandleTransferSignal applies a "/TRANSFER_PAUSE", "/TRANSFER_RESUME" or
+// "/TRANSFER_CANCEL" sent by the peer of one of our transfers
+func HandleTransferSignal(command, peerId, token string) {
+	transfer, exists := FindTransferByToken(token, peerId)
+	if !exists {
+		return
+	}
+
+	if command == "/TRANSFER_CANCEL" {
+		if err := CancelTransfer(transfer.ID); err != nil {
+			return
+		}
+		if transfer.Direction == "receive" {
+			discardPartial(transfer.Path)
+		}
+		fmt.Printf("%s %s cancelled transfer %s\n",
+			utils.WarningColor("🚫"),
+			utils.UserColor(peerId),
+			utils.CommandColor(transfer.ID))
+		return
+	}
+
+	if command == "/TRANSFER_PAUSE" {
+		if err := PauseTransfer(transfer.ID); err != nil {
+			return
+		}
+		fmt.Printf("%s %s paused transfer %s\n",
+			utils.WarningColor("⏸"),
+			utils.UserColor(peerId),
+			utils.CommandColor(transfer.ID))
+		return
+	}
+
+	if err := ResumeTransfer(transfer.ID); err != nil {
+		return
+	}
+	fmt.Printf("%s %s resumed transfer %s\n",
+		utils.SuccessColor("▶"),
+		utils.UserColor(peerId),
+		utils.CommandColor(transfer.ID))
 }
 
 // HandleListTransfers handles the /transfers command
 func HandleListTransfers() {
 	transfers := ListTransfers()
+	offers := ListOffers()
+	queue := ListQueue()
 	
-	if len(transfers) == 0 {
+	if len(transfers) == 0 && len(offers) == 0 && len(queue) == 0 {
 		fmt.Println(utils.InfoColor("📡 No active transfers"))
 		return
 	}
+
+	if len(queue) > 0 {
+		fmt.Println(utils.HeaderColor("⏳ Queued to send:"))
+		printQueued(queue)
+		fmt.Printf("  %s - Reorder, hold or release queued sends\n", utils.CommandColor("/queue"))
+		if len(offers) == 0 && len(transfers) == 0 {
+			return
+		}
+	}
+
+	if len(offers) > 0 {
+		fmt.Println(utils.HeaderColor("📨 Waiting for your answer:"))
+		for _, offer := range offers {
+			fmt.Printf("%s %s (%s) from %s, offered %s ago\n",
+				utils.CommandColor("ID: "+offer.ID),
+				utils.InfoColor(offer.Name),
+				formatTransferType(offer.Type),
+				utils.UserColor(offer.SenderName),
+				formatDuration(time.Since(offer.ReceivedAt)))
+			printOfferDetails(offer)
+		}
+		fmt.Printf("  %s / %s - Answer an offer\n", utils.CommandColor("/accept <transferId>"), utils.CommandColor("/decline <transferId>"))
+		if len(transfers) == 0 {
+			return
+		}
+	}
 	
 	fmt.Println(utils.HeaderColor("📡 Active Transfers:"))
 	fmt.Println(utils.InfoColor("-----------------------------------"))
 	
 	for _, transfer := range transfers {
-		progress := float64(transfer.BytesComplete) / float64(transfer.Size) * 100
+		progress := float64(transfer.Progress()) / float64(transfer.Size) * 100
 		
 		statusColor := utils.InfoColor
 		statusIcon := ""
@@ -372,6 +651,9 @@ func HandleListTransfers() {
 		case Failed:
 			statusColor = utils.ErrorColor
 			statusIcon = "❌ "
+		case Cancelled:
+			statusColor = utils.WarningColor
+			statusIcon = "🚫 "
 		}
 		
 		directionIcon := "📤 "
@@ -390,7 +672,7 @@ func HandleListTransfers() {
 			formatTransferType(transfer.Type),
 			formatSize(transfer.Size),
 			progress,
-			formatSize(transfer.BytesComplete),
+			formatSize(transfer.Progress()),
 			formatSize(transfer.Size))
 		
 		relationText := "From"
@@ -401,6 +683,15 @@ func HandleListTransfers() {
 			relationText,
 			utils.UserColor(transfer.Recipient),
 			formatDuration(time.Since(transfer.StartTime)))
+		if len(transfer.Streams) > 0 {
+			fmt.Printf("   Streams: %d in parallel\n", len(transfer.Streams)+1)
+		}
+		if rate := transfer.rateLimit(); rate > 0 {
+			fmt.Printf("   Limit: %s\n", formatRate(rate))
+		}
+		if transfer.Compression != "" || transfer.Type == FolderTransfer {
+			fmt.Printf("   Wire: %s\n", formatWire(transfer, transfer.Progress()))
+		}
 		
 		fmt.Println(utils.InfoColor("   ---"))
 	}
@@ -408,6 +699,8 @@ func HandleListTransfers() {
 	fmt.Println(utils.InfoColor("Commands:"))
 	fmt.Printf("  %s - Pause a transfer\n", utils.CommandColor("/pause <transferId>"))
 	fmt.Printf("  %s - Resume a paused transfer\n", utils.CommandColor("/resume <transferId>"))
+	fmt.Printf("  %s - Cancel a transfer\n", utils.CommandColor("/cancel <transferId>"))
+	fmt.Printf("  %s - Limit a transfer's bandwidth\n", utils.CommandColor("/limit <transferId> <rate>"))
 	fmt.Println(utils.InfoColor("-----------------------------------"))
 }
 
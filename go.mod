@@ -5,6 +5,7 @@ go 1.22.3
 require (
 	github.com/fatih/color v1.16.0
 	github.com/schollz/progressbar/v3 v3.13.1
+	golang.org/x/term v0.27.0
 )
 
 require (
@@ -14,5 +15,4 @@ require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
 	golang.org/x/sys v0.28.0 // indirect
-	golang.org/x/term v0.27.0 // indirect
 )
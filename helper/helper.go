@@ -1,9 +1,8 @@
 package helper
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/md5"
+	"crypto/sha256"
+	"drizlink/protocol"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -16,38 +15,20 @@ import (
 	"time"
 )
 
-// CalculateFileChecksum computes an MD5 hash of a file
-func CalculateFileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+// CalculateDataChecksum hashes everything read from reader, a buffer at a
+// time, so memory use does not grow with the size of the data
+func CalculateDataChecksum(reader io.Reader, algorithm string) (string, error) {
+	hash, err := protocol.NewChecksum(algorithm)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
-
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, reader); err != nil {
 		return "", err
 	}
 
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// CalculateDataChecksum computes an MD5 hash from a reader without consuming it
-// Returns the checksum and a new reader that can be used normally
-func CalculateDataChecksum(reader io.Reader) (string, io.Reader, error) {
-	hash := md5.New()
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return "", nil, err
-	}
-	
-	hash.Write(data)
-	checksum := hex.EncodeToString(hash.Sum(nil))
-	
-	// Return a new reader with the same data
-	return checksum, bytes.NewReader(data), nil
-}
-
 // VerifyChecksum checks if two checksums match
 func VerifyChecksum(original, received string) bool {
 	return original == received
@@ -90,122 +71,68 @@ func IsPortInUse(port string) bool {
 	return true
 }
 
-// CreateZipFromFolder creates a zip archive from a folder
-func CreateZipFromFolder(folderPath string, zipPath string) error {
-	zipFile, err := os.Create(zipPath)
-	if err != nil {
-		return fmt.Errorf("failed to create zip file: %v", err)
-	}
-	defer zipFile.Close()
-
-	archive := zip.NewWriter(zipFile)
-	defer archive.Close()
-
-	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get the relative path for the zip
-		relPath, err := filepath.Rel(folderPath, path)
-		if err != nil {
-			return err
-		}
-
-		// Skip if it's the root folder
-		if relPath == "." {
-			return nil
-		}
-
-		// Create zip header
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		// Set relative path as name
-		header.Name = relPath
-
-		// Set compression
-		header.Method = zip.Deflate
-
-		writer, err := archive.CreateHeader(header)
+// GetFolderSize returns the total size of a folder in bytes
+func GetFolderSize(folderPath string) (int64, error) {
+	var size int64
+	err := filepath.Walk(folderPath, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-
-		// If it's a directory, just return
-		if info.IsDir() {
-			return nil
-		}
-
-		// Copy file contents
-		file, err := os.Open(path)
-		if err != nil {
-			return err
+		if !info.IsDir() {
+			size += info.Size()
 		}
-		defer file.Close()
-
-		_, err = io.Copy(writer, file)
-		return err
+		return nil
 	})
+	return size, err
 }
 
-// ExtractZip extracts a zip archive to the specified destination
-func ExtractZip(zipPath string, destPath string) error {
-	archive, err := zip.OpenReader(zipPath)
+// ConfigDir returns the per-user DrizLink configuration directory, creating it if needed
+func ConfigDir() (string, error) {
+	base, err := os.UserConfigDir()
 	if err != nil {
-		return fmt.Errorf("failed to open zip file: %v", err)
+		return "", err
 	}
-	defer archive.Close()
-
-	for _, file := range archive.File {
-		filePath := filepath.Join(destPath, file.Name)
-
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(filePath, os.ModePerm)
-			continue
-		}
-
-		// Ensure parent directory exists
-		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			return err
-		}
-
-		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			return err
-		}
-
-		srcFile, err := file.Open()
-		if err != nil {
-			dstFile.Close()
-			return err
-		}
+	dir := filepath.Join(base, "drizlink")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
 
-		_, err = io.Copy(dstFile, srcFile)
-		srcFile.Close()
-		dstFile.Close()
+// ParseSize reads a size such as "512KB", "10MB" or "1.5GB"; a bare number is bytes
+func ParseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
 
-		if err != nil {
-			return err
+	text := strings.ToUpper(strings.TrimSpace(value))
+	factor := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(text, unit.suffix) {
+			factor = unit.factor
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			break
 		}
 	}
 
-	return nil
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * factor), nil
 }
 
-// GetFolderSize returns the total size of a folder in bytes
-func GetFolderSize(folderPath string) (int64, error) {
-	var size int64
-	err := filepath.Walk(folderPath, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-	return size, err
-}	
\ No newline at end of file
+// CertificateFingerprint returns the SHA-256 fingerprint of a DER encoded
+// certificate as colon separated hex pairs
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	pairs := make([]string, len(sum))
+	for i, b := range sum {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Checksum algorithms a sender may name in the hash attribute of an offer
+const (
+	HashSHA256 = "sha256"
+	// HashMD5 is only used to verify offers from clients that predate the
+	// hash attribute, on servers that predate it too
+	HashMD5 = "md5"
+)
+
+// DefaultHash is the algorithm we checksum our own transfers with
+const DefaultHash = HashSHA256
+
+// ChecksumFollows is sent in place of the checksum of an offer whose
+// checksum is computed as the data is sent and follows it on the stream
+const ChecksumFollows = "-"
+
+// NewChecksum returns a hash for the named checksum algorithm
+func NewChecksum(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashMD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// WriteStreamChecksum ends a transfer stream with the checksum the sender
+// computed while sending the data
+func WriteStreamChecksum(w io.Writer, sum []byte) error {
+	if len(sum) == 0 || len(sum) > 255 {
+		return fmt.Errorf("invalid checksum length %d", len(sum))
+	}
+	_, err := w.Write(append([]byte{byte(len(sum))}, sum...))
+	return err
+}
+
+// ReadStreamChecksum reads the checksum written by WriteStreamChecksum, in
+// the hex form offers carry
+func ReadStreamChecksum(r io.Reader) (string, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+	if length[0] == 0 {
+		return "", fmt.Errorf("invalid checksum length 0")
+	}
+	sum := make([]byte, length[0])
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestStreamChecksumRoundTrip(t *testing.T) {
+	digest, err := NewChecksum(DefaultHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest.Write([]byte("data"))
+	sum := digest.Sum(nil)
+
+	var buf bytes.Buffer
+	if err := WriteStreamChecksum(&buf, sum); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("rest")
+	got, err := ReadStreamChecksum(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != hex.EncodeToString(sum) || buf.String() != "rest" {
+		t.Errorf("read %q, left %q", got, buf.String())
+	}
+
+	if err := WriteStreamChecksum(&buf, nil); err == nil {
+		t.Error("wrote an empty checksum")
+	}
+	if _, err := ReadStreamChecksum(bytes.NewReader([]byte{0})); err == nil {
+		t.Error("read an empty checksum")
+	}
+	if _, err := ReadStreamChecksum(bytes.NewReader([]byte{32, 1, 2})); err == nil {
+		t.Error("read a truncated checksum")
+	}
+}
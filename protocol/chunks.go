@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ChunkSize is the size of the pieces a transfer is verified and, if
+// corrupted, sent again in
+const ChunkSize = 1024 * 1024
+
+// MaxResendRounds bounds how often corrupted chunks are asked for again
+const MaxResendRounds = 3
+
+// NoChunks is sent in place of an empty chunk list
+const NoChunks = "-"
+
+// maxManifestChunks keeps a bogus manifest header from allocating too much
+const maxManifestChunks = 1 << 24
+
+// Manifest lists the hash of every chunk of a file. The sender writes it to
+// the stream ahead of the data so each chunk is checked as it arrives.
+type Manifest struct {
+	ChunkSize int64
+	Size      int64
+	Hashes    [][]byte
+}
+
+// BuildManifest hashes the size bytes read from r in chunks of ChunkSize
+func BuildManifest(r io.Reader, size int64) (*Manifest, error) {
+	m := &Manifest{ChunkSize: ChunkSize, Size: size}
+	for offset := int64(0); offset < size; offset += m.ChunkSize {
+		h := sha256.New()
+		if _, err := io.CopyN(h, r, m.ChunkLength(len(m.Hashes))); err != nil {
+			return nil, err
+		}
+		m.Hashes = append(m.Hashes, h.Sum(nil))
+	}
+	return m, nil
+}
+
+// Chunks returns the number of chunks in the file
+func (m *Manifest) Chunks() int {
+	return len(m.Hashes)
+}
+
+// ChunkOffset returns where chunk index starts in the file
+func (m *Manifest) ChunkOffset(index int) int64 {
+	return int64(index) * m.ChunkSize
+}
+
+// ChunkLength returns the length of chunk index; only the last one is short
+func (m *Manifest) ChunkLength(index int) int64 {
+	length := m.Size - m.ChunkOffset(index)
+	if length > m.ChunkSize {
+		length = m.ChunkSize
+	}
+	return length
+}
+
+// VerifyChunk reports whether data is chunk index as the sender has it
+func (m *Manifest) VerifyChunk(index int, data []byte) bool {
+	sum := sha256.Sum256(data)
+	return index >= 0 && index < len(m.Hashes) && bytes.Equal(sum[:], m.Hashes[index])
+}
+
+// WriteManifest writes m as its chunk size, chunk count and hashes
+func WriteManifest(w io.Writer, m *Manifest) error {
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(m.ChunkSize))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(m.Hashes)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	for _, sum := range m.Hashes {
+		if _, err := w.Write(sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest written by WriteManifest for a file of the
+// given size
+func ReadManifest(r io.Reader, size int64) (*Manifest, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	chunkSize := int64(binary.BigEndian.Uint64(header[:8]))
+	count := int(binary.BigEndian.Uint32(header[8:]))
+	if chunkSize <= 0 || count > maxManifestChunks || int64(count) != (size+chunkSize-1)/chunkSize {
+		return nil, fmt.Errorf("invalid manifest: %d chunks of %d bytes for %d bytes", count, chunkSize, size)
+	}
+
+	m := &Manifest{ChunkSize: chunkSize, Size: size, Hashes: make([][]byte, count)}
+	for i := range m.Hashes {
+		m.Hashes[i] = make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, m.Hashes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ChunkVerifier checks the data written to it against a manifest, one chunk
+// at a time, and remembers which chunks did not match
+type ChunkVerifier struct {
+	manifest *Manifest
+	index    int
+	filled   int64
+	hash     hash.Hash
+	corrupt  []int
+}
+
+// NewVerifier returns a verifier for data starting at offset, which has to
+// be at a chunk boundary
+func (m *Manifest) NewVerifier(offset int64) *ChunkVerifier {
+	return &ChunkVerifier{manifest: m, index: int(offset / m.ChunkSize), hash: sha256.New()}
+}
+
+// Write hashes p, checking each chunk as soon as it is complete
+func (v *ChunkVerifier) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 && v.index < v.manifest.Chunks() {
+		n := v.manifest.ChunkLength(v.index) - v.filled
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		v.hash.Write(p[:n])
+		v.filled += n
+		p = p[n:]
+
+		if v.filled == v.manifest.ChunkLength(v.index) {
+			if !bytes.Equal(v.hash.Sum(nil), v.manifest.Hashes[v.index]) {
+				v.corrupt = append(v.corrupt, v.index)
+			}
+			v.index++
+			v.filled = 0
+			v.hash.Reset()
+		}
+	}
+	return written, nil
+}
+
+// Abandon gives up on the data from the chunk being filled up to end, which
+// is at a chunk boundary or the end of the file. Those chunks are reported
+// as corrupt, to be sent again.
+func (v *ChunkVerifier) Abandon(end int64) {
+	for ; v.index < v.manifest.Chunks() && v.manifest.ChunkOffset(v.index) < end; v.index++ {
+		v.corrupt = append(v.corrupt, v.index)
+	}
+	v.filled = 0
+	v.hash.Reset()
+}
+
+// Corrupt returns the chunks that failed verification so far. A nil
+// verifier, used when there is no manifest, reports none.
+func (v *ChunkVerifier) Corrupt() []int {
+	if v == nil {
+		return nil
+	}
+	return v.corrupt
+}
+
+// ResendRequest is sent back to the sender on the data connection once the
+// recipient has read the whole stream: "/TRANSFER_RESEND <token> <chunks>".
+// An empty list means every chunk arrived intact and the sender may finish.
+type ResendRequest struct {
+	Token  string
+	Chunks []int
+}
+
+// Encode returns the command form of a ResendRequest
+func (r ResendRequest) Encode() string {
+	if len(r.Chunks) == 0 {
+		return fmt.Sprintf("/TRANSFER_RESEND %s %s", r.Token, NoChunks)
+	}
+	indices := make([]string, len(r.Chunks))
+	for i, index := range r.Chunks {
+		indices[i] = strconv.Itoa(index)
+	}
+	return fmt.Sprintf("/TRANSFER_RESEND %s %s", r.Token, strings.Join(indices, ","))
+}
+
+// ParseResendRequest parses a "/TRANSFER_RESEND" command
+func ParseResendRequest(message string) (ResendRequest, error) {
+	args := strings.Fields(message)
+	if len(args) != 3 || args[0] != "/TRANSFER_RESEND" {
+		return ResendRequest{}, fmt.Errorf("invalid resend request: %q", message)
+	}
+	request := ResendRequest{Token: args[1]}
+	if args[2] == NoChunks {
+		return request, nil
+	}
+	for _, field := range strings.Split(args[2], ",") {
+		index, err := strconv.Atoi(field)
+		if err != nil || index < 0 {
+			return ResendRequest{}, fmt.Errorf("invalid chunk index: %q", field)
+		}
+		request.Chunks = append(request.Chunks, index)
+	}
+	return request, nil
+}
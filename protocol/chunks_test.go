@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	data := testData(2*ChunkSize + 100)
+	manifest, err := BuildManifest(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Chunks() != 3 || manifest.ChunkLength(2) != 100 || manifest.ChunkOffset(2) != 2*ChunkSize {
+		t.Fatalf("manifest has %d chunks, the last %d bytes at %d", manifest.Chunks(), manifest.ChunkLength(2), manifest.ChunkOffset(2))
+	}
+
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, manifest); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(bytes.NewReader(buf.Bytes()), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, manifest) {
+		t.Error("manifest changed on the way")
+	}
+	if !read.VerifyChunk(2, data[2*ChunkSize:]) || read.VerifyChunk(1, data[2*ChunkSize:]) || read.VerifyChunk(3, nil) {
+		t.Error("VerifyChunk does not match chunks to their hashes")
+	}
+
+	if _, err := ReadManifest(bytes.NewReader(buf.Bytes()), ChunkSize); err == nil {
+		t.Error("accepted a manifest for a file of another size")
+	}
+}
+
+func TestVerifierFindsCorruptChunks(t *testing.T) {
+	data := testData(3*ChunkSize + 10)
+	manifest, err := BuildManifest(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged := bytes.Clone(data)
+	damaged[ChunkSize+5]++
+	damaged[len(damaged)-1]++
+
+	// Resuming at the second chunk, in writes that straddle chunk boundaries
+	verifier := manifest.NewVerifier(ChunkSize)
+	for rest := damaged[ChunkSize:]; len(rest) > 0; {
+		n := min(len(rest), 300000)
+		verifier.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if got := verifier.Corrupt(); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("corrupt chunks = %v, want [1 3]", got)
+	}
+
+	var none *ChunkVerifier
+	if none.Corrupt() != nil {
+		t.Error("a nil verifier reported corrupt chunks")
+	}
+}
+
+func TestResendRequestRoundTrip(t *testing.T) {
+	for _, request := range []ResendRequest{
+		{Token: "abc"},
+		{Token: "abc", Chunks: []int{0}},
+		{Token: "abc", Chunks: []int{2, 5, 17}},
+	} {
+		parsed, err := ParseResendRequest(request.Encode())
+		if err != nil {
+			t.Errorf("%q: %v", request.Encode(), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, request) {
+			t.Errorf("%q parsed as %+v", request.Encode(), parsed)
+		}
+	}
+	if (ResendRequest{Token: "abc"}).Encode() != "/TRANSFER_RESEND abc -" {
+		t.Errorf("empty request encoded as %q", ResendRequest{Token: "abc"}.Encode())
+	}
+
+	for _, message := range []string{
+		"/TRANSFER_RESEND abc",
+		"/TRANSFER_RESEND abc 1,x",
+		"/TRANSFER_RESEND abc -1",
+		"/TRANSFER_OFFSET abc 1",
+	} {
+		if _, err := ParseResendRequest(message); err == nil {
+			t.Errorf("accepted %q", message)
+		}
+	}
+}
+
+// sealedTransfer seals data the way a sender with a manifest does, marking
+// the end of the data, and returns the stream with one byte of the frame
+// at offset damaged
+func sealedTransfer(t *testing.T, data []byte, damageAt int) (*bytes.Buffer, *SealedWriter) {
+	t.Helper()
+	var out bytes.Buffer
+	writer, err := NewSealedWriter(&out, testKey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), sealedChunkSize)
+		if _, err := writer.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := writer.EndData(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data frames are all full, so the one holding damageAt is easy to find
+	frame := frames(t, out.Bytes())[damageAt/sealedChunkSize]
+	start := bytes.Index(out.Bytes(), frame)
+	out.Bytes()[start+len(frame)-1] ^= 0x40
+	return &out, writer
+}
+
+// resend plays the sender's side of a resend request on the same stream
+func resend(t *testing.T, writer *SealedWriter, data []byte, manifest *Manifest, chunks []int) {
+	t.Helper()
+	for _, index := range chunks {
+		offset := manifest.ChunkOffset(index)
+		if _, err := writer.Write(data[offset : offset+manifest.ChunkLength(index)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedTransferResendsOnlyTheDamagedChunk(t *testing.T) {
+	data := testData(3*ChunkSize + 1000)
+	manifest, err := BuildManifest(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire, writer := sealedTransfer(t, data, ChunkSize+5*sealedChunkSize)
+
+	reader, err := NewSealedReader(wire, testKey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.FillDamaged(true)
+	verifier := manifest.NewVerifier(0)
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(io.TeeReader(reader, verifier), received); err != nil {
+		t.Fatalf("reading past the damaged frame: %v", err)
+	}
+	if err := reader.EndData(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := verifier.Corrupt()
+	if !reflect.DeepEqual(corrupt, []int{1}) {
+		t.Fatalf("corrupt chunks = %v, want [1]", corrupt)
+	}
+
+	resend(t, writer, data, manifest, corrupt)
+	chunk := make([]byte, manifest.ChunkLength(1))
+	if _, err := io.ReadFull(reader, chunk); err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.VerifyChunk(1, chunk) {
+		t.Error("chunk sent again does not verify")
+	}
+	if err := reader.Verify(); err != nil {
+		t.Errorf("Verify after the resend: %v", err)
+	}
+}
+
+func TestSealedTransferSkipsDataItCannotFollow(t *testing.T) {
+	data := testData(3*ChunkSize + 1000)
+	manifest, err := BuildManifest(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire, writer := sealedTransfer(t, data, 2*ChunkSize)
+
+	// Without FillDamaged, as for compressed data, the damaged frame ends the data
+	reader, err := NewSealedReader(wire, testKey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := manifest.NewVerifier(0)
+	if _, err := io.Copy(verifier, reader); !errors.Is(err, ErrTampered) {
+		t.Fatalf("reading the damaged frame: %v, want ErrTampered", err)
+	}
+	if err := reader.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	verifier.Abandon(int64(len(data)))
+	if err := reader.EndData(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := verifier.Corrupt()
+	if !reflect.DeepEqual(corrupt, []int{2, 3}) {
+		t.Fatalf("corrupt chunks = %v, want [2 3]", corrupt)
+	}
+
+	resend(t, writer, data, manifest, corrupt)
+	for _, index := range corrupt {
+		chunk := make([]byte, manifest.ChunkLength(index))
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			t.Fatal(err)
+		}
+		if !manifest.VerifyChunk(index, chunk) {
+			t.Errorf("chunk %d sent again does not verify", index)
+		}
+	}
+	if err := reader.Verify(); err != nil {
+		t.Errorf("Verify after the resend: %v", err)
+	}
+}
+
+func TestSealedEndOfDataIsNotData(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewSealedWriter(&out, testKey(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("short"))
+	writer.EndData()
+	writer.Close()
+
+	// A recipient expecting more data than came must not run into the resends
+	reader, err := NewSealedReader(bytes.NewReader(out.Bytes()), testKey(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 10)); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading past the end of the data: %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	// Nor may data be left unread before it
+	reader, _ = NewSealedReader(bytes.NewReader(out.Bytes()), testKey(4))
+	if _, err := io.ReadFull(reader, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.EndData(); err == nil {
+		t.Error("EndData accepted unread data")
+	}
+
+	// A damaged marker is never taken for one
+	damaged := bytes.Clone(out.Bytes())
+	marker := frames(t, damaged)[1]
+	damaged[bytes.Index(damaged, marker)+len(marker)-1] ^= 1
+	reader, _ = NewSealedReader(bytes.NewReader(damaged), testKey(4))
+	reader.FillDamaged(true)
+	io.ReadFull(reader, make([]byte, 5))
+	if err := reader.EndData(); !errors.Is(err, ErrTampered) {
+		t.Errorf("EndData on a damaged marker: %v, want ErrTampered", err)
+	}
+}
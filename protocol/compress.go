@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression algorithms a sender may pick for the data of a transfer. The
+// offer names the one in use; offers without it are sent as they are.
+const (
+	CompressFlate = "flate"
+	CompressGzip  = "gzip"
+)
+
+// CheckCompression returns an error for a compression we cannot undo
+func CheckCompression(algorithm string) error {
+	switch algorithm {
+	case "", CompressFlate, CompressGzip:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %q", algorithm)
+}
+
+// NewCompressor returns a writer compressing into w. Closing it ends the
+// compressed data but leaves w open for whatever follows.
+func NewCompressor(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressFlate:
+		return flate.NewWriter(w, flate.BestSpeed)
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	return nil, CheckCompression(algorithm)
+}
+
+// CompressedReader is the stream a decompressor reads from. Reading it a
+// byte at a time lets the decompressor stop exactly where the compressed
+// data ends, so the rest of the stream can be read after it.
+type CompressedReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// NewDecompressor returns a reader of the data NewCompressor wrote to r.
+// A gzip stream starts with a header, so this waits until it arrives.
+func NewDecompressor(r CompressedReader, algorithm string) (io.Reader, error) {
+	switch algorithm {
+	case CompressFlate:
+		return flate.NewReader(r), nil
+	case CompressGzip:
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		// Whatever follows in the stream is not another gzip member
+		reader.Multistream(false)
+		return reader, nil
+	}
+	return nil, CheckCompression(algorithm)
+}
+
+// FinishDecompressing reads the end of the compressed data once all the
+// bytes announced have been read from it, checking that there are no more
+func FinishDecompressing(r io.Reader) error {
+	extra, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return err
+	}
+	if extra != 0 {
+		return fmt.Errorf("sender compressed %d bytes more than announced", extra)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Roles a data connection can take in a transfer
+const (
+	RoleSend    = "send"
+	RoleReceive = "receive"
+)
+
+// Paths a transfer's bytes can take, reported by the recipient with
+// "/TRANSFER_PATH <token> <path>"
+const (
+	PathDirect = "direct"
+	PathRelay  = "relay"
+)
+
+// NoCandidates is sent instead of an address list when the sender cannot be
+// reached directly
+const NoCandidates = "-"
+
+// EncodeCandidates joins the addresses a sender listens on for direct transfers
+func EncodeCandidates(addresses []string) string {
+	if len(addresses) == 0 {
+		return NoCandidates
+	}
+	return strings.Join(addresses, ",")
+}
+
+// DecodeCandidates splits a candidate list back into addresses
+func DecodeCandidates(candidates string) []string {
+	if candidates == NoCandidates || candidates == "" {
+		return nil
+	}
+	return strings.Split(candidates, ",")
+}
+
+// DataHello is the first frame on a data connection: "/DATA <token> <role>".
+// The server answers with "/DATA_OK" once the peer's connection has arrived,
+// or "/DATA_REJECTED <reason>".
+type DataHello struct {
+	Token string
+	Role  string
+}
+
+// Encode returns the command form of a DataHello
+func (d DataHello) Encode() string {
+	return fmt.Sprintf("/DATA %s %s", d.Token, d.Role)
+}
+
+// IsDataHello reports whether a first frame opens a data connection rather
+// than a control connection
+func IsDataHello(message string) bool {
+	return strings.HasPrefix(message, "/DATA ")
+}
+
+// ParseDataHello parses a "/DATA" command
+func ParseDataHello(message string) (DataHello, error) {
+	args := strings.Fields(message)
+	if len(args) != 3 || args[0] != "/DATA" {
+		return DataHello{}, fmt.Errorf("invalid data connection request: %q", message)
+	}
+	if args[2] != RoleSend && args[2] != RoleReceive {
+		return DataHello{}, fmt.Errorf("invalid data connection role: %q", args[2])
+	}
+	return DataHello{Token: args[1], Role: args[2]}, nil
+}
@@ -0,0 +1,503 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A delta stream lets a folder be sent again without the bytes the recipient
+// already has. The recipient signs the files it holds, block by block, and
+// the sender slides a weak checksum over its own files to find those blocks
+// at any offset, as rsync does. What it finds is sent as a reference to the
+// recipient's block, everything else as literal bytes.
+
+const (
+	// minSignatureBlock and maxSignatureBlock bound the block size of a
+	// signature, which otherwise grows with the square root of the file
+	minSignatureBlock = 2 * 1024
+	maxSignatureBlock = 64 * 1024
+	// MaxSignatureBlocks bounds the blocks signed for one transfer
+	MaxSignatureBlocks = 1 << 22
+	// maxSignatureSize keeps a bogus signature header from allocating too much
+	maxSignatureSize = 128 << 20
+	// strongChecksumSize is how much of a block's SHA-256 a signature keeps
+	strongChecksumSize = 16
+	// deltaLiteralSize is the largest literal a sender puts in one op
+	deltaLiteralSize = 64 * 1024
+)
+
+// Ops of a delta stream
+const (
+	deltaLiteral byte = 'L' // length, then that many bytes
+	deltaCopy    byte = 'C' // file, first block and block count of the recipient's copy
+)
+
+// BlockSignature identifies one block of a file the recipient holds
+type BlockSignature struct {
+	Weak   uint32
+	Strong [strongChecksumSize]byte
+}
+
+// FileSignature lists the blocks of a file the recipient holds. Path is
+// relative to the folder and uses forward slashes.
+type FileSignature struct {
+	Path      string
+	Size      int64
+	BlockSize int64
+	Blocks    []BlockSignature
+}
+
+// SignatureBlockSize returns the block size a file of size bytes is signed in
+func SignatureBlockSize(size int64) int64 {
+	block := int64(math.Sqrt(float64(size)))
+	block = (block + 1023) / 1024 * 1024
+	return min(max(block, minSignatureBlock), maxSignatureBlock)
+}
+
+// blockLength returns the length of block index; only the last one is short
+func (s *FileSignature) blockLength(index int) int64 {
+	return min(s.BlockSize, s.Size-int64(index)*s.BlockSize)
+}
+
+// SignFile reads the size bytes of r and signs them block by block
+func SignFile(r io.Reader, path string, size int64) (FileSignature, error) {
+	sig := FileSignature{Path: path, Size: size, BlockSize: SignatureBlockSize(size)}
+	buf := make([]byte, sig.BlockSize)
+	for offset := int64(0); offset < size; offset += sig.BlockSize {
+		block := buf[:sig.blockLength(len(sig.Blocks))]
+		if _, err := io.ReadFull(r, block); err != nil {
+			return FileSignature{}, err
+		}
+		sig.Blocks = append(sig.Blocks, BlockSignature{Weak: weakChecksum(block), Strong: strongChecksum(block)})
+	}
+	return sig, nil
+}
+
+// WriteSignatures writes the signatures of every file as one length-prefixed
+// message: file count, then per file its path, size, block size and blocks
+func WriteSignatures(w io.Writer, signatures []FileSignature) error {
+	body := binary.BigEndian.AppendUint32(nil, uint32(len(signatures)))
+	for _, sig := range signatures {
+		if len(sig.Path) > math.MaxUint16 {
+			return fmt.Errorf("path is too long to sign: %q", sig.Path)
+		}
+		body = binary.BigEndian.AppendUint16(body, uint16(len(sig.Path)))
+		body = append(body, sig.Path...)
+		body = binary.BigEndian.AppendUint64(body, uint64(sig.Size))
+		body = binary.BigEndian.AppendUint32(body, uint32(sig.BlockSize))
+		for _, block := range sig.Blocks {
+			body = binary.BigEndian.AppendUint32(body, block.Weak)
+			body = append(body, block.Strong[:]...)
+		}
+	}
+	if len(body) > maxSignatureSize {
+		return fmt.Errorf("signatures are too large (%d bytes)", len(body))
+	}
+
+	message := binary.BigEndian.AppendUint64(nil, uint64(len(body)))
+	_, err := w.Write(append(message, body...))
+	return err
+}
+
+// ReadSignatures reads the message written by WriteSignatures
+func ReadSignatures(r io.Reader) ([]FileSignature, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint64(header[:])
+	if length > maxSignatureSize {
+		return nil, fmt.Errorf("signatures are too large (%d bytes)", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	invalid := errors.New("invalid signatures")
+	take := func(n int) []byte {
+		if n > len(body) {
+			return nil
+		}
+		field := body[:n]
+		body = body[n:]
+		return field
+	}
+
+	count := take(4)
+	if count == nil {
+		return nil, invalid
+	}
+	var signatures []FileSignature
+	blocks := 0
+	for i := uint32(0); i < binary.BigEndian.Uint32(count); i++ {
+		pathLength := take(2)
+		if pathLength == nil {
+			return nil, invalid
+		}
+		path := take(int(binary.BigEndian.Uint16(pathLength)))
+		sizes := take(12)
+		if path == nil || sizes == nil {
+			return nil, invalid
+		}
+		sig := FileSignature{
+			Path:      string(path),
+			Size:      int64(binary.BigEndian.Uint64(sizes[:8])),
+			BlockSize: int64(binary.BigEndian.Uint32(sizes[8:])),
+		}
+		if sig.Size < 0 || sig.BlockSize <= 0 || sig.BlockSize > maxSignatureBlock {
+			return nil, invalid
+		}
+		count := (sig.Size + sig.BlockSize - 1) / sig.BlockSize
+		if blocks += int(count); count > MaxSignatureBlocks || blocks > MaxSignatureBlocks {
+			return nil, fmt.Errorf("signatures list more than %d blocks", MaxSignatureBlocks)
+		}
+		sig.Blocks = make([]BlockSignature, count)
+		for j := range sig.Blocks {
+			block := take(4 + strongChecksumSize)
+			if block == nil {
+				return nil, invalid
+			}
+			sig.Blocks[j].Weak = binary.BigEndian.Uint32(block[:4])
+			copy(sig.Blocks[j].Strong[:], block[4:])
+		}
+		signatures = append(signatures, sig)
+	}
+	if len(body) != 0 {
+		return nil, invalid
+	}
+	return signatures, nil
+}
+
+// rollingChecksum is the weak checksum of a block. It can slide forward by
+// one byte without reading the whole block again.
+type rollingChecksum struct {
+	a, b   uint32
+	length uint32
+}
+
+func (c *rollingChecksum) reset(block []byte) {
+	c.a, c.b, c.length = 0, 0, uint32(len(block))
+	for i, x := range block {
+		c.a += uint32(x)
+		c.b += uint32(len(block)-i) * uint32(x)
+	}
+}
+
+// roll drops out from the start of the block and adds in at its end
+func (c *rollingChecksum) roll(out, in byte) {
+	c.a += uint32(in) - uint32(out)
+	c.b += c.a - c.length*uint32(out)
+}
+
+func (c *rollingChecksum) sum() uint32 {
+	return c.a&0xffff | c.b<<16
+}
+
+func weakChecksum(block []byte) uint32 {
+	var c rollingChecksum
+	c.reset(block)
+	return c.sum()
+}
+
+func strongChecksum(block []byte) [strongChecksumSize]byte {
+	var strong [strongChecksumSize]byte
+	sum := sha256.Sum256(block)
+	copy(strong[:], sum[:])
+	return strong
+}
+
+// DeltaWriter writes a delta stream. Literal and Copied count the bytes sent
+// as they are and the bytes the recipient copies from its own files.
+type DeltaWriter struct {
+	w       io.Writer
+	buf     []byte
+	pending struct{ file, block, count int } // run of blocks not written yet
+	Literal int64
+	Copied  int64
+}
+
+// NewDeltaWriter returns a DeltaWriter writing to w. Flush must be called
+// once everything is written.
+func NewDeltaWriter(w io.Writer) *DeltaWriter {
+	return &DeltaWriter{w: w}
+}
+
+// WriteLiteral sends the next n bytes of r as they are
+func (d *DeltaWriter) WriteLiteral(r io.Reader, n int64) error {
+	if d.buf == nil {
+		d.buf = make([]byte, deltaLiteralSize)
+	}
+	for n > 0 {
+		chunk := d.buf[:min(n, deltaLiteralSize)]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		if err := d.literal(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// WriteFile sends the next n bytes of r, which belong to a file the
+// recipient holds an earlier copy of. file is the index of its signature.
+func (d *DeltaWriter) WriteFile(r io.Reader, n int64, file int, sig *FileSignature) error {
+	blockSize := int(sig.BlockSize)
+	index := make(map[uint32][]int)
+	tail := -1
+	for i, block := range sig.Blocks {
+		if sig.blockLength(i) < sig.BlockSize {
+			tail = i
+			continue
+		}
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+
+	// buf holds the literal bytes not written yet, then the block being
+	// looked up and whatever was read past it
+	buf := make([]byte, 0, 2*deltaLiteralSize+2*blockSize)
+	lit, pos := 0, 0
+	var weak rollingChecksum
+	rolled, pendingRoll := false, false
+	var dropped byte
+
+	for {
+		if len(buf)-pos < blockSize && n > 0 {
+			copy(buf, buf[lit:])
+			buf = buf[:len(buf)-lit]
+			pos -= lit
+			lit = 0
+			more := int(min(int64(cap(buf)-len(buf)), n))
+			if _, err := io.ReadFull(r, buf[len(buf):len(buf)+more]); err != nil {
+				return err
+			}
+			buf = buf[:len(buf)+more]
+			n -= int64(more)
+		}
+
+		available := len(buf) - pos
+		if available < blockSize {
+			// The end of the file can only match the recipient's last block
+			end := len(buf)
+			if tail >= 0 && available >= int(sig.blockLength(tail)) {
+				start := end - int(sig.blockLength(tail))
+				block := buf[start:end]
+				if weakChecksum(block) == sig.Blocks[tail].Weak && strongChecksum(block) == sig.Blocks[tail].Strong {
+					if err := d.literal(buf[lit:start]); err != nil {
+						return err
+					}
+					return d.copyBlock(file, tail, len(block))
+				}
+			}
+			return d.literal(buf[lit:end])
+		}
+
+		window := buf[pos : pos+blockSize]
+		if !rolled {
+			weak.reset(window)
+			rolled = true
+		} else if pendingRoll {
+			weak.roll(dropped, window[blockSize-1])
+		}
+		pendingRoll = false
+
+		if match := d.findBlock(index[weak.sum()], window, file, sig); match >= 0 {
+			if err := d.literal(buf[lit:pos]); err != nil {
+				return err
+			}
+			if err := d.copyBlock(file, match, blockSize); err != nil {
+				return err
+			}
+			pos += blockSize
+			lit = pos
+			rolled = false
+			continue
+		}
+
+		dropped = buf[pos]
+		pendingRoll = true
+		pos++
+		if pos-lit >= deltaLiteralSize {
+			if err := d.literal(buf[lit:pos]); err != nil {
+				return err
+			}
+			lit = pos
+		}
+	}
+}
+
+// findBlock returns the block of the recipient's file that window matches,
+// preferring the one after the last match so runs of blocks stay together
+func (d *DeltaWriter) findBlock(candidates []int, window []byte, file int, sig *FileSignature) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := strongChecksum(window)
+	match := -1
+	for _, candidate := range candidates {
+		if sig.Blocks[candidate].Strong != strong {
+			continue
+		}
+		if d.pending.count > 0 && d.pending.file == file && candidate == d.pending.block+d.pending.count {
+			return candidate
+		}
+		if match < 0 {
+			match = candidate
+		}
+	}
+	return match
+}
+
+// Flush writes the run of blocks still held back
+func (d *DeltaWriter) Flush() error {
+	if d.pending.count == 0 {
+		return nil
+	}
+	var op [13]byte
+	op[0] = deltaCopy
+	binary.BigEndian.PutUint32(op[1:5], uint32(d.pending.file))
+	binary.BigEndian.PutUint32(op[5:9], uint32(d.pending.block))
+	binary.BigEndian.PutUint32(op[9:13], uint32(d.pending.count))
+	d.pending.count = 0
+	_, err := d.w.Write(op[:])
+	return err
+}
+
+func (d *DeltaWriter) literal(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := d.Flush(); err != nil {
+		return err
+	}
+	var op [5]byte
+	op[0] = deltaLiteral
+	binary.BigEndian.PutUint32(op[1:], uint32(len(p)))
+	if _, err := d.w.Write(op[:]); err != nil {
+		return err
+	}
+	if _, err := d.w.Write(p); err != nil {
+		return err
+	}
+	d.Literal += int64(len(p))
+	return nil
+}
+
+// copyBlock adds a block to the current run, starting a new run if it does
+// not follow on from it
+func (d *DeltaWriter) copyBlock(file, block, length int) error {
+	d.Copied += int64(length)
+	if d.pending.count > 0 && d.pending.file == file && d.pending.block+d.pending.count == block {
+		d.pending.count++
+		return nil
+	}
+	if err := d.Flush(); err != nil {
+		return err
+	}
+	d.pending.file, d.pending.block, d.pending.count = file, block, 1
+	return nil
+}
+
+// DeltaReader turns a delta stream back into the bytes it stands for,
+// reading copied blocks from the files the recipient signed. Literal and
+// Copied count the bytes that came over the wire and from those files.
+type DeltaReader struct {
+	r          io.Reader
+	signatures []FileSignature
+	basis      func(file int) (io.ReaderAt, error)
+
+	literal  int64 // bytes left in the current literal
+	copyFrom io.ReaderAt
+	copyPath string
+	copyAt   int64
+	copying  int64 // bytes left in the current run of blocks
+
+	Literal int64
+	Copied  int64
+}
+
+// NewDeltaReader reads the delta stream from r. basis opens the file of a
+// signature.
+func NewDeltaReader(r io.Reader, signatures []FileSignature, basis func(file int) (io.ReaderAt, error)) *DeltaReader {
+	return &DeltaReader{r: r, signatures: signatures, basis: basis}
+}
+
+func (d *DeltaReader) Read(p []byte) (int, error) {
+	for d.literal == 0 && d.copying == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if d.literal > 0 {
+		n, err := d.r.Read(p[:min(int64(len(p)), d.literal)])
+		d.literal -= int64(n)
+		d.Literal += int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+
+	want := int(min(int64(len(p)), d.copying))
+	n, err := d.copyFrom.ReadAt(p[:want], d.copyAt)
+	d.copyAt += int64(n)
+	d.copying -= int64(n)
+	d.Copied += int64(n)
+	if n < want {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%s changed while it was being received", d.copyPath)
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// next reads the op header of the next literal or run of blocks
+func (d *DeltaReader) next() error {
+	var op [1]byte
+	if _, err := io.ReadFull(d.r, op[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	switch op[0] {
+	case deltaLiteral:
+		var length [4]byte
+		if _, err := io.ReadFull(d.r, length[:]); err != nil {
+			return err
+		}
+		d.literal = int64(binary.BigEndian.Uint32(length[:]))
+		return nil
+	case deltaCopy:
+		var fields [12]byte
+		if _, err := io.ReadFull(d.r, fields[:]); err != nil {
+			return err
+		}
+		file := int(binary.BigEndian.Uint32(fields[0:4]))
+		block := int64(binary.BigEndian.Uint32(fields[4:8]))
+		count := int64(binary.BigEndian.Uint32(fields[8:12]))
+		if file >= len(d.signatures) || block+count > int64(len(d.signatures[file].Blocks)) {
+			return fmt.Errorf("delta refers to blocks we never signed")
+		}
+		sig := &d.signatures[file]
+		from, err := d.basis(file)
+		if err != nil {
+			return err
+		}
+		d.copyFrom, d.copyPath = from, sig.Path
+		d.copyAt = block * sig.BlockSize
+		d.copying = min(count*sig.BlockSize, sig.Size-d.copyAt)
+		return nil
+	default:
+		return fmt.Errorf("unknown delta op: %d", op[0])
+	}
+}
@@ -0,0 +1,265 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func randomBytes(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// delta sends current as a delta against basis and returns what the
+// recipient rebuilds, with the writer and reader counts
+func delta(t *testing.T, basis, current []byte) (rebuilt []byte, writer *DeltaWriter, reader *DeltaReader, stream []byte) {
+	t.Helper()
+	sig, err := SignFile(bytes.NewReader(basis), "dir/file.bin", int64(len(basis)))
+	if err != nil {
+		t.Fatalf("SignFile: %v", err)
+	}
+
+	var out bytes.Buffer
+	writer = NewDeltaWriter(&out)
+	// Short reads must not change what is sent
+	if err := writer.WriteFile(iotest.HalfReader(bytes.NewReader(current)), int64(len(current)), 0, &sig); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	stream = out.Bytes()
+
+	wire := bytes.NewReader(stream)
+	reader = NewDeltaReader(wire, []FileSignature{sig}, func(file int) (io.ReaderAt, error) {
+		if file != 0 {
+			t.Errorf("delta opened file %d", file)
+		}
+		return bytes.NewReader(basis), nil
+	})
+	rebuilt = make([]byte, len(current))
+	if _, err := io.ReadFull(reader, rebuilt); err != nil {
+		t.Fatalf("DeltaReader: %v", err)
+	}
+	if wire.Len() != 0 {
+		t.Errorf("%d bytes of the delta were left unread", wire.Len())
+	}
+	return rebuilt, writer, reader, stream
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	// 100000 bytes are signed in 2048 byte blocks: 48 full ones and a tail
+	// of 1696 bytes
+	const size = 100000
+	const block = 2048
+	const full = size / block * block
+	const tail = size - full
+	if SignatureBlockSize(size) != block {
+		t.Fatalf("block size of %d bytes = %d, the cases below expect %d", size, SignatureBlockSize(size), block)
+	}
+
+	basis := randomBytes(1, size)
+	inserted := randomBytes(2, 100)
+	changed := append([]byte(nil), basis...)
+	changed[30000] ^= 0xff
+	large := randomBytes(3, 3*deltaLiteralSize+123)
+
+	for _, tc := range []struct {
+		name    string
+		basis   []byte
+		current []byte
+		literal int64
+		copied  int64
+	}{
+		{"identical", basis, basis, 0, size},
+		{"shifted by one byte", basis, join([]byte{0}, basis), 1, size},
+		{"shifted by a few bytes", basis, join(inserted[:10], basis), 10, size},
+		// The block the bytes went into is sent whole, the rest is found again
+		{"inserted", basis, join(basis[:50000], inserted, basis[50000:]), block + 100, size - block},
+		{"one byte changed", basis, changed, block, size - block},
+		{"removed block", basis, join(basis[:10*block], basis[11*block:]), 0, size - block},
+		// What is left of the cut block does not match anything
+		{"truncated", basis, basis[:60000], 60000 - 60000/block*block, 60000 / block * block},
+		{"truncated to blocks", basis, basis[:20*block], 0, 20 * block},
+		// The short tail only matches at the very end of the file
+		{"appended", basis, join(basis, inserted), tail + 100, full},
+		{"prepended more than a literal holds", basis, join(large, basis), int64(len(large)), size},
+		{"swapped halves", basis, join(basis[24*block:], basis[:24*block]), tail, full},
+		{"empty", basis, nil, 0, 0},
+		{"nothing signed", nil, basis, size, 0},
+		{"smaller than a block", basis[:1000], basis[:1000], 0, 1000},
+		{"unrelated", basis, randomBytes(4, size), size, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rebuilt, writer, reader, _ := delta(t, tc.basis, tc.current)
+			if !bytes.Equal(rebuilt, tc.current) {
+				t.Fatal("rebuilt file differs from the one sent")
+			}
+			if writer.Literal != tc.literal || writer.Copied != tc.copied {
+				t.Errorf("writer sent %d literal and %d copied bytes, want %d and %d",
+					writer.Literal, writer.Copied, tc.literal, tc.copied)
+			}
+			if reader.Literal != writer.Literal || reader.Copied != writer.Copied {
+				t.Errorf("reader counted %d literal and %d copied bytes, writer %d and %d",
+					reader.Literal, reader.Copied, writer.Literal, writer.Copied)
+			}
+		})
+	}
+}
+
+func TestDeltaRunsOfBlocks(t *testing.T) {
+	basis := randomBytes(1, 100000)
+	_, _, _, stream := delta(t, basis, basis)
+	// The whole file is a single run of blocks
+	if len(stream) != 13 || stream[0] != deltaCopy {
+		t.Errorf("identical file sent as %d bytes of ops, want one copy op", len(stream))
+	}
+}
+
+func TestDeltaWriteLiteral(t *testing.T) {
+	data := randomBytes(1, 2*deltaLiteralSize+5)
+	var out bytes.Buffer
+	writer := NewDeltaWriter(&out)
+	if err := writer.WriteLiteral(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewDeltaReader(&out, nil, nil)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || writer.Literal != int64(len(data)) || reader.Literal != int64(len(data)) {
+		t.Errorf("literal round trip failed: %d and %d literal bytes", writer.Literal, reader.Literal)
+	}
+}
+
+func TestDeltaReaderRejects(t *testing.T) {
+	sig := FileSignature{Path: "a", Size: 4096, BlockSize: 2048, Blocks: make([]BlockSignature, 2)}
+	basis := func(int) (io.ReaderAt, error) { return bytes.NewReader(make([]byte, 4096)), nil }
+	copyOp := func(file, block, count uint32) []byte {
+		op := []byte{deltaCopy}
+		op = binary.BigEndian.AppendUint32(op, file)
+		op = binary.BigEndian.AppendUint32(op, block)
+		return binary.BigEndian.AppendUint32(op, count)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"unknown op", []byte{'X'}},
+		{"unknown file", copyOp(1, 0, 1)},
+		{"blocks past the end", copyOp(0, 1, 2)},
+		{"cut literal", []byte{deltaLiteral, 0, 0, 0, 10, 1, 2}},
+		{"nothing", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := NewDeltaReader(bytes.NewReader(tc.stream), []FileSignature{sig}, basis)
+			if _, err := io.ReadFull(reader, make([]byte, 10)); err == nil {
+				t.Error("read an invalid delta")
+			}
+		})
+	}
+}
+
+func TestSignaturesRoundTrip(t *testing.T) {
+	first, err := SignFile(bytes.NewReader(randomBytes(1, 5000)), "a.txt", 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := SignFile(bytes.NewReader(nil), "dir/empty", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures := []FileSignature{first, empty}
+
+	var out bytes.Buffer
+	if err := WriteSignatures(&out, signatures); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSignatures(&out)
+	if err != nil {
+		t.Fatalf("ReadSignatures: %v", err)
+	}
+	// An empty file has no blocks, which reads back as an empty list
+	got[1].Blocks = nil
+	if !reflect.DeepEqual(got, signatures) {
+		t.Errorf("ReadSignatures = %+v, want %+v", got, signatures)
+	}
+}
+
+func TestReadSignaturesMalformed(t *testing.T) {
+	// message frames a body the way WriteSignatures does
+	message := func(body []byte) []byte {
+		return append(binary.BigEndian.AppendUint64(nil, uint64(len(body))), body...)
+	}
+	// file encodes one signature header without its blocks
+	file := func(path string, size uint64, blockSize uint32) []byte {
+		b := binary.BigEndian.AppendUint16(nil, uint16(len(path)))
+		b = append(b, path...)
+		b = binary.BigEndian.AppendUint64(b, size)
+		return binary.BigEndian.AppendUint32(b, blockSize)
+	}
+	count := func(n uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, n)
+	}
+	block := make([]byte, 4+strongChecksumSize)
+
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		error string
+	}{
+		{"no header", []byte{0, 0, 0}, ""},
+		{"oversize", binary.BigEndian.AppendUint64(nil, maxSignatureSize+1), "too large"},
+		{"huge length", binary.BigEndian.AppendUint64(nil, 1<<63), "too large"},
+		{"body cut short", binary.BigEndian.AppendUint64(nil, 100), ""},
+		{"no count", message(nil), "invalid"},
+		{"missing file", message(count(1)), "invalid"},
+		{"path cut short", message(join(count(1), []byte{0, 10, 'a'})), "invalid"},
+		{"zero block size", message(join(count(1), file("a", 10, 0))), "invalid"},
+		{"block size too large", message(join(count(1), file("a", 10, maxSignatureBlock+1))), "invalid"},
+		{"negative size", message(join(count(1), file("a", 1<<63, 2048))), "invalid"},
+		{"too many blocks", message(join(count(1), file("a", MaxSignatureBlocks+1, 1))), "more than"},
+		{"missing blocks", message(join(count(1), file("a", 4096, 2048), block)), "invalid"},
+		{"trailing bytes", message(join(count(1), file("a", 2048, 2048), block, []byte{0})), "invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			signatures, err := ReadSignatures(bytes.NewReader(tc.input))
+			if err == nil {
+				t.Fatalf("ReadSignatures accepted it: %+v", signatures)
+			}
+			if !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("error = %v, want one mentioning %q", err, tc.error)
+			}
+		})
+	}
+}
+
+func TestRollingChecksum(t *testing.T) {
+	data := randomBytes(1, 4096)
+	const size = 1024
+	var c rollingChecksum
+	c.reset(data[:size])
+	for i := 1; i+size <= len(data); i++ {
+		c.roll(data[i-1], data[i+size-1])
+		if want := weakChecksum(data[i : i+size]); c.sum() != want {
+			t.Fatalf("rolled checksum at %d = %x, want %x", i, c.sum(), want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// FolderListingHeaderSize is the length prefix in front of a folder listing
+const FolderListingHeaderSize = 8
+
+// MaxFolderListingSize bounds the listing a receiver is willing to buffer
+const MaxFolderListingSize = 64 << 20
+
+// FolderEntry is one file, directory or symlink of a folder transfer. Paths
+// are relative to the folder and use forward slashes.
+type FolderEntry struct {
+	Path string      `json:"path"`
+	Size int64       `json:"size,omitempty"`
+	Mode os.FileMode `json:"mode"`
+	Dir  bool        `json:"dir,omitempty"`
+	Link string      `json:"link,omitempty"` // the target of a symlink, as the sender has it
+}
+
+// A folder is sent as one stream: the length of the listing, the listing,
+// then the contents of every file in listing order. Treating it as a single
+// file lets resume, chunk verification and checksums work on folders too.
+
+// EncodeFolderListing returns the listing as it starts a folder stream
+func EncodeFolderListing(entries []FolderEntry) ([]byte, error) {
+	listing, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(listing) > MaxFolderListingSize {
+		return nil, fmt.Errorf("folder listing is too large (%d bytes)", len(listing))
+	}
+
+	header := make([]byte, FolderListingHeaderSize, FolderListingHeaderSize+len(listing))
+	binary.BigEndian.PutUint64(header, uint64(len(listing)))
+	return append(header, listing...), nil
+}
+
+// FolderListingLength returns the full length of the listing at the start of
+// a folder stream, once its length prefix has arrived
+func FolderListingLength(header []byte) (int64, error) {
+	if len(header) < FolderListingHeaderSize {
+		return 0, fmt.Errorf("folder listing header is incomplete")
+	}
+	length := binary.BigEndian.Uint64(header[:FolderListingHeaderSize])
+	if length > MaxFolderListingSize {
+		return 0, fmt.Errorf("folder listing is too large (%d bytes)", length)
+	}
+	return FolderListingHeaderSize + int64(length), nil
+}
+
+// DecodeFolderListing parses a complete listing and checks it with
+// CheckFolderListing
+func DecodeFolderListing(header []byte) ([]FolderEntry, error) {
+	var entries []FolderEntry
+	if err := json.Unmarshal(header[FolderListingHeaderSize:], &entries); err != nil {
+		return nil, fmt.Errorf("invalid folder listing: %v", err)
+	}
+	if err := CheckFolderListing(entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// CheckFolderListing checks that every path of a listing stays inside the
+// folder it is extracted to, appears once and leads through directories of
+// the listing only, never through one of its files or links. Where a link
+// may point is up to the receiver.
+func CheckFolderListing(entries []FolderEntry) error {
+	kinds := make(map[string]bool, len(entries)) // path -> is a directory
+	for _, entry := range entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) || path.Clean(entry.Path) != entry.Path || entry.Path == "." {
+			return fmt.Errorf("folder listing contains an unsafe path: %q", entry.Path)
+		}
+		if _, exists := kinds[entry.Path]; exists {
+			return fmt.Errorf("folder listing contains %q twice", entry.Path)
+		}
+		if entry.Dir && entry.Link != "" {
+			return fmt.Errorf("folder listing has %q as both a directory and a link", entry.Path)
+		}
+		if entry.Size < 0 || ((entry.Dir || entry.Link != "") && entry.Size != 0) {
+			return fmt.Errorf("folder listing has an invalid size for %q", entry.Path)
+		}
+		kinds[entry.Path] = entry.Dir
+	}
+	for _, entry := range entries {
+		for parent := path.Dir(entry.Path); parent != "."; parent = path.Dir(parent) {
+			if dir, exists := kinds[parent]; exists && !dir {
+				return fmt.Errorf("folder listing puts %q inside a file or link", entry.Path)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func listing(t *testing.T, entries ...FolderEntry) []byte {
+	t.Helper()
+	header, err := EncodeFolderListing(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestFolderListingRoundTrip(t *testing.T) {
+	entries := []FolderEntry{
+		{Path: "docs", Mode: 0755, Dir: true},
+		{Path: "docs/a.txt", Size: 10, Mode: 0644},
+		{Path: "docs/link", Mode: 0777, Link: "a.txt"},
+		{Path: "empty", Mode: 0644},
+	}
+	header := listing(t, entries...)
+
+	length, err := FolderListingLength(header)
+	if err != nil || length != int64(len(header)) {
+		t.Fatalf("FolderListingLength = %d, %v; want %d", length, err, len(header))
+	}
+	got, err := DecodeFolderListing(header)
+	if err != nil {
+		t.Fatalf("DecodeFolderListing: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("decoded %d entries, want %d", len(got), len(entries))
+	}
+	for i := range got {
+		if got[i] != entries[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], entries[i])
+		}
+	}
+}
+
+func TestFolderListingLength(t *testing.T) {
+	if _, err := FolderListingLength([]byte{0, 0, 0}); err == nil {
+		t.Error("accepted an incomplete header")
+	}
+	header := binary.BigEndian.AppendUint64(nil, MaxFolderListingSize+1)
+	if _, err := FolderListingLength(header); err == nil {
+		t.Error("accepted a listing larger than MaxFolderListingSize")
+	}
+}
+
+func TestDecodeFolderListingRejects(t *testing.T) {
+	file := func(path string) FolderEntry { return FolderEntry{Path: path, Size: 1, Mode: 0644} }
+	dir := func(path string) FolderEntry { return FolderEntry{Path: path, Mode: 0755, Dir: true} }
+	link := func(path, target string) FolderEntry { return FolderEntry{Path: path, Mode: 0777, Link: target} }
+
+	for _, tc := range []struct {
+		name    string
+		entries []FolderEntry
+		error   string
+	}{
+		{"parent", []FolderEntry{file("../evil")}, "unsafe path"},
+		{"parent inside", []FolderEntry{file("a/../../evil")}, "unsafe path"},
+		{"only parent", []FolderEntry{dir("..")}, "unsafe path"},
+		{"absolute", []FolderEntry{file("/etc/passwd")}, "unsafe path"},
+		{"empty path", []FolderEntry{file("")}, "unsafe path"},
+		{"dot", []FolderEntry{dir(".")}, "unsafe path"},
+		{"not clean", []FolderEntry{file("a//b")}, "unsafe path"},
+		{"trailing slash", []FolderEntry{dir("a/")}, "unsafe path"},
+		{"dot inside", []FolderEntry{file("a/./b")}, "unsafe path"},
+		{"duplicate", []FolderEntry{file("a"), file("a")}, "twice"},
+		{"file and directory", []FolderEntry{dir("a"), file("a")}, "twice"},
+		{"under a file", []FolderEntry{file("a"), file("a/b")}, "inside a file or link"},
+		{"deep under a file", []FolderEntry{file("a"), dir("a/b"), file("a/b/c")}, "inside a file or link"},
+		{"under a file listed later", []FolderEntry{file("a/b"), file("a")}, "inside a file or link"},
+		{"under a link", []FolderEntry{link("a", "/tmp"), file("a/b")}, "inside a file or link"},
+		{"directory and link", []FolderEntry{{Path: "a", Dir: true, Link: "b"}}, "both a directory and a link"},
+		{"negative size", []FolderEntry{{Path: "a", Size: -1}}, "invalid size"},
+		{"sized directory", []FolderEntry{{Path: "a", Size: 1, Dir: true}}, "invalid size"},
+		{"sized link", []FolderEntry{{Path: "a", Size: 1, Link: "b"}}, "invalid size"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := DecodeFolderListing(listing(t, tc.entries...))
+			if err == nil {
+				t.Fatalf("accepted %+v", entries)
+			}
+			if !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("error = %v, want one mentioning %q", err, tc.error)
+			}
+		})
+	}
+}
+
+func TestDecodeFolderListingAccepts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []FolderEntry
+	}{
+		// Parents do not have to be listed, they are created as needed
+		{"unlisted parent", []FolderEntry{{Path: "a/b/c", Size: 1}}},
+		{"dots in names", []FolderEntry{{Path: "..a"}, {Path: "a..b"}}},
+		// Where a link points is checked by the receiver
+		{"link leaving the folder", []FolderEntry{{Path: "a", Link: "../../etc"}}},
+		{"nothing", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := DecodeFolderListing(listing(t, tc.entries...)); err != nil {
+				t.Errorf("DecodeFolderListing: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeFolderListingInvalidJSON(t *testing.T) {
+	body := []byte(`[{"path": 1}]`)
+	header := append(binary.BigEndian.AppendUint64(nil, uint64(len(body))), body...)
+	if _, err := DecodeFolderListing(header); err == nil {
+		t.Error("accepted an invalid listing")
+	}
+}
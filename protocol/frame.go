@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType identifies what the payload of a frame carries
+type FrameType byte
+
+const (
+	// FrameCommand carries a control command such as "/FILE_REQUEST ..."
+	FrameCommand FrameType = iota + 1
+	// FrameChat carries chat text that is displayed as-is
+	FrameChat
+	// FrameData carries one sealed frame of an encrypted transfer stream on a
+	// data connection; it never appears on a control connection
+	FrameData
+)
+
+// String representation of FrameType
+func (t FrameType) String() string {
+	switch t {
+	case FrameCommand:
+		return "Command"
+	case FrameChat:
+		return "Chat"
+	case FrameData:
+		return "Data"
+	default:
+		return "Unknown"
+	}
+}
+
+const (
+	// HeaderSize is the size of the frame header: 1 byte type + 4 bytes length
+	HeaderSize = 5
+	// MaxPayloadSize bounds a single frame so a peer cannot make us allocate unbounded memory
+	MaxPayloadSize = 16 << 20
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds MaxPayloadSize
+var ErrFrameTooLarge = errors.New("frame exceeds maximum payload size")
+
+// Frame is a single message on the wire: type, length and payload
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// WriteFrame encodes a frame and writes it with a single Write call so that
+// frames written concurrently on the same connection never interleave
+func WriteFrame(w io.Writer, frameType FrameType, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, HeaderSize+len(payload))
+	buf[0] = byte(frameType)
+	binary.BigEndian.PutUint32(buf[1:HeaderSize], uint32(len(payload)))
+	copy(buf[HeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame from the reader
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	frameType := FrameType(header[0])
+	if frameType < FrameCommand || frameType > FrameData {
+		return Frame{}, fmt.Errorf("unknown frame type: %d", header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MaxPayloadSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return Frame{Type: frameType, Payload: payload}, nil
+}
+
+// SendCommand writes a control command frame
+func SendCommand(w io.Writer, command string) error {
+	return WriteFrame(w, FrameCommand, []byte(command))
+}
+
+// SendChat writes a chat frame
+func SendChat(w io.Writer, text string) error {
+	return WriteFrame(w, FrameChat, []byte(text))
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the version spoken by this build
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version this build still talks to
+	MinProtocolVersion = 1
+)
+
+// Optional features a peer may announce during the handshake. Unknown
+// feature names are ignored so new ones can be rolled out gradually.
+const (
+	FeatureCompression = "compression"
+	FeatureHashing     = "hashing"
+	FeatureEncryption  = "encryption"
+	FeatureResume      = "resume"
+	FeatureDirect      = "direct"
+	FeatureChunks      = "chunks"
+	FeatureDelta       = "delta"
+	FeatureStreams     = "streams"
+)
+
+// Hello is sent by the client as the very first frame of a control connection
+type Hello struct {
+	Version  int
+	Features []string
+}
+
+// Welcome is the server's answer to Hello: the negotiated version and the
+// features both sides support
+type Welcome struct {
+	Version  int
+	Features []string
+}
+
+// Encode returns the command form of a Hello: "/HELLO <version> <features>"
+func (h Hello) Encode() string {
+	return encodeHandshake("/HELLO", h.Version, h.Features)
+}
+
+// Encode returns the command form of a Welcome: "/WELCOME <version> <features>"
+func (w Welcome) Encode() string {
+	return encodeHandshake("/WELCOME", w.Version, w.Features)
+}
+
+// ParseHello parses a "/HELLO" command
+func ParseHello(message string) (Hello, error) {
+	version, features, err := parseHandshake("/HELLO", message)
+	return Hello{Version: version, Features: features}, err
+}
+
+// ParseWelcome parses a "/WELCOME" command
+func ParseWelcome(message string) (Welcome, error) {
+	version, features, err := parseHandshake("/WELCOME", message)
+	return Welcome{Version: version, Features: features}, err
+}
+
+// Negotiate picks the version both sides speak and the features both support.
+// It fails if the remote version is older than MinProtocolVersion.
+func Negotiate(remoteVersion int, local, remote []string) (int, []string, error) {
+	if remoteVersion < MinProtocolVersion {
+		return 0, nil, fmt.Errorf("protocol version %d is no longer supported (minimum %d)", remoteVersion, MinProtocolVersion)
+	}
+
+	version := ProtocolVersion
+	if remoteVersion < version {
+		version = remoteVersion
+	}
+
+	var features []string
+	for _, feature := range local {
+		if HasFeature(remote, feature) {
+			features = append(features, feature)
+		}
+	}
+	return version, features, nil
+}
+
+// HasFeature reports whether a feature is in the list
+func HasFeature(features []string, name string) bool {
+	for _, feature := range features {
+		if feature == name {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeHandshake(command string, version int, features []string) string {
+	list := strings.Join(features, ",")
+	if list == "" {
+		list = "-"
+	}
+	return fmt.Sprintf("%s %d %s", command, version, list)
+}
+
+func parseHandshake(command, message string) (int, []string, error) {
+	args := strings.Fields(message)
+	if len(args) < 2 || args[0] != command {
+		return 0, nil, fmt.Errorf("expected %s, got %q", command, message)
+	}
+
+	version, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid protocol version %q", args[1])
+	}
+
+	var features []string
+	if len(args) > 2 && args[2] != "-" {
+		for _, feature := range strings.Split(args[2], ",") {
+			if feature != "" {
+				features = append(features, feature)
+			}
+		}
+	}
+	return version, features, nil
+}
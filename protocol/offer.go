@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"sort"
+	"strings"
+)
+
+// NoAttributes is sent in place of an empty attribute list
+const NoAttributes = "-"
+
+// Attributes a sender may attach to a file or folder offer. Unknown ones are
+// ignored so new attributes can be added without breaking older clients.
+const (
+	// AttrRoom names the room a file was sent to; the server only passes it
+	// on if both sides are members
+	AttrRoom = "room"
+	// AttrHash names the algorithm of the checksum in the offer; offers
+	// without it use HashMD5, unless the server announced FeatureHashing
+	AttrHash = "hash"
+	// AttrStreams is the number of data connections a file is sent over;
+	// offers without it use one
+	AttrStreams = "streams"
+	// AttrCompress names the compression of the data; offers without it
+	// send the data as it is
+	AttrCompress = "compress"
+)
+
+// EncodeAttributes joins offer attributes as "key=value,key=value". Keys and
+// values may not contain spaces, commas or equal signs.
+func EncodeAttributes(attributes map[string]string) string {
+	if len(attributes) == 0 {
+		return NoAttributes
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+attributes[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// DecodeAttributes splits an attribute list back into its key/value pairs
+func DecodeAttributes(encoded string) map[string]string {
+	attributes := make(map[string]string)
+	if encoded == NoAttributes || encoded == "" {
+		return attributes
+	}
+	for _, pair := range strings.Split(encoded, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if found && key != "" {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateSlices is how many pieces a second's worth of bytes is handed out in,
+// so no stream waits much longer than a tenth of a second for its turn
+const rateSlices = 10
+
+// RateLimiter is a token bucket pacing the bytes of one or more streams. It
+// fills at its rate and holds at most a second's worth of tokens, so a stream
+// that was idle cannot burst for long. The zero value does not limit.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64 // bytes per second; 0 is unlimited
+	tokens float64
+	filled time.Time
+}
+
+// NewRateLimiter returns a bucket filling at rate bytes per second
+func NewRateLimiter(rate int64) *RateLimiter {
+	limiter := &RateLimiter{}
+	limiter.SetRate(rate)
+	return limiter
+}
+
+// SetRate changes the rate in bytes per second; 0 or less lifts the limit
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = min(l.tokens, float64(rate))
+		l.filled = time.Now()
+	}
+}
+
+// Rate returns the rate in bytes per second, 0 if unlimited
+func (l *RateLimiter) Rate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+// Take waits until some of n bytes may pass and returns how many. Callers
+// move that many and take again for the rest; each wait is short, so a
+// stream is never held up long after its rate was raised or lifted.
+func (l *RateLimiter) Take(n int) int {
+	for {
+		l.mutex.Lock()
+		if l.rate <= 0 || n <= 0 {
+			l.mutex.Unlock()
+			return n
+		}
+		now := time.Now()
+		l.tokens = min(l.tokens+now.Sub(l.filled).Seconds()*float64(l.rate), float64(l.rate))
+		l.filled = now
+
+		want := float64(min(int64(n), max(l.rate/rateSlices, 1)))
+		if l.tokens >= want {
+			l.tokens -= want
+			l.mutex.Unlock()
+			return int(want)
+		}
+		wait := time.Duration((want - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mutex.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Wait blocks until all n bytes may pass
+func (l *RateLimiter) Wait(n int) {
+	for n > 0 {
+		n -= l.Take(n)
+	}
+}
+
+// rateLimitedWriter writes no faster than every one of its limiters allows
+type rateLimitedWriter struct {
+	writer   io.Writer
+	limiters []*RateLimiter
+}
+
+// NewRateLimitedWriter paces writes to w by all of the given limiters, e.g.
+// one for each party whose bandwidth the bytes count against
+func NewRateLimitedWriter(w io.Writer, limiters ...*RateLimiter) io.Writer {
+	return &rateLimitedWriter{writer: w, limiters: limiters}
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if len(w.limiters) > 0 {
+			n = w.limiters[0].Take(n)
+			for _, limiter := range w.limiters[1:] {
+				limiter.Wait(n)
+			}
+		}
+		m, err := w.writer.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// timed returns how long f took
+func timed(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+// checkDuration fails unless got is within the bounds, which are loose so
+// a busy machine does not fail the test
+func checkDuration(t *testing.T, what string, got, least, most time.Duration) {
+	t.Helper()
+	if got < least || got > most {
+		t.Errorf("%s took %v, want between %v and %v", what, got, least, most)
+	}
+}
+
+func TestRateLimiterHonoursRate(t *testing.T) {
+	limiter := NewRateLimiter(100 * 1024)
+	elapsed := timed(func() { limiter.Wait(50 * 1024) })
+	checkDuration(t, "50 KB at 100 KB/s", elapsed, 400*time.Millisecond, 900*time.Millisecond)
+
+	var unlimited RateLimiter
+	elapsed = timed(func() { unlimited.Wait(1 << 30) })
+	checkDuration(t, "1 GB without a limit", elapsed, 0, 50*time.Millisecond)
+}
+
+func TestRateLimiterTakesInSlices(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	for i := 0; i < 3; i++ {
+		if n := limiter.Take(5000); n != 1000/rateSlices {
+			t.Fatalf("Take(5000) = %d, want a slice of %d", n, 1000/rateSlices)
+		}
+	}
+	if n := limiter.Take(7); n != 7 {
+		t.Errorf("Take(7) = %d, want 7", n)
+	}
+}
+
+func TestSetRateZeroReleasesWait(t *testing.T) {
+	limiter := NewRateLimiter(10)
+	done := make(chan time.Duration)
+	go func() {
+		done <- timed(func() { limiter.Wait(1000) })
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	limiter.SetRate(0)
+	select {
+	case elapsed := <-done:
+		checkDuration(t, "a wait released by lifting the limit", elapsed, 100*time.Millisecond, 600*time.Millisecond)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait still blocked after the limit was lifted")
+	}
+	if limiter.Rate() != 0 {
+		t.Errorf("rate = %d, want 0", limiter.Rate())
+	}
+}
+
+func TestRateLimitedWriterFollowsRateChanges(t *testing.T) {
+	limiter := NewRateLimiter(50 * 1024)
+	var out bytes.Buffer
+	writer := NewRateLimitedWriter(&out, limiter)
+
+	// At 50 KB/s the write would take two seconds; raised after a fifth of
+	// one, the rest goes at 1 MB/s
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		limiter.SetRate(1024 * 1024)
+	}()
+	data := testData(100 * 1024)
+	var n int
+	var err error
+	elapsed := timed(func() { n, err = writer.Write(data) })
+	if err != nil || n != len(data) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("wrote %d of %d bytes: %v", n, len(data), err)
+	}
+	checkDuration(t, "a write whose rate was raised", elapsed, 200*time.Millisecond, 900*time.Millisecond)
+}
+
+func TestRateLimitedWriterChainsLimiters(t *testing.T) {
+	fast, slow := NewRateLimiter(1024*1024), NewRateLimiter(100*1024)
+	writer := NewRateLimitedWriter(io.Discard, fast, slow)
+	elapsed := timed(func() { writer.Write(make([]byte, 50*1024)) })
+	checkDuration(t, "50 KB through 1 MB/s and 100 KB/s", elapsed, 400*time.Millisecond, 900*time.Millisecond)
+
+	// Either order, the slowest limiter sets the pace
+	fast, slow = NewRateLimiter(1024*1024), NewRateLimiter(100*1024)
+	writer = NewRateLimitedWriter(io.Discard, slow, fast)
+	elapsed = timed(func() { writer.Write(make([]byte, 50*1024)) })
+	checkDuration(t, "50 KB through 100 KB/s and 1 MB/s", elapsed, 400*time.Millisecond, 900*time.Millisecond)
+
+	writer = NewRateLimitedWriter(io.Discard)
+	if n, err := writer.Write(make([]byte, 1<<20)); n != 1<<20 || err != nil {
+		t.Errorf("writer without limiters wrote %d bytes: %v", n, err)
+	}
+}
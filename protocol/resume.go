@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NoProof is sent in place of a prefix proof when nothing was received yet
+const NoProof = "-"
+
+// ResumeOffer is sent by the recipient of a transfer once it knows how much
+// of the file it already holds: "/TRANSFER_OFFSET <token> <offset> <proof>".
+// The sender only skips those bytes if the proof matches its own copy.
+type ResumeOffer struct {
+	Token  string
+	Offset int64
+	Proof  string
+}
+
+// Encode returns the command form of a ResumeOffer
+func (r ResumeOffer) Encode() string {
+	return fmt.Sprintf("/TRANSFER_OFFSET %s %d %s", r.Token, r.Offset, r.Proof)
+}
+
+// ParseResumeOffer parses a "/TRANSFER_OFFSET" command
+func ParseResumeOffer(message string) (ResumeOffer, error) {
+	args := strings.Fields(message)
+	if len(args) != 4 || args[0] != "/TRANSFER_OFFSET" {
+		return ResumeOffer{}, fmt.Errorf("invalid resume offer: %q", message)
+	}
+	offset, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || offset < 0 {
+		return ResumeOffer{}, fmt.Errorf("invalid resume offset: %q", args[2])
+	}
+	return ResumeOffer{Token: args[1], Offset: offset, Proof: args[3]}, nil
+}
+
+// PrefixProof hashes the first n bytes of r. With a transfer key it is an
+// HMAC, so the relay cannot use it to confirm guesses about the contents.
+func PrefixProof(r io.Reader, n int64, key []byte) (string, error) {
+	if n == 0 {
+		return NoProof, nil
+	}
+
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	if _, err := io.CopyN(h, r, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteStreamOffset starts a transfer stream with the offset the sender
+// continues from, so the recipient knows whether its partial file was kept
+func WriteStreamOffset(w io.Writer, offset int64) error {
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], uint64(offset))
+	_, err := w.Write(header[:])
+	return err
+}
+
+// ReadStreamOffset reads the offset written by WriteStreamOffset
+func ReadStreamOffset(r io.Reader) (int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	offset := int64(binary.BigEndian.Uint64(header[:]))
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid stream offset %d", offset)
+	}
+	return offset, nil
+}
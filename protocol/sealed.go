@@ -0,0 +1,307 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// NoPublicKey is sent in place of a public key when a transfer is not
+// end-to-end encrypted
+const NoPublicKey = "-"
+
+// sealedChunkSize is the largest plaintext carried by one sealed frame
+const sealedChunkSize = 32 * 1024
+
+// ErrTampered is returned when a sealed frame fails authentication
+var ErrTampered = errors.New("transfer data failed authentication, it was corrupted or tampered with")
+
+// GenerateTransferKey creates an ephemeral X25519 key for a single transfer
+func GenerateTransferKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodePublicKey returns the form of a public key sent on the control channel
+func EncodePublicKey(key *ecdh.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+// DeriveTransferKey combines our private key with the peer's encoded public
+// key into the symmetric key for the transfer identified by token
+func DeriveTransferKey(private *ecdh.PrivateKey, peerPublic, token string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	public, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind the key to the transfer so it can never be reused for another one
+	h := sha256.New()
+	h.Write([]byte("drizlink transfer key"))
+	h.Write(shared)
+	h.Write([]byte(token))
+	return h.Sum(nil), nil
+}
+
+// ReplyKey derives the key the recipient seals what it sends back to the
+// sender with, so the two directions of a transfer never share nonces
+func ReplyKey(key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("drizlink reply key"))
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// KeyFingerprint is a short code both peers can compare to rule out a
+// server that swapped the public keys
+func KeyFingerprint(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("drizlink key fingerprint"))
+	h.Write(key)
+	sum := h.Sum(nil)
+	return fmt.Sprintf("%X-%X-%X", sum[0:2], sum[2:4], sum[4:6])
+}
+
+// newTransferCipher returns AES-256-GCM keyed for one transfer
+func newTransferCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Kinds of sealed frames. Only data frames carry bytes; the others are
+// empty, which no data frame ever is.
+const (
+	sealedData  byte = 0
+	sealedFinal byte = 1
+	sealedMark  byte = 2
+)
+
+// sealedNonce encodes the frame counter; the last byte holds the kind of
+// frame, so a stream cut short by the relay cannot pass as complete
+func sealedNonce(counter uint64, kind byte) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[2:10], counter)
+	nonce[11] = kind
+	return nonce
+}
+
+// SealedWriter encrypts everything written to it into authenticated data
+// frames. Close must be called to write the final frame.
+type SealedWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	counter uint64
+}
+
+// NewSealedWriter wraps w so that every write is encrypted with key
+func NewSealedWriter(w io.Writer, key []byte) (*SealedWriter, error) {
+	aead, err := newTransferCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedWriter{w: w, aead: aead}, nil
+}
+
+// Write implements io.Writer
+func (s *SealedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > sealedChunkSize {
+			n = sealedChunkSize
+		}
+		if err := s.seal(p[:n], sealedData); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close writes the final frame that marks the end of the stream
+func (s *SealedWriter) Close() error {
+	return s.seal(nil, sealedFinal)
+}
+
+// EndData writes a frame that marks the end of a transfer's data, ahead of
+// the chunks the recipient may ask for again. A recipient that lost track of
+// the data after a damaged frame skips to it.
+func (s *SealedWriter) EndData() error {
+	return s.seal(nil, sealedMark)
+}
+
+func (s *SealedWriter) seal(chunk []byte, kind byte) error {
+	sealed := s.aead.Seal(nil, sealedNonce(s.counter, kind), chunk, nil)
+	s.counter++
+	return WriteFrame(s.w, FrameData, sealed)
+}
+
+// SealedReader decrypts and authenticates the frames of a SealedWriter
+type SealedReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	done    bool
+	marked  bool // the end of the data was reached and not yet read by EndData
+	fill    bool // damaged data frames read as zeros
+}
+
+// NewSealedReader wraps r so that reads return the decrypted stream
+func NewSealedReader(r io.Reader, key []byte) (*SealedReader, error) {
+	aead, err := newTransferCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedReader{r: r, aead: aead}, nil
+}
+
+// Read implements io.Reader. It returns io.EOF only after the authenticated
+// final frame; a stream that simply stops, or whose data ends before it was
+// expected to, yields io.ErrUnexpectedEOF.
+func (s *SealedReader) Read(p []byte) (int, error) {
+	if err := s.fillBuffer(); err != nil {
+		return 0, err
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// ReadByte implements io.ByteReader, so a decompressor reading the stream
+// takes no more of it than the compressed data
+func (s *SealedReader) ReadByte() (byte, error) {
+	if err := s.fillBuffer(); err != nil {
+		return 0, err
+	}
+	b := s.buf[0]
+	s.buf = s.buf[1:]
+	return b, nil
+}
+
+func (s *SealedReader) fillBuffer() error {
+	for len(s.buf) == 0 {
+		if s.done {
+			return io.EOF
+		}
+		if s.marked {
+			return io.ErrUnexpectedEOF
+		}
+		if err := s.open(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FillDamaged makes data frames that fail authentication read as zeros of
+// their length instead of failing with ErrTampered, for data sent as it is
+// whose chunks are verified and sent again. The frames that end the data or
+// the stream are never filled, and a stream whose framing breaks still fails.
+func (s *SealedReader) FillDamaged(fill bool) {
+	s.fill = fill
+}
+
+// Skip drops the rest of a transfer's data, damaged or not, up to the frame
+// that ends it, for a recipient that can no longer follow the data after a
+// damaged frame. EndData or Verify reads that frame afterwards.
+func (s *SealedReader) Skip() error {
+	s.buf = nil
+	for !s.done && !s.marked {
+		if err := s.open(true); err != nil {
+			return err
+		}
+		s.buf = nil
+	}
+	return nil
+}
+
+// EndData reads the frame written by SealedWriter.EndData, which has to
+// follow the data that was read
+func (s *SealedReader) EndData() error {
+	if len(s.buf) == 0 && !s.done && !s.marked {
+		if err := s.open(false); err != nil {
+			return err
+		}
+	}
+	if len(s.buf) != 0 {
+		return errors.New("sender sent more data than announced")
+	}
+	if !s.marked {
+		return io.ErrUnexpectedEOF
+	}
+	s.marked = false
+	return nil
+}
+
+// Verify consumes the rest of the stream and checks that it ends with the
+// final frame and carries no data beyond what was already read
+func (s *SealedReader) Verify() error {
+	extra, err := io.Copy(io.Discard, s)
+	if err != nil {
+		return err
+	}
+	if extra != 0 {
+		return fmt.Errorf("sender sent %d bytes more than announced", extra)
+	}
+	return nil
+}
+
+// open reads the next frame. With skip, a data frame that fails
+// authentication is dropped rather than failing the stream.
+func (s *SealedReader) open(skip bool) error {
+	frame, err := ReadFrame(s.r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if frame.Type != FrameData {
+		return fmt.Errorf("unexpected %s frame in sealed stream", frame.Type)
+	}
+	counter := s.counter
+	s.counter++
+
+	// Only the frames that end the data or the stream are just a tag
+	if len(frame.Payload) == s.aead.Overhead() {
+		for _, kind := range []byte{sealedFinal, sealedMark} {
+			if _, err := s.aead.Open(nil, sealedNonce(counter, kind), frame.Payload, nil); err == nil {
+				s.done = kind == sealedFinal
+				s.marked = kind == sealedMark
+				return nil
+			}
+		}
+		return ErrTampered
+	}
+
+	plain, err := s.aead.Open(nil, sealedNonce(counter, sealedData), frame.Payload, nil)
+	switch {
+	case err == nil:
+		s.buf = plain
+	case skip:
+	case s.fill && len(frame.Payload) > s.aead.Overhead():
+		s.buf = make([]byte, len(frame.Payload)-s.aead.Overhead())
+	default:
+		return ErrTampered
+	}
+	return nil
+}
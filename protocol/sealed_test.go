@@ -0,0 +1,284 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, 32)
+}
+
+// seal encrypts data the way a sender does, in writes of at most step bytes
+func seal(t *testing.T, key, data []byte, step int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	writer, err := NewSealedWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := min(step, len(data))
+		if _, err := writer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// frames splits a sealed stream into its encoded frames
+func frames(t *testing.T, stream []byte) [][]byte {
+	t.Helper()
+	var out [][]byte
+	r := bytes.NewReader(stream)
+	for r.Len() > 0 {
+		start := len(stream) - r.Len()
+		if _, err := ReadFrame(r); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, stream[start:len(stream)-r.Len()])
+	}
+	return out
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestSealedRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+		step int
+	}{
+		{"empty", 0, 1},
+		{"small", 100, 100},
+		{"one chunk", sealedChunkSize, sealedChunkSize},
+		{"split writes", 3*sealedChunkSize + 17, 1000},
+		{"large write", 5*sealedChunkSize + 1, 5*sealedChunkSize + 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := testData(tc.size)
+			stream := seal(t, testKey(1), data, tc.step)
+			if tc.size > 0 && bytes.Contains(stream, data[:min(64, tc.size)]) {
+				t.Error("sealed stream contains the plaintext")
+			}
+
+			reader, err := NewSealedReader(bytes.NewReader(stream), testKey(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes back, want %d equal ones", len(got), len(data))
+			}
+			if err := reader.Verify(); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSealedReadByte(t *testing.T) {
+	data := testData(2*sealedChunkSize + 3)
+	reader, err := NewSealedReader(bytes.NewReader(seal(t, testKey(1), data, len(data))), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range data {
+		b, err := reader.ReadByte()
+		if err != nil || b != want {
+			t.Fatalf("byte %d = %d, %v; want %d", i, b, err, want)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("ReadByte after the end = %v, want io.EOF", err)
+	}
+}
+
+func TestSealedTampered(t *testing.T) {
+	data := testData(3 * sealedChunkSize)
+	stream := seal(t, testKey(1), data, len(data))
+	parts := frames(t, stream)
+
+	flipped := append([]byte(nil), stream...)
+	flipped[HeaderSize+10] ^= 1
+
+	flippedFinal := append([]byte(nil), stream...)
+	flippedFinal[len(flippedFinal)-1] ^= 1
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		key    []byte
+	}{
+		{"flipped byte", flipped, testKey(1)},
+		{"flipped final tag", flippedFinal, testKey(1)},
+		{"wrong key", stream, testKey(2)},
+		{"reordered frames", bytes.Join([][]byte{parts[1], parts[0], parts[2], parts[3]}, nil), testKey(1)},
+		{"dropped frame", bytes.Join([][]byte{parts[0], parts[2], parts[3]}, nil), testKey(1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reader, err := NewSealedReader(bytes.NewReader(tc.stream), tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(reader); !errors.Is(err, ErrTampered) {
+				t.Errorf("read = %v, want ErrTampered", err)
+			}
+		})
+	}
+}
+
+func TestSealedTruncated(t *testing.T) {
+	data := testData(2 * sealedChunkSize)
+	stream := seal(t, testKey(1), data, len(data))
+	parts := frames(t, stream)
+	withoutFinal := bytes.Join(parts[:len(parts)-1], nil)
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"no final frame", withoutFinal},
+		{"cut inside a frame", withoutFinal[:len(withoutFinal)-5]},
+		{"cut inside a header", stream[:len(parts[0])+2]},
+		{"nothing at all", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reader, err := NewSealedReader(bytes.NewReader(tc.stream), testKey(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(reader); err != io.ErrUnexpectedEOF {
+				t.Errorf("read = %v, want io.ErrUnexpectedEOF", err)
+			}
+			if err := reader.Verify(); err != io.ErrUnexpectedEOF {
+				t.Errorf("Verify = %v, want io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestSealedVerifyRejectsExtraData(t *testing.T) {
+	announced := testData(1000)
+	stream := seal(t, testKey(1), append(announced, "and then some"...), 4096)
+
+	reader, err := NewSealedReader(bytes.NewReader(stream), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(announced))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Verify(); err == nil {
+		t.Error("Verify accepted data beyond what was announced")
+	}
+}
+
+func TestSealedStopsAtFinalFrame(t *testing.T) {
+	// Whatever follows the final frame on the connection is not part of the stream
+	stream := seal(t, testKey(1), []byte("payload"), 7)
+	trailing := seal(t, testKey(1), []byte("more"), 4)
+
+	reader, err := NewSealedReader(bytes.NewReader(append(stream, trailing...)), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil || string(got) != "payload" {
+		t.Errorf("read = %q, %v; want payload", got, err)
+	}
+}
+
+func TestSealedRejectsOtherFrames(t *testing.T) {
+	var stream bytes.Buffer
+	SendCommand(&stream, "/FILE_REQUEST")
+	reader, err := NewSealedReader(&stream, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); err == nil || errors.Is(err, ErrTampered) {
+		t.Errorf("read = %v, want an unexpected frame error", err)
+	}
+}
+
+func TestStreamKey(t *testing.T) {
+	key := testKey(1)
+	if !bytes.Equal(StreamKey(key, 0), key) {
+		t.Error("stream 0 does not use the transfer key")
+	}
+
+	seen := map[string]int{string(ReplyKey(key)): -1}
+	for stream := 0; stream < 16; stream++ {
+		derived := StreamKey(key, stream)
+		if len(derived) != 32 {
+			t.Fatalf("stream %d key has %d bytes", stream, len(derived))
+		}
+		if other, exists := seen[string(derived)]; exists {
+			t.Errorf("stream %d shares its key with %d", stream, other)
+		}
+		seen[string(derived)] = stream
+	}
+	if bytes.Equal(StreamKey(key, 1), StreamKey(testKey(2), 1)) {
+		t.Error("stream keys do not depend on the transfer key")
+	}
+
+	// A frame sealed for one stream must not open on another
+	reader, err := NewSealedReader(bytes.NewReader(seal(t, StreamKey(key, 1), []byte("range"), 5)), StreamKey(key, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); !errors.Is(err, ErrTampered) {
+		t.Errorf("read with another stream's key = %v, want ErrTampered", err)
+	}
+}
+
+func TestDeriveTransferKey(t *testing.T) {
+	alice, err := GenerateTransferKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GenerateTransferKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := DeriveTransferKey(alice, EncodePublicKey(bob.PublicKey()), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DeriveTransferKey(bob, EncodePublicKey(alice.PublicKey()), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) || KeyFingerprint(a) != KeyFingerprint(b) {
+		t.Error("both sides derived different keys")
+	}
+
+	other, err := DeriveTransferKey(alice, EncodePublicKey(bob.PublicKey()), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, other) {
+		t.Error("the key does not depend on the transfer token")
+	}
+
+	if _, err := DeriveTransferKey(alice, "not base64!", "token"); err == nil {
+		t.Error("accepted an invalid public key")
+	}
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// A large file can be sent over several data connections at once, each
+// carrying one range of it, so a single TCP connection's window does not cap
+// the throughput of a high-latency link. The first stream carries everything
+// a single-stream transfer does; the others carry only their range.
+
+const (
+	// DefaultStreams is how many streams a large file is sent over
+	DefaultStreams = 4
+	// MaxStreams bounds the streams of one transfer
+	MaxStreams = 16
+	// MinParallelSize is the smallest file worth sending over several streams
+	MinParallelSize = 64 << 20
+)
+
+// Range is the part of a file one stream carries
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+// SplitRanges divides the bytes from offset to size between streams. Every
+// range starts at a chunk boundary, so each stream's chunks can be verified
+// on their own; trailing ranges are empty if there is too little left.
+func SplitRanges(offset, size int64, streams int) []Range {
+	per := (size - offset + int64(streams) - 1) / int64(streams)
+	per = (per + ChunkSize - 1) / ChunkSize * ChunkSize
+	ranges := make([]Range, streams)
+	start := offset
+	for i := range ranges {
+		end := min(start+per, size)
+		ranges[i] = Range{Start: start, Length: end - start}
+		start = end
+	}
+	return ranges
+}
+
+// OfferStreams returns the number of streams an offer's attributes ask for
+func OfferStreams(attributes map[string]string) int {
+	streams, err := strconv.Atoi(attributes[AttrStreams])
+	if err != nil || streams < 1 {
+		return 1
+	}
+	return min(streams, MaxStreams)
+}
+
+// StreamToken returns the token of the data connection for stream of a
+// transfer; the first stream uses the transfer's own token
+func StreamToken(token string, stream int) string {
+	if stream == 0 {
+		return token
+	}
+	return fmt.Sprintf("%s.%d", token, stream)
+}
+
+// StreamKey returns the key that seals stream of a transfer, so no two
+// streams share nonces; the first stream uses the transfer key itself
+func StreamKey(key []byte, stream int) []byte {
+	if stream == 0 {
+		return key
+	}
+	h := sha256.New()
+	h.Write([]byte("drizlink stream key"))
+	h.Write(key)
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(stream)))
+	return h.Sum(nil)
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import "testing"
+
+func TestSplitRanges(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		offset  int64
+		size    int64
+		streams int
+		want    []Range
+	}{
+		{"even", 0, 4 * ChunkSize, 4, []Range{{0, ChunkSize}, {ChunkSize, ChunkSize}, {2 * ChunkSize, ChunkSize}, {3 * ChunkSize, ChunkSize}}},
+		{"uneven", 0, 5*ChunkSize + 10, 2, []Range{{0, 3 * ChunkSize}, {3 * ChunkSize, 2*ChunkSize + 10}}},
+		{"short last", 0, 2*ChunkSize + 1, 3, []Range{{0, ChunkSize}, {ChunkSize, ChunkSize}, {2 * ChunkSize, 1}}},
+		{"resumed", 2 * ChunkSize, 6 * ChunkSize, 2, []Range{{2 * ChunkSize, 2 * ChunkSize}, {4 * ChunkSize, 2 * ChunkSize}}},
+		{"single byte", 0, 1, 4, []Range{{0, 1}, {1, 0}, {1, 0}, {1, 0}}},
+		{"more streams than bytes", 0, 3, 16, append([]Range{{0, 3}}, emptyRanges(15, 3)...)},
+		{"more streams than chunks", 0, ChunkSize + 5, 4, []Range{{0, ChunkSize}, {ChunkSize, 5}, {ChunkSize + 5, 0}, {ChunkSize + 5, 0}}},
+		{"nothing left", ChunkSize, ChunkSize, 2, []Range{{ChunkSize, 0}, {ChunkSize, 0}}},
+		{"one stream", 0, 3*ChunkSize + 7, 1, []Range{{0, 3*ChunkSize + 7}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := SplitRanges(tc.offset, tc.size, tc.streams)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d ranges, want %d", len(got), len(tc.want))
+			}
+			next := tc.offset
+			for i, r := range got {
+				if r != tc.want[i] {
+					t.Errorf("range %d = %+v, want %+v", i, r, tc.want[i])
+				}
+				if r.Start != next {
+					t.Errorf("range %d starts at %d, want %d", i, r.Start, next)
+				}
+				if r.Length > 0 && (r.Start-tc.offset)%ChunkSize != 0 {
+					t.Errorf("range %d starts inside a chunk", i)
+				}
+				next = r.Start + r.Length
+			}
+			if next != tc.size {
+				t.Errorf("ranges end at %d, want %d", next, tc.size)
+			}
+		})
+	}
+}
+
+// emptyRanges returns count empty ranges at the end of a file of size bytes
+func emptyRanges(count int, size int64) []Range {
+	ranges := make([]Range, count)
+	for i := range ranges {
+		ranges[i] = Range{Start: size}
+	}
+	return ranges
+}
@@ -4,15 +4,25 @@ import (
 	helper "drizlink/helper"
 	"drizlink/server/interfaces"
 	connection "drizlink/server/internal"
+	"drizlink/server/storage"
 	"drizlink/utils"
 	"flag"
 	"fmt"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 func main() {
 	port := flag.String("port", "8080", "Port to run the server on")
+	useTLS := flag.Bool("tls", false, "Encrypt client connections with TLS")
+	certFile := flag.String("cert", "", "TLS certificate file (a self-signed one is generated if omitted)")
+	keyFile := flag.String("key", "", "TLS private key file")
+	storeKind := flag.String("store", "file", "Where to keep users, rooms and settings: file or memory")
+	retention := flag.String("retention", "", "How long to keep messages for offline users, e.g. 72h; 0 disables the queue (remembered across restarts)")
+	relayLimit := flag.String("relay-limit", "", "Bandwidth relayed per user per second, e.g. 10MB; 0 lifts the cap (remembered across restarts)")
+	dataFile := flag.String("data", "", "State file for the file store (default: server-state.json in the config directory)")
 	flag.Parse()
 	
 	// Ensure port starts with a colon for address format
@@ -32,10 +42,64 @@ func main() {
 	fmt.Println(utils.InfoColor("Starting server on port " + *port + "..."))
 	
 	server := interfaces.Server{
-		Address:     formattedPort,
-		Connections: make(map[string]*interfaces.User),
-		IpAddresses: make(map[string]*interfaces.User),
-		Messages:    make(chan interfaces.Message),
+		Address:         formattedPort,
+		Connections:     make(map[string]*interfaces.User),
+		Accounts:        make(map[string]*interfaces.Account),
+		Sessions:        make(map[string]*interfaces.Session),
+		Messages:        make(chan interfaces.Message),
+		Rooms:           make(map[string]*interfaces.Room),
+		Transfers:       make(map[string]*interfaces.Transfer),
+		Relays:          make(map[string]*interfaces.Transfer),
+		Direct:          make(map[string]*interfaces.Transfer),
+		Settings:        make(map[string]string),
+		OfflineMessages: make(map[string][]interfaces.Message),
+	}
+
+	if *storeKind == "file" && *dataFile == "" {
+		configDir, err := helper.ConfigDir()
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error locating config directory:"), err)
+			return
+		}
+		*dataFile = filepath.Join(configDir, "server-state.json")
+	}
+
+	store, err := storage.Open(*storeKind, *dataFile)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening server state:"), err)
+		return
+	}
+	defer store.Close()
+	server.Store = store
+
+	if err := connection.LoadState(&server); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error loading server state:"), err)
+		return
+	}
+	if *retention != "" {
+		duration, err := time.ParseDuration(*retention)
+		if err != nil || duration < 0 {
+			fmt.Println(utils.ErrorColor("❌ Invalid retention:"), *retention)
+			return
+		}
+		connection.SaveSetting(&server, "message_retention", duration.String())
+	}
+	if *relayLimit != "" {
+		limit, err := helper.ParseSize(strings.TrimSuffix(strings.ToUpper(*relayLimit), "/S"))
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Invalid relay limit:"), *relayLimit)
+			return
+		}
+		connection.SaveSetting(&server, "relay_limit", strconv.FormatInt(limit, 10))
+	}
+
+	if *useTLS || *certFile != "" || *keyFile != "" {
+		tlsConfig, err := connection.LoadTLSConfig(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error setting up TLS:"), err)
+			return
+		}
+		server.TLSConfig = tlsConfig
 	}
 
 	go connection.StartHeartBeat(100*time.Second, &server)
@@ -1,17 +1,31 @@
 package interfaces
 
 import (
+	"crypto/tls"
 	"net"
 	"sync"
+	"time"
 )
 
 type Server struct {
 	Address     string
 	Connections map[string]*User
-	IpAddresses map[string]*User
+	Accounts    map[string]*Account
+	Sessions    map[string]*Session
 	Messages    chan Message
 	Rooms       map[string]*Room
-	Mutex       sync.Mutex
+	// OfflineMessages holds chat meant for offline users, oldest first
+	OfflineMessages map[string][]Message
+	Transfers       map[string]*Transfer
+	// Relays holds paired transfers whose bytes the server is relaying
+	Relays map[string]*Transfer
+	// Direct holds transfers that went peer to peer until either side
+	// leaves, so the server still knows who may pause or resume them
+	Direct    map[string]*Transfer
+	Settings  map[string]string
+	Store     Store
+	TLSConfig *tls.Config
+	Mutex     sync.Mutex
 }
 
 type Message struct {
@@ -20,23 +34,101 @@ type Message struct {
 	Content        string
 	Timestamp      string
 	RoomID         string
+	Direct         bool
 }
 
 type User struct {
+	UserId          string
+	Username        string
+	StoreFilePath   string
+	Conn            net.Conn
+	IsOnline        bool
+	IpAddress       string
+	CurrentRoomID   string
+	ProtocolVersion int
+	Features        []string
+}
+
+// Account holds the credentials a user logs in with, keyed by username. The
+// password is only ever stored as a salted PBKDF2 hash.
+type Account struct {
+	Username     string
+	PasswordHash string
+	UserId       string
+	CreatedAt    time.Time
+}
+
+// Session lets a client reconnect without its password. It is keyed by the
+// SHA-256 of the opaque token the client keeps.
+type Session struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+type Room struct {
+	ID        string
+	Name      string
+	Members   map[string]*User
+	CreatedBy string
+	CreatedAt string
+	Mutex     sync.RWMutex
+}
+
+// Transfer is a file or folder transfer brokered by the server. Its bytes do
+// not travel over the control connections: sender and recipient each open a
+// data connection identified by the one-time Token and the server pairs them.
+type Transfer struct {
+	Token         string
+	Kind          string // "file" or "folder"
+	Name          string
+	Size          int64
+	Checksum      string
+	Sender        *User
+	Recipient     *User
+	SenderData    net.Conn
+	RecipientData net.Conn
+	CreatedAt     time.Time
+	Streams       []string // tokens of the further data connections of a file sent in parallel
+}
+
+// Store persists the server state that must survive a restart: accounts,
+// sessions, users, rooms with their members, and settings. Live connections
+// and transfers are never stored.
+type Store interface {
+	Load() (*State, error)
+	SaveAccount(account Account) error
+	SaveSession(key string, session Session) error
+	DeleteSession(key string) error
+	SaveUser(user UserRecord) error
+	SaveRoom(room RoomRecord) error
+	SaveSetting(key, value string) error
+	SaveQueues(queues map[string][]Message) error
+	Close() error
+}
+
+// State is everything a Store holds
+type State struct {
+	Accounts map[string]Account
+	Sessions map[string]Session
+	Users    map[string]UserRecord
+	Rooms    map[string]RoomRecord
+	Settings map[string]string
+	Queues   map[string][]Message
+}
+
+// UserRecord is the durable part of a User
+type UserRecord struct {
 	UserId        string
 	Username      string
 	StoreFilePath string
-	Conn          net.Conn
-	IsOnline      bool
-	IpAddress     string
 	CurrentRoomID string
 }
 
-type Room struct {
-	ID          string
-	Name        string
-	Members     map[string]*User
-	CreatedBy   string
-	CreatedAt   string
-	Mutex       sync.RWMutex
-}
\ No newline at end of file
+// RoomRecord is the durable part of a Room, with members listed by user ID
+type RoomRecord struct {
+	ID        string
+	Name      string
+	CreatedBy string
+	CreatedAt string
+	Members   []string
+}
@@ -0,0 +1,228 @@
+package connection
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxLoginAttempts is how many wrong passwords a connection may try before it is dropped
+	maxLoginAttempts = 3
+	// loginTimeout bounds how long a client may take to log in
+	loginTimeout = 2 * time.Minute
+	// failedLoginDelay slows down password guessing
+	failedLoginDelay = time.Second
+
+	minPasswordLength = 6
+	maxUsernameLength = 32
+
+	// passwordIterations is the PBKDF2-HMAC-SHA256 work factor for new passwords
+	passwordIterations = 600000
+	passwordSaltSize   = 16
+)
+
+var errWrongPassword = errors.New("wrong username or password")
+
+// Login outcomes reported to the client in /AUTH_OK
+const (
+	loginRegistered = "registered"
+	loginReturning  = "returning"
+	loginResumed    = "resumed"
+)
+
+// login runs the /AUTH or /RECONNECT exchange and returns the account the
+// client proved it owns. Unknown usernames are registered on the spot.
+func login(conn net.Conn, server *interfaces.Server) (*interfaces.Account, string, error) {
+	conn.SetReadDeadline(time.Now().Add(loginTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for attempt := 1; attempt <= maxLoginAttempts; attempt++ {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return nil, "", err
+		}
+		message := string(frame.Payload)
+
+		if strings.HasPrefix(message, "/RECONNECT ") {
+			account, err := resumeSession(server, strings.TrimSpace(strings.TrimPrefix(message, "/RECONNECT ")))
+			if err != nil {
+				protocol.SendCommand(conn, "/AUTH_FAILED "+err.Error())
+				continue
+			}
+			return account, loginResumed, nil
+		}
+
+		// The password goes last so it may contain spaces
+		args := strings.SplitN(message, " ", 3)
+		if len(args) != 3 || args[0] != "/AUTH" {
+			protocol.SendCommand(conn, "/AUTH_FAILED Use: /AUTH <username> <password> or /RECONNECT <token>")
+			continue
+		}
+
+		account, registered, err := authenticate(server, args[1], args[2])
+		if err != nil {
+			time.Sleep(failedLoginDelay)
+			protocol.SendCommand(conn, "/AUTH_FAILED "+err.Error())
+			continue
+		}
+		if registered {
+			return account, loginRegistered, nil
+		}
+		return account, loginReturning, nil
+	}
+	return nil, "", errors.New("too many failed login attempts")
+}
+
+// authenticate checks the password of an existing account or creates the
+// account if the username is free
+func authenticate(server *interfaces.Server, username, password string) (*interfaces.Account, bool, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, false, err
+	}
+
+	server.Mutex.Lock()
+	account, exists := server.Accounts[username]
+	server.Mutex.Unlock()
+
+	if exists {
+		if !verifyPassword(account.PasswordHash, password) {
+			return nil, false, errWrongPassword
+		}
+		return account, false, nil
+	}
+
+	if len(password) < minPasswordLength {
+		return nil, false, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	// Hashing is slow on purpose, so do it before taking the lock
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, false, err
+	}
+
+	server.Mutex.Lock()
+	if _, taken := server.Accounts[username]; taken {
+		server.Mutex.Unlock()
+		return nil, false, errors.New("username was just taken, try again")
+	}
+
+	account = &interfaces.Account{
+		Username:     username,
+		PasswordHash: hash,
+		UserId:       newUserId(server),
+		CreatedAt:    time.Now(),
+	}
+	server.Accounts[username] = account
+	server.Mutex.Unlock()
+	saveAccount(server, username)
+	return account, true, nil
+}
+
+// newUserId draws user IDs until one is unused. IDs are kept across restarts,
+// so a repeat would merge two users for good. Call with server.Mutex held.
+func newUserId(server *interfaces.Server) string {
+	for {
+		id := helper.GenerateUserId()
+		if _, taken := server.Connections[id]; taken {
+			continue
+		}
+		if !accountHasUserId(server, id) {
+			return id
+		}
+	}
+}
+
+// accountHasUserId reports whether an account, online or not, uses the ID
+func accountHasUserId(server *interfaces.Server, id string) bool {
+	for _, account := range server.Accounts {
+		if account.UserId == id {
+			return true
+		}
+	}
+	return false
+}
+
+func validateUsername(username string) error {
+	if username == "" || len(username) > maxUsernameLength {
+		return fmt.Errorf("username must be 1 to %d characters", maxUsernameLength)
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return errors.New("username may not contain spaces")
+		}
+	}
+	return nil
+}
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<hash>"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword compares a password against a stored hash in constant time
+func verifyPassword(stored, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, iterations)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// pbkdf2SHA256 derives a single SHA-256 sized block as specified in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	var blockIndex [4]byte
+	binary.BigEndian.PutUint32(blockIndex[:], 1)
+	prf.Write(salt)
+	prf.Write(blockIndex[:])
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
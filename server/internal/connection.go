@@ -1,7 +1,8 @@
 package connection
 
 import (
-	"drizlink/helper"
+	"crypto/tls"
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"drizlink/utils"
 	"fmt"
@@ -32,15 +33,21 @@ func Start(server *interfaces.Server) {
 		panic(err)
 	}
 
-	defer listen.Close()
+	// Control and data connections share the listener, so TLS covers both
+	if server.TLSConfig != nil {
+		listen = tls.NewListener(listen, server.TLSConfig)
+	}
 
-	// Initialize rooms map
-	server.Rooms = make(map[string]*interfaces.Room)
+	defer listen.Close()
 
 	fmt.Println(utils.SuccessColor("✅ Server started on"), utils.InfoColor(server.Address))
+	if server.TLSConfig != nil {
+		fmt.Println(utils.SuccessColor("🔐 TLS enabled, certificate fingerprint:"))
+		fmt.Println("   " + utils.CommandColor(TLSFingerprint(server.TLSConfig)))
+	}
 
 	// Start UDP broadcast for server discovery
-	go StartDiscoveryBroadcast(server.Address)
+	go StartDiscoveryBroadcast(server.Address, server.TLSConfig != nil)
 
 	for {
 		conn, err := listen.Accept()
@@ -56,70 +63,119 @@ func Start(server *interfaces.Server) {
 func HandleConnection(conn net.Conn, server *interfaces.Server) {
 	ipAddr := conn.RemoteAddr().String()
 	ip := strings.Split(ipAddr, ":")[0]
+	// The first frame tells control connections (HELLO) from data connections (DATA)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	frame, err := protocol.ReadFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if frame.Type == protocol.FrameCommand && protocol.IsDataHello(string(frame.Payload)) {
+		HandleDataConnection(conn, server, string(frame.Payload))
+		return
+	}
+
 	fmt.Println("New connection from", ip)
-	if existingUser := server.IpAddresses[ip]; existingUser != nil {
-		fmt.Println("Connection already exists for IP:", ip)
-		// Send reconnection signal with existing user data
-		reconnectMsg := fmt.Sprintf("/RECONNECT %s %s", existingUser.Username, existingUser.StoreFilePath)
-		_, err := conn.Write([]byte(reconnectMsg))
-		if err != nil {
-			fmt.Println("Error sending reconnect signal:", err)
-			return
-		}
 
-		// Update connection and online status
-		server.Mutex.Lock()
-		existingUser.Conn = conn
-		existingUser.IsOnline = true
-		server.Mutex.Unlock()
+	version, features, err := handshake(conn, frame)
+	if err != nil {
+		fmt.Printf("Handshake with %s failed: %v\n", ip, err)
+		conn.Close()
+		return
+	}
 
-		// Encrypt and broadcast welcome back message
-		welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", existingUser.Username)
-		BroadcastMessage(welcomeMsg, server, existingUser)
+	// Ask the client to log in; the account, not the IP address, identifies the user
+	if err := protocol.SendCommand(conn, "/LOGIN"); err != nil {
+		fmt.Println("Error requesting login:", err)
+		return
+	}
 
-		// Start handling messages for the reconnected user
-		handleUserMessages(conn, existingUser, server)
+	account, status, err := login(conn, server)
+	if err != nil {
+		fmt.Printf("Login from %s failed: %v\n", ip, err)
+		conn.Close()
 		return
 	}
 
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
+	server.Mutex.Lock()
+	existingUser := server.Connections[account.UserId]
+	server.Mutex.Unlock()
+
+	lastStorePath := "-"
+	if existingUser != nil && existingUser.StoreFilePath != "" {
+		lastStorePath = existingUser.StoreFilePath
+	}
+
+	// A fresh session token lets the client come back later without its password
+	token, err := issueSession(server, account)
 	if err != nil {
-		fmt.Println("error in read username")
+		fmt.Println("Error creating session:", err)
+		return
+	}
+	if err := protocol.SendCommand(conn, fmt.Sprintf("/AUTH_OK %s %s %s %s", account.UserId, status, token, lastStorePath)); err != nil {
+		fmt.Println("Error confirming login:", err)
 		return
 	}
-	username := string(buffer[:n])
 
-	n, err = conn.Read(buffer)
+	frame, err = protocol.ReadFrame(conn)
 	if err != nil {
 		fmt.Println("error in read storeFilePath")
 		return
 	}
-	storeFilePath := string(buffer[:n])
+	storeFilePath := strings.TrimSpace(strings.TrimPrefix(string(frame.Payload), "/STORE_PATH"))
 
-	userId := helper.GenerateUserId()
+	if existingUser != nil {
+		server.Mutex.Lock()
+		previousConn := existingUser.Conn
+		wasOnline := existingUser.IsOnline
+		existingUser.Conn = conn
+		existingUser.IsOnline = true
+		existingUser.IpAddress = ip
+		existingUser.StoreFilePath = storeFilePath
+		existingUser.ProtocolVersion = version
+		existingUser.Features = features
+		server.Mutex.Unlock()
+		saveUser(server, existingUser.UserId)
+
+		// Logging in again takes over a session that is still open elsewhere
+		if wasOnline && previousConn != nil {
+			protocol.SendChat(previousConn, "You logged in from another connection, closing this one")
+			previousConn.Close()
+		}
+
+		fmt.Printf("User reconnected: %s (ID: %s)\n", existingUser.Username, existingUser.UserId)
+		welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", existingUser.Username)
+		BroadcastMessage(welcomeMsg, server, existingUser)
+
+		restoreRoom(server, existingUser)
+		deliverQueuedMessages(server, existingUser)
+
+		handleUserMessages(conn, existingUser, server)
+		return
+	}
 
 	user := &interfaces.User{
-		UserId:        userId,
-		Username:      username,
-		StoreFilePath: storeFilePath,
-		Conn:          conn,
-		IsOnline:      true,
-		IpAddress:     ip,
+		UserId:          account.UserId,
+		Username:        account.Username,
+		StoreFilePath:   storeFilePath,
+		Conn:            conn,
+		IsOnline:        true,
+		IpAddress:       ip,
+		ProtocolVersion: version,
+		Features:        features,
 	}
 
 	server.Mutex.Lock()
 	server.Connections[user.UserId] = user
-	server.IpAddresses[ip] = user
 	server.Mutex.Unlock()
+	saveUser(server, user.UserId)
 
-	// Send user ID to client
-	conn.Write([]byte("/USERID " + userId + "\n"))
-
-	welcomeMsg := fmt.Sprintf("User %s has joined the chat", username)
+	welcomeMsg := fmt.Sprintf("User %s has joined the chat", user.Username)
 	BroadcastMessage(welcomeMsg, server, user)
 
-	fmt.Printf("New user connected: %s (ID: %s)\n", username, userId)
+	fmt.Printf("New user connected: %s (ID: %s)\n", user.Username, user.UserId)
 
 	// Start handling messages for the new user
 	handleUserMessages(conn, user, server)
@@ -128,10 +184,9 @@ func HandleConnection(conn net.Conn, server *interfaces.Server) {
 // Room management functions
 func CreateRoom(server *interfaces.Server, roomName string, creatorID string, memberIDs []string) (*interfaces.Room, error) {
 	server.Mutex.Lock()
-	defer server.Mutex.Unlock()
 
 	// Generate unique room ID
-	roomID := generateRoomID()
+	roomID := generateRoomID(server)
 
 	// Create room
 	room := &interfaces.Room{
@@ -156,47 +211,59 @@ func CreateRoom(server *interfaces.Server, roomName string, creatorID string, me
 
 	// Store room
 	server.Rooms[roomID] = room
+	server.Mutex.Unlock()
+	saveRoom(server, roomID)
 
 	return room, nil
 }
 
-func generateRoomID() string {
-	return fmt.Sprintf("room_%d", rand.Intn(100000))
+// generateRoomID draws room IDs until one is unused, so a new room never
+// replaces a stored one. Call with server.Mutex held.
+func generateRoomID(server *interfaces.Server) string {
+	for {
+		id := fmt.Sprintf("room_%d", rand.Intn(100000))
+		if _, taken := server.Rooms[id]; !taken {
+			return id
+		}
+	}
 }
 
 func AddUserToRoom(server *interfaces.Server, roomID string, userID string) error {
 	server.Mutex.Lock()
-	defer server.Mutex.Unlock()
-
 	room, exists := server.Rooms[roomID]
 	if !exists {
+		server.Mutex.Unlock()
 		return fmt.Errorf("room not found")
 	}
 
 	user, exists := server.Connections[userID]
 	if !exists {
+		server.Mutex.Unlock()
 		return fmt.Errorf("user not found")
 	}
 
 	room.Mutex.Lock()
 	room.Members[userID] = user
 	room.Mutex.Unlock()
+	server.Mutex.Unlock()
+	saveRoom(server, roomID)
 
 	return nil
 }
 
 func RemoveUserFromRoom(server *interfaces.Server, roomID string, userID string) error {
 	server.Mutex.Lock()
-	defer server.Mutex.Unlock()
-
 	room, exists := server.Rooms[roomID]
 	if !exists {
+		server.Mutex.Unlock()
 		return fmt.Errorf("room not found")
 	}
 
 	room.Mutex.Lock()
 	delete(room.Members, userID)
 	room.Mutex.Unlock()
+	server.Mutex.Unlock()
+	saveRoom(server, roomID)
 
 	return nil
 }
@@ -211,13 +278,22 @@ func BroadcastRoomMessage(roomID string, senderUsername string, content string,
 	}
 
 	room.Mutex.RLock()
-	defer room.Mutex.RUnlock()
-
+	members := make([]*interfaces.User, 0, len(room.Members))
 	for _, member := range room.Members {
+		members = append(members, member)
 		if member.IsOnline && member != sender {
-			_, _ = member.Conn.Write([]byte(fmt.Sprintf("[Room %s] %s: %s\n", room.Name, senderUsername, content)))
+			_ = protocol.SendChat(member.Conn, fmt.Sprintf("[Room %s] %s: %s", room.Name, senderUsername, content))
 		}
 	}
+	room.Mutex.RUnlock()
+
+	// Members who are away get it when they come back
+	message := newMessage(sender, content)
+	message.RoomID = roomID
+	server.Mutex.Lock()
+	queued := queueForOffline(server, message, members)
+	server.Mutex.Unlock()
+	saveQueues(server, queued)
 }
 
 func GetOnlineUsersList(server *interfaces.Server) []interfaces.User {
@@ -234,94 +310,174 @@ func GetOnlineUsersList(server *interfaces.Server) []interfaces.User {
 }
 func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces.Server) {
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		frame, err := protocol.ReadFrame(conn)
 		if err != nil {
-			fmt.Printf("User disconnected: %s\n", user.Username)
 			server.Mutex.Lock()
-			user.IsOnline = false
+			replaced := user.Conn != conn
+			if !replaced {
+				user.IsOnline = false
+			}
 			server.Mutex.Unlock()
+			// The user logged in again on a new connection, which now owns the session
+			if replaced {
+				return
+			}
+			fmt.Printf("User disconnected: %s\n", user.Username)
+			DropTransfers(server, user)
 			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
 			BroadcastMessage(offlineMsg, server, user)
 			return
 		}
 
-		messageContent := string(buffer[:n])
+		switch frame.Type {
+		case protocol.FrameData:
+			fmt.Printf("Ignoring data frame from %s: transfer bytes belong on a data connection\n", user.Username)
+			continue
+		case protocol.FrameChat:
+			messageContent := string(frame.Payload)
+			// Check if user is in a room and wants to send a room message
+			if user.CurrentRoomID != "" {
+				BroadcastRoomMessage(user.CurrentRoomID, user.Username, messageContent, server, user)
+			} else {
+				BroadcastMessage(messageContent, server, user)
+				// Users who are away get it when they come back
+				server.Mutex.Lock()
+				recipients := make([]*interfaces.User, 0, len(server.Connections))
+				for _, recipient := range server.Connections {
+					recipients = append(recipients, recipient)
+				}
+				queued := queueForOffline(server, newMessage(user, messageContent), recipients)
+				server.Mutex.Unlock()
+				saveQueues(server, queued)
+			}
+			continue
+		}
+
+		messageContent := strings.TrimSpace(string(frame.Payload))
 
 		switch {
 		case messageContent == "/exit":
 			server.Mutex.Lock()
 			user.IsOnline = false
 			server.Mutex.Unlock()
+			DropTransfers(server, user)
 			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
 			BroadcastMessage(offlineMsg, server, user)
 			return
+		case strings.HasPrefix(messageContent, "/LOGOUT"):
+			// Forget the session token of this device, the connection is closed by the client
+			args := strings.Fields(messageContent)
+			if len(args) == 2 {
+				revokeSession(server, user, args[1])
+			}
+			continue
 		case strings.HasPrefix(messageContent, "/FILE_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
-			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+			args := strings.SplitN(messageContent, " ", 9)
+			if len(args) != 9 {
+				fmt.Println("Invalid arguments. Use: /FILE_REQUEST <userId> <transferId> <fileSize> <checksum> <candidates> <publicKey> <attributes> <filename>")
 				continue
 			}
 			recipientId := args[1]
-			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-
-			// Include checksum in filename if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				fileName = fileName + "|" + checksum
-			}
-
+			transferID := args[2]
+			fileSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println("Invalid fileSize. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+				fmt.Println("Invalid fileSize. Use: /FILE_REQUEST <userId> <transferId> <fileSize> <checksum> <candidates> <publicKey> <attributes> <filename>")
 				continue
 			}
+			checksum := args[4]
+			candidates := args[5]
+			publicKey := args[6]
+			attributes := args[7]
+			fileName := args[8]
 
-			HandleFileTransfer(server, conn, recipientId, fileName, fileSize)
+			HandleFileTransfer(server, user, recipientId, transferID, fileName, checksum, candidates, publicKey, attributes, fileSize)
 			continue
 		case strings.HasPrefix(messageContent, "/FOLDER_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
-			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+			args := strings.SplitN(messageContent, " ", 9)
+			if len(args) != 9 {
+				fmt.Println("Invalid arguments. Use: /FOLDER_REQUEST <userId> <transferId> <folderSize> <checksum> <candidates> <publicKey> <attributes> <folderName>")
 				continue
 			}
 			recipientId := args[1]
-			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-
-			// Include checksum in foldername if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				folderName = folderName + "|" + checksum
-			}
-
+			transferID := args[2]
+			folderSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println("Invalid folderSize. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+				fmt.Println("Invalid folderSize. Use: /FOLDER_REQUEST <userId> <transferId> <folderSize> <checksum> <candidates> <publicKey> <attributes> <folderName>")
 				continue
 			}
+			checksum := args[4]
+			candidates := args[5]
+			publicKey := args[6]
+			attributes := args[7]
+			folderName := args[8]
 
-			HandleFolderTransfer(server, conn, recipientId, folderName, folderSize)
+			HandleFolderTransfer(server, user, recipientId, transferID, folderName, checksum, candidates, publicKey, attributes, folderSize)
 			continue
-		case messageContent == "PONG\n":
+		case strings.HasPrefix(messageContent, "/TRANSFER_PATH"):
+			args := strings.Fields(messageContent)
+			if len(args) != 3 {
+				fmt.Println("Invalid arguments. Use: /TRANSFER_PATH <token> <direct|relay>")
+				continue
+			}
+			HandleTransferPath(server, user, args[1], args[2])
 			continue
-		case strings.HasPrefix(messageContent, "/status"):
-			_, err = conn.Write([]byte("USERS:"))
+		case strings.HasPrefix(messageContent, "/TRANSFER_KEY"):
+			args := strings.Fields(messageContent)
+			if len(args) != 3 {
+				fmt.Println("Invalid arguments. Use: /TRANSFER_KEY <token> <publicKey>")
+				continue
+			}
+			HandleTransferKey(server, user, args[1], args[2])
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_PAUSE"), strings.HasPrefix(messageContent, "/TRANSFER_RESUME"),
+			strings.HasPrefix(messageContent, "/TRANSFER_CANCEL"):
+			args := strings.Fields(messageContent)
+			if len(args) != 3 {
+				fmt.Printf("Invalid arguments. Use: %s <userId> <token>\n", args[0])
+				continue
+			}
+			HandleTransferSignal(server, user, args[0], args[1], args[2])
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_ACCEPT"), strings.HasPrefix(messageContent, "/TRANSFER_DECLINE"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				fmt.Printf("Invalid arguments. Use: %s <token>\n", args[0])
+				continue
+			}
+			HandleTransferAnswer(server, user, args[0], args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_DONE"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				fmt.Println("Invalid arguments. Use: /TRANSFER_DONE <token>")
+				continue
+			}
+			HandleTransferDone(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_OFFSET"):
+			offer, err := protocol.ParseResumeOffer(messageContent)
 			if err != nil {
-				fmt.Println("Error sending user list header:", err)
+				fmt.Println("Invalid arguments. Use: /TRANSFER_OFFSET <token> <offset> <proof>")
 				continue
 			}
+			HandleTransferOffset(server, user, offer)
+			continue
+		case messageContent == "PONG":
+			continue
+		case strings.HasPrefix(messageContent, "/status"):
+			// The whole list travels in one frame so the client never has to guess where it ends
+			statusMsg := "USERS:"
+			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					statusMsg := fmt.Sprintf("%s (%s) is online\n", user.Username, user.UserId)
-					_, err = conn.Write([]byte(statusMsg))
-					if err != nil {
-						fmt.Println("Error sending user list:", err)
-						continue
-					}
+					statusMsg += fmt.Sprintf("\n%s (%s) is online", user.Username, user.UserId)
 				}
 			}
+			server.Mutex.Unlock()
+			err = protocol.SendCommand(conn, statusMsg)
+			if err != nil {
+				fmt.Println("Error sending user list:", err)
+			}
 			continue
 		case strings.HasPrefix(messageContent, "/GET_ONLINE_USERS"):
 			users := GetOnlineUsersList(server)
@@ -331,8 +487,7 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 					response += fmt.Sprintf(" %s|%s", u.UserId, u.Username)
 				}
 			}
-			response += "\n"
-			_, err = conn.Write([]byte(response))
+			err = protocol.SendCommand(conn, response)
 			if err != nil {
 				fmt.Println("Error sending online users list:", err)
 			}
@@ -356,8 +511,8 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 			// Notify all room members about room creation
 			for memberID, member := range room.Members {
 				if member.IsOnline {
-					notification := fmt.Sprintf("ROOM_CREATED %s %s %s\n", room.ID, room.Name, user.Username)
-					_, err = member.Conn.Write([]byte(notification))
+					notification := fmt.Sprintf("ROOM_CREATED %s %s %s", room.ID, room.Name, user.Username)
+					err = protocol.SendCommand(member.Conn, notification)
 					if err != nil {
 						fmt.Printf("Error notifying user %s about room creation: %v\n", memberID, err)
 					}
@@ -377,7 +532,7 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 			server.Mutex.Unlock()
 
 			if !exists {
-				_, err = conn.Write([]byte("ROOM_NOT_FOUND\n"))
+				err = protocol.SendCommand(conn, "ROOM_NOT_FOUND")
 				if err != nil {
 					fmt.Printf("Error sending room not found message: %v\n", err)
 				}
@@ -390,15 +545,18 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 			room.Mutex.RUnlock()
 
 			if !isMember {
-				_, err = conn.Write([]byte("NOT_ROOM_MEMBER\n"))
+				err = protocol.SendCommand(conn, "NOT_ROOM_MEMBER")
 				if err != nil {
 					fmt.Printf("Error sending not member message: %v\n", err)
 				}
 				continue
 			}
 
+			server.Mutex.Lock()
 			user.CurrentRoomID = roomID
-			_, err = conn.Write([]byte(fmt.Sprintf("ROOM_JOINED %s %s\n", roomID, room.Name)))
+			server.Mutex.Unlock()
+			saveUser(server, user.UserId)
+			err = protocol.SendCommand(conn, fmt.Sprintf("ROOM_JOINED %s %s", roomID, room.Name))
 			if err != nil {
 				fmt.Printf("Error sending room joined confirmation: %v\n", err)
 			}
@@ -406,8 +564,11 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 		case strings.HasPrefix(messageContent, "/LEAVE_ROOM"):
 			if user.CurrentRoomID != "" {
 				oldRoomID := user.CurrentRoomID
+				server.Mutex.Lock()
 				user.CurrentRoomID = ""
-				_, err = conn.Write([]byte(fmt.Sprintf("ROOM_LEFT %s\n", oldRoomID)))
+				server.Mutex.Unlock()
+				saveUser(server, user.UserId)
+				err = protocol.SendCommand(conn, fmt.Sprintf("ROOM_LEFT %s", oldRoomID))
 				if err != nil {
 					fmt.Printf("Error sending room left confirmation: %v\n", err)
 				}
@@ -424,8 +585,7 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 				room.Mutex.RUnlock()
 			}
 			server.Mutex.Unlock()
-			response += "\n"
-			_, err = conn.Write([]byte(response))
+			err = protocol.SendCommand(conn, response)
 			if err != nil {
 				fmt.Printf("Error sending rooms list: %v\n", err)
 			}
@@ -458,6 +618,14 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 
 			BroadcastRoomMessage(roomID, user.Username, content, server, user)
 			continue
+		case strings.HasPrefix(messageContent, "/DIRECT_MESSAGE"):
+			args := strings.SplitN(messageContent, " ", 3)
+			if len(args) != 3 {
+				fmt.Println("Invalid arguments. Use: /DIRECT_MESSAGE <userId> <content>")
+				continue
+			}
+			SendDirectMessage(server, user, args[1], args[2])
+			continue
 		case strings.HasPrefix(messageContent, "/LOOK"):
 			args := strings.SplitN(messageContent, " ", 2)
 			if len(args) != 2 {
@@ -465,7 +633,7 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 				continue
 			}
 			recipientId := strings.TrimSpace(args[1])
-			HandleLookupRequest(server, conn, recipientId)
+			HandleLookupRequest(server, user, recipientId)
 			continue
 		case strings.HasPrefix(messageContent, "/DIR_LISTING"):
 			args := strings.SplitN(messageContent, " ", 3)
@@ -473,9 +641,8 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 				fmt.Println("Invalid arguments. Use: /DIR_LISTING <userId> <files>")
 				continue
 			}
-			userId := strings.TrimSpace(args[1])
-			files := strings.TrimSpace(args[2])
-			HandleLookupResponse(server, conn, userId, strings.Split(files, " "))
+			requesterId := strings.TrimSpace(args[1])
+			HandleLookupResponse(server, user, requesterId, args[2])
 			continue
 		case strings.HasPrefix(messageContent, "/DOWNLOAD_REQUEST"):
 			args := strings.SplitN(messageContent, " ", 3)
@@ -491,7 +658,7 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 		case strings.HasPrefix(messageContent, "/ROOM_MEMBERS"):
 			args := strings.SplitN(messageContent, " ", 2)
 			if len(args) != 2 {
-				conn.Write([]byte("ROOM_MEMBERS_RESPONSE ERROR\n"))
+				protocol.SendCommand(conn, "ROOM_MEMBERS_RESPONSE ERROR")
 				continue
 			}
 			roomID := strings.TrimSpace(args[1])
@@ -499,7 +666,7 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 			room, exists := server.Rooms[roomID]
 			server.Mutex.Unlock()
 			if !exists {
-				conn.Write([]byte("ROOM_MEMBERS_RESPONSE ERROR\n"))
+				protocol.SendCommand(conn, "ROOM_MEMBERS_RESPONSE ERROR")
 				continue
 			}
 			room.Mutex.RLock()
@@ -508,16 +675,11 @@ func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces
 				userIDs = append(userIDs, uid)
 			}
 			room.Mutex.RUnlock()
-			response := "ROOM_MEMBERS_RESPONSE " + roomID + " " + strings.Join(userIDs, ",") + "\n"
-			conn.Write([]byte(response))
+			response := "ROOM_MEMBERS_RESPONSE " + roomID + " " + strings.Join(userIDs, ",")
+			protocol.SendCommand(conn, response)
 			continue
 		default:
-			// Check if user is in a room and wants to send a room message
-			if user.CurrentRoomID != "" {
-				BroadcastRoomMessage(user.CurrentRoomID, user.Username, messageContent, server, user)
-			} else {
-				BroadcastMessage(messageContent, server, user)
-			}
+			fmt.Printf("Unknown command from %s: %s\n", user.Username, messageContent)
 		}
 	}
 }
@@ -527,7 +689,7 @@ func BroadcastMessage(content string, server *interfaces.Server, sender *interfa
 	defer server.Mutex.Unlock()
 	for _, recipient := range server.Connections {
 		if recipient.IsOnline && recipient != sender {
-			_, _ = recipient.Conn.Write([]byte(fmt.Sprintf("%s: %s\n", sender.Username, content)))
+			_ = protocol.SendChat(recipient.Conn, fmt.Sprintf("%s: %s", sender.Username, content))
 		}
 	}
 }
@@ -539,7 +701,7 @@ func StartHeartBeat(interval time.Duration, server *interfaces.Server) {
 			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					_, err := user.Conn.Write([]byte("PING\n"))
+					err := protocol.SendCommand(user.Conn, "PING")
 					if err != nil {
 						fmt.Printf("User disconnected: %s\n", user.Username)
 						user.IsOnline = false
@@ -553,7 +715,7 @@ func StartHeartBeat(interval time.Duration, server *interfaces.Server) {
 }
 
 // StartDiscoveryBroadcast continuously broadcasts server presence via UDP
-func StartDiscoveryBroadcast(serverAddress string) {
+func StartDiscoveryBroadcast(serverAddress string, useTLS bool) {
 	// Extract port from server address
 	port := strings.TrimPrefix(serverAddress, ":")
 
@@ -572,8 +734,11 @@ func StartDiscoveryBroadcast(serverAddress string) {
 	}
 	defer conn.Close()
 
-	// Broadcast message format: DRIZLINK_SERVER:<server_ip>:<server_port>
+	// Broadcast message format: DRIZLINK_SERVER:<server_ip>:<server_port>[:tls]
 	broadcastMsg := fmt.Sprintf("DRIZLINK_SERVER:%s:%s", serverIP, port)
+	if useTLS {
+		broadcastMsg += ":tls"
+	}
 
 	fmt.Println(utils.InfoColor("📡 Broadcasting server presence on UDP port 9876"))
 	fmt.Println(utils.InfoColor("   Message:"), utils.CommandColor(broadcastMsg))
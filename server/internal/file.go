@@ -1,43 +1,47 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"io"
 	"net"
-	"strings"
 )
 
-func HandleFileTransfer(server *interfaces.Server, conn net.Conn, recipientId, fileName string, fileSize int64) {
-	// Extract checksum if present
-	checksum := ""
-	fileNameWithChecksum := fileName
-	
-	parts := strings.SplitN(fileName, "|", 2)
-	if len(parts) == 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println("Original checksum:", checksum)
-	}
-	
+func HandleFileTransfer(server *interfaces.Server, sender *interfaces.User, recipientId, transferID, fileName, checksum, candidates, publicKey, attributes string, fileSize int64) {
+	fmt.Println("Original checksum:", checksum)
+
+	server.Mutex.Lock()
 	recipient, exists := server.Connections[recipientId]
-	if exists {
-		// Include checksum in response if available
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FILE_RESPONSE %s %s %d %s", 
-		    recipientId, fileNameWithChecksum, fileSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending file response to %s: %v\n", recipientId, err)
-		}
-		n, err := io.CopyN(recipient.Conn, conn, fileSize)
-		if err != nil {
-			fmt.Printf("Error receiving file from %s: %v\n", recipientId, err)
-		}
-		fmt.Printf("Transferred %d bytes from %s\n", n, recipientId)
-		if err != nil {
-			fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
-		}
-	} else {
+	server.Mutex.Unlock()
+	if !exists || !recipient.IsOnline {
 		fmt.Printf("User %s not found\n", recipientId)
+		protocol.SendCommand(sender.Conn, fmt.Sprintf("/TRANSFER_FAILED %s User %s is not online", transferID, recipientId))
+		return
+	}
+
+	transfer := RegisterTransfer(server, "file", sender, recipient, fileName, checksum, fileSize)
+
+	// The recipient tries the sender's addresses first and falls back to our relay.
+	// The public key is passed through untouched so only the two clients can
+	// derive the key that encrypts the file.
+	candidates = withObservedCandidate(candidates, sender.IpAddress)
+	attributes = checkOfferAttributes(server, sender, recipient, attributes)
+	// A large file may be sent over several data connections side by side
+	RegisterStreams(server, transfer, protocol.OfferStreams(protocol.DecodeAttributes(attributes)))
+	err := protocol.SendCommand(recipient.Conn, fmt.Sprintf("/FILE_RESPONSE %s %s %s %d %s %s %s %s %s",
+		transfer.Token, sender.UserId, sender.Username, fileSize, checksum, candidates, publicKey, attributes, fileName))
+	if err != nil {
+		fmt.Printf("Error sending file response to %s: %v\n", recipientId, err)
+		removePendingTransfer(server, transfer.Token)
+		protocol.SendCommand(sender.Conn, fmt.Sprintf("/TRANSFER_FAILED %s Could not reach %s", transferID, recipientId))
+		return
+	}
+
+	// Hand the sender the token for its own data connection
+	err = protocol.SendCommand(sender.Conn, fmt.Sprintf("/TRANSFER_READY %s %s", transferID, transfer.Token))
+	if err != nil {
+		fmt.Printf("Error sending transfer token to %s: %v\n", sender.UserId, err)
+		removePendingTransfer(server, transfer.Token)
 	}
 }
 
@@ -52,19 +56,21 @@ func SendFile(server *interfaces.Server, senderId, recipientId, filePath string)
 	}
 
 	sender, exists := server.Connections[senderId]
-	if !exists {
+	if !exists || !sender.IsOnline {
 		fmt.Printf("User %s not found\n", senderId)
 		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/sendfile %s %s\n", recipientId, filePath)))
+	err := protocol.SendCommand(sender.Conn, fmt.Sprintf("/sendfile %s %s", recipientId, filePath))
 	if err != nil {
 		fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
 	}
 }
 
 func HandleDownloadRequest(server *interfaces.Server, conn net.Conn, senderId, recipientId, filePath string) {
+	server.Mutex.Lock()
 	sender, exists := server.Connections[senderId]
+	server.Mutex.Unlock()
 	if !exists {
 		fmt.Printf("User %s not found\n", senderId)
 		return
@@ -75,7 +81,7 @@ func HandleDownloadRequest(server *interfaces.Server, conn net.Conn, senderId, r
 		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+	err := protocol.SendCommand(sender.Conn, fmt.Sprintf("/DOWNLOAD_REQUEST %s %s", recipientId, filePath))
 	if err != nil {
 		fmt.Printf("Error sending file request to %s: %v\n", senderId, err)
 	}
@@ -1,41 +1,49 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"io"
-	"net"
-	"strings"
 )
 
-func HandleFolderTransfer(server *interfaces.Server, conn net.Conn, recipientId, folderName string, folderSize int64) {
+func HandleFolderTransfer(server *interfaces.Server, sender *interfaces.User, recipientId, transferID, folderName, checksum, candidates, publicKey, attributes string, folderSize int64) {
+	server.Mutex.Lock()
 	recipient, exists := server.Connections[recipientId]
-	if exists {
-		// Send folder transfer response to recipient
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FOLDER_RESPONSE %s %s %d %s", recipientId, folderName, folderSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending folder response to %s: %v\n", recipientId, err)
-			return
-		}
-
-		// Forward the zipped folder data from sender to recipient
-		n, err := io.CopyN(recipient.Conn, conn, folderSize)
-		if err != nil {
-			fmt.Printf("Error transferring folder data: %v\n", err)
-			return
-		}
-		fmt.Printf("Transferred %d bytes of folder data\n", n)
-	} else {
+	server.Mutex.Unlock()
+	if !exists || !recipient.IsOnline {
 		fmt.Printf("User %s not found\n", recipientId)
+		protocol.SendCommand(sender.Conn, fmt.Sprintf("/TRANSFER_FAILED %s User %s is not online", transferID, recipientId))
+		return
+	}
+
+	transfer := RegisterTransfer(server, "folder", sender, recipient, folderName, checksum, folderSize)
+
+	// Send folder transfer response to recipient, the folder stream follows on the data connection
+	candidates = withObservedCandidate(candidates, sender.IpAddress)
+	attributes = checkOfferAttributes(server, sender, recipient, attributes)
+	err := protocol.SendCommand(recipient.Conn, fmt.Sprintf("/FOLDER_RESPONSE %s %s %s %d %s %s %s %s %s",
+		transfer.Token, sender.UserId, sender.Username, folderSize, checksum, candidates, publicKey, attributes, folderName))
+	if err != nil {
+		fmt.Printf("Error sending folder response to %s: %v\n", recipientId, err)
+		removePendingTransfer(server, transfer.Token)
+		protocol.SendCommand(sender.Conn, fmt.Sprintf("/TRANSFER_FAILED %s Could not reach %s", transferID, recipientId))
+		return
+	}
+
+	err = protocol.SendCommand(sender.Conn, fmt.Sprintf("/TRANSFER_READY %s %s", transferID, transfer.Token))
+	if err != nil {
+		fmt.Printf("Error sending transfer token to %s: %v\n", sender.UserId, err)
+		removePendingTransfer(server, transfer.Token)
 	}
 }
 
-func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string) {
+func HandleLookupRequest(server *interfaces.Server, requester *interfaces.User, userId string) {
+	server.Mutex.Lock()
 	recipient, exists := server.Connections[userId]
-	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
+	server.Mutex.Unlock()
 	if !exists {
 		fmt.Printf("User %s not found\n", userId)
-		_, err := conn.Write([]byte(fmt.Sprintf("User %s not found\n", userId)))
+		err := protocol.SendChat(requester.Conn, fmt.Sprintf("User %s not found", userId))
 		if err != nil {
 			fmt.Printf("Error sending lookup response: %v\n", err)
 		}
@@ -44,7 +52,7 @@ func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string
 
 	if !recipient.IsOnline {
 		fmt.Printf("User %s is not online\n", userId)
-		_, err := conn.Write([]byte(fmt.Sprintf("User %s is not online\n", userId)))
+		err := protocol.SendChat(requester.Conn, fmt.Sprintf("User %s is not online", userId))
 		if err != nil {
 			fmt.Printf("Error sending lookup response: %v\n", err)
 		}
@@ -53,10 +61,10 @@ func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string
 
 	// Send the lookup request to the recipient's connection
 	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
-	_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/LOOK_REQUEST %s %s\n", userId, recipient.StoreFilePath)))
+	err := protocol.SendCommand(recipient.Conn, fmt.Sprintf("/LOOK_REQUEST %s %s", requester.UserId, recipient.StoreFilePath))
 	if err != nil {
 		fmt.Printf("Error sending lookup request to recipient: %v\n", err)
-		_, respErr := conn.Write([]byte(fmt.Sprintf("Error looking up user %s's directory\n", userId)))
+		respErr := protocol.SendChat(requester.Conn, fmt.Sprintf("Error looking up user %s's directory", userId))
 		if respErr != nil {
 			fmt.Printf("Error sending error response: %v\n", respErr)
 		}
@@ -66,8 +74,16 @@ func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string
 	fmt.Printf("Lookup request sent to user %s\n", userId)
 }
 
-func HandleLookupResponse(server *interfaces.Server, conn net.Conn, userId string, files []string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(files, " "))))
+func HandleLookupResponse(server *interfaces.Server, owner *interfaces.User, requesterId string, listing string) {
+	server.Mutex.Lock()
+	requester, exists := server.Connections[requesterId]
+	server.Mutex.Unlock()
+	if !exists || !requester.IsOnline {
+		fmt.Printf("User %s not found\n", requesterId)
+		return
+	}
+
+	err := protocol.SendCommand(requester.Conn, fmt.Sprintf("/LOOK_RESPONSE %s %s", owner.UserId, listing))
 	if err != nil {
 		fmt.Printf("Error sending lookup response: %v\n", err)
 		return
@@ -0,0 +1,50 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"fmt"
+	"net"
+	"time"
+)
+
+// handshakeTimeout bounds how long a new connection may take to say HELLO
+const handshakeTimeout = 10 * time.Second
+
+// SupportedFeatures lists the optional protocol features this server implements
+var SupportedFeatures = []string{
+	protocol.FeatureHashing,
+	protocol.FeatureEncryption,
+	protocol.FeatureDirect,
+	protocol.FeatureResume,
+	protocol.FeatureChunks,
+	protocol.FeatureDelta,
+	protocol.FeatureStreams,
+	protocol.FeatureCompression,
+}
+
+// handshake parses the client's HELLO and answers with a WELCOME carrying the
+// negotiated protocol version and features
+func handshake(conn net.Conn, frame protocol.Frame) (int, []string, error) {
+	if frame.Type != protocol.FrameCommand {
+		return 0, nil, fmt.Errorf("expected HELLO, got %s frame", frame.Type)
+	}
+
+	hello, err := protocol.ParseHello(string(frame.Payload))
+	if err != nil {
+		protocol.SendCommand(conn, "/INCOMPATIBLE "+err.Error())
+		return 0, nil, err
+	}
+
+	version, features, err := protocol.Negotiate(hello.Version, SupportedFeatures, hello.Features)
+	if err != nil {
+		protocol.SendCommand(conn, "/INCOMPATIBLE "+err.Error())
+		return 0, nil, err
+	}
+
+	welcome := protocol.Welcome{Version: version, Features: features}
+	if err := protocol.SendCommand(conn, welcome.Encode()); err != nil {
+		return 0, nil, err
+	}
+
+	return version, features, nil
+}
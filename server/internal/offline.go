@@ -0,0 +1,170 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"time"
+)
+
+const (
+	// retentionSetting is the settings key for how long queued messages are kept
+	retentionSetting = "message_retention"
+	// defaultRetention applies until a retention is configured
+	defaultRetention = 7 * 24 * time.Hour
+	// maxQueuedMessages caps each user's queue; the oldest messages go first
+	maxQueuedMessages = 500
+)
+
+// messageRetention returns how long messages wait for an offline user; zero
+// disables the queue
+func messageRetention(server *interfaces.Server) time.Duration {
+	value, exists := server.Settings[retentionSetting]
+	if !exists {
+		return defaultRetention
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultRetention
+	}
+	return retention
+}
+
+// queueForOffline keeps a chat message for every offline user it was meant
+// for and returns their IDs, to be passed to saveQueues once server.Mutex is
+// released. Call with server.Mutex held.
+func queueForOffline(server *interfaces.Server, message interfaces.Message, recipients []*interfaces.User) []string {
+	retention := messageRetention(server)
+	if retention <= 0 {
+		return nil
+	}
+
+	var queued []string
+
+	for _, recipient := range recipients {
+		if recipient.IsOnline || recipient.UserId == message.SenderId {
+			continue
+		}
+		queue := append(pruneExpired(server.OfflineMessages[recipient.UserId], retention), message)
+		if len(queue) > maxQueuedMessages {
+			queue = queue[len(queue)-maxQueuedMessages:]
+		}
+		server.OfflineMessages[recipient.UserId] = queue
+		queued = append(queued, recipient.UserId)
+	}
+	return queued
+}
+
+// pruneExpired drops messages older than the retention
+func pruneExpired(queue []interfaces.Message, retention time.Duration) []interfaces.Message {
+	cutoff := time.Now().Add(-retention)
+	for len(queue) > 0 {
+		sent, err := time.Parse(time.RFC3339, queue[0].Timestamp)
+		if err == nil && sent.After(cutoff) {
+			break
+		}
+		queue = queue[1:]
+	}
+	return queue
+}
+
+// newMessage stamps a chat message with the current time
+func newMessage(sender *interfaces.User, content string) interfaces.Message {
+	return interfaces.Message{
+		SenderId:       sender.UserId,
+		SenderUsername: sender.Username,
+		Content:        content,
+		Timestamp:      time.Now().Format(time.RFC3339),
+	}
+}
+
+// deliverQueuedMessages replays everything said while the user was away, in
+// order and with the original timestamps
+func deliverQueuedMessages(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	queue, exists := server.OfflineMessages[user.UserId]
+	if exists {
+		delete(server.OfflineMessages, user.UserId)
+	}
+	queue = pruneExpired(queue, messageRetention(server))
+
+	lines := make([]string, len(queue))
+	for i, message := range queue {
+		lines[i] = formatMessage(server, message)
+	}
+	conn := user.Conn
+	server.Mutex.Unlock()
+
+	if exists {
+		saveQueues(server, []string{user.UserId})
+	}
+
+	if len(queue) == 0 {
+		return
+	}
+
+	protocol.SendChat(conn, fmt.Sprintf("📬 %d messages arrived while you were away:", len(queue)))
+	for i, message := range queue {
+		sent, err := time.Parse(time.RFC3339, message.Timestamp)
+		if err != nil {
+			sent = time.Now()
+		}
+		if err := protocol.SendCommand(conn, fmt.Sprintf("/QUEUED_MESSAGE %d %s", sent.Unix(), lines[i])); err != nil {
+			fmt.Printf("Error replaying messages to %s: %v\n", user.Username, err)
+			return
+		}
+	}
+}
+
+// formatMessage renders a message the way it is shown when delivered live.
+// Call with server.Mutex held.
+func formatMessage(server *interfaces.Server, message interfaces.Message) string {
+	switch {
+	case message.Direct:
+		return fmt.Sprintf("[DM] %s: %s", message.SenderUsername, message.Content)
+	case message.RoomID != "":
+		name := message.RoomID
+		if room, exists := server.Rooms[message.RoomID]; exists {
+			name = room.Name
+		}
+		return fmt.Sprintf("[Room %s] %s: %s", name, message.SenderUsername, message.Content)
+	default:
+		return fmt.Sprintf("%s: %s", message.SenderUsername, message.Content)
+	}
+}
+
+// SendDirectMessage delivers a private message, or queues it if the
+// recipient is offline
+func SendDirectMessage(server *interfaces.Server, sender *interfaces.User, recipientId, content string) {
+	message := newMessage(sender, content)
+	message.Direct = true
+
+	server.Mutex.Lock()
+	recipient, exists := server.Connections[recipientId]
+	if !exists {
+		server.Mutex.Unlock()
+		protocol.SendChat(sender.Conn, fmt.Sprintf("User %s not found", recipientId))
+		return
+	}
+
+	if recipient.IsOnline {
+		conn := recipient.Conn
+		line := formatMessage(server, message)
+		server.Mutex.Unlock()
+		if err := protocol.SendChat(conn, line); err != nil {
+			fmt.Printf("Error sending direct message to %s: %v\n", recipient.Username, err)
+		}
+		return
+	}
+
+	saved := queueForOffline(server, message, []*interfaces.User{recipient})
+	queued := messageRetention(server) > 0
+	server.Mutex.Unlock()
+	saveQueues(server, saved)
+
+	if queued {
+		protocol.SendChat(sender.Conn, fmt.Sprintf("📬 %s is offline, your message will be delivered when they return", recipient.Username))
+	} else {
+		protocol.SendChat(sender.Conn, fmt.Sprintf("%s is offline and this server does not keep messages", recipient.Username))
+	}
+}
@@ -0,0 +1,74 @@
+package connection
+
+import (
+	"drizlink/server/interfaces"
+	"drizlink/server/storage"
+	"fmt"
+	"testing"
+)
+
+// countingStore counts the writes of offline queues
+type countingStore struct {
+	*storage.MemoryStore
+	writes int
+}
+
+func (s *countingStore) SaveQueues(queues map[string][]interfaces.Message) error {
+	s.writes++
+	return s.MemoryStore.SaveQueues(queues)
+}
+
+func TestQueueForOfflineSavesOnce(t *testing.T) {
+	store := &countingStore{MemoryStore: storage.NewMemoryStore()}
+	server := newTestServer(store)
+	sender := &interfaces.User{UserId: "0", Username: "sender", IsOnline: true}
+	recipients := []*interfaces.User{sender, {UserId: "online", IsOnline: true}}
+	for i := 0; i < 20; i++ {
+		recipients = append(recipients, &interfaces.User{UserId: fmt.Sprint(i + 1)})
+	}
+
+	server.Mutex.Lock()
+	queued := queueForOffline(server, newMessage(sender, "hello"), recipients)
+	server.Mutex.Unlock()
+	if len(queued) != 20 {
+		t.Fatalf("queued for %d users, want the 20 offline ones", len(queued))
+	}
+	if store.writes != 0 {
+		t.Errorf("queueForOffline wrote to the store %d times while holding the lock", store.writes)
+	}
+
+	saveQueues(server, queued)
+	if store.writes != 1 {
+		t.Errorf("saving 20 queues took %d writes, want 1", store.writes)
+	}
+	state, _ := store.Load()
+	if len(state.Queues) != 20 || state.Queues["1"][0].Content != "hello" {
+		t.Errorf("stored queues = %+v", state.Queues)
+	}
+}
+
+func TestSaveQueuesStoresCurrentQueues(t *testing.T) {
+	server := newTestServer(storage.NewMemoryStore())
+	sender := &interfaces.User{UserId: "0", Username: "sender", IsOnline: true}
+	away := &interfaces.User{UserId: "1"}
+
+	server.Mutex.Lock()
+	first := queueForOffline(server, newMessage(sender, "first"), []*interfaces.User{away})
+	queueForOffline(server, newMessage(sender, "second"), []*interfaces.User{away})
+	server.Mutex.Unlock()
+
+	// A late save still writes the queue as it is now, never an older one
+	saveQueues(server, first)
+	state, _ := server.Store.Load()
+	if queue := state.Queues["1"]; len(queue) != 2 || queue[1].Content != "second" {
+		t.Errorf("stored queue = %+v, want both messages", queue)
+	}
+
+	server.Mutex.Lock()
+	delete(server.OfflineMessages, "1")
+	server.Mutex.Unlock()
+	saveQueues(server, first)
+	if state, _ := server.Store.Load(); len(state.Queues) != 0 {
+		t.Errorf("a delivered queue is still stored: %+v", state.Queues)
+	}
+}
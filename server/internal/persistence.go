@@ -0,0 +1,226 @@
+package connection
+
+import (
+	"drizlink/server/interfaces"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoadState fills the server from its store. Users come back offline and
+// reappear in their rooms; expired sessions are dropped on the way.
+func LoadState(server *interfaces.Server) error {
+	state, err := server.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+
+	for username, account := range state.Accounts {
+		account := account
+		server.Accounts[username] = &account
+	}
+
+	now := time.Now()
+	for key, session := range state.Sessions {
+		session := session
+		if now.After(session.ExpiresAt) {
+			persistError(server.Store.DeleteSession(key))
+			continue
+		}
+		server.Sessions[key] = &session
+	}
+
+	for id, record := range state.Users {
+		server.Connections[id] = &interfaces.User{
+			UserId:        record.UserId,
+			Username:      record.Username,
+			StoreFilePath: record.StoreFilePath,
+			CurrentRoomID: record.CurrentRoomID,
+		}
+	}
+
+	for id, record := range state.Rooms {
+		room := &interfaces.Room{
+			ID:        record.ID,
+			Name:      record.Name,
+			Members:   make(map[string]*interfaces.User),
+			CreatedBy: record.CreatedBy,
+			CreatedAt: record.CreatedAt,
+		}
+		for _, memberID := range record.Members {
+			if member, exists := server.Connections[memberID]; exists {
+				room.Members[memberID] = member
+			}
+		}
+		server.Rooms[id] = room
+	}
+
+	for key, value := range state.Settings {
+		server.Settings[key] = value
+	}
+
+	retention := messageRetention(server)
+	for userId, queue := range state.Queues {
+		if queue = pruneExpired(queue, retention); len(queue) > 0 {
+			server.OfflineMessages[userId] = queue
+		}
+	}
+
+	fmt.Printf("Loaded %d accounts, %d users and %d rooms\n", len(server.Accounts), len(server.Connections), len(server.Rooms))
+	return nil
+}
+
+// saveMutex orders the writes of the save functions below. Each copies
+// what it persists under server.Mutex only once it holds saveMutex, so a
+// snapshot never overwrites a newer one.
+var saveMutex sync.Mutex
+
+// The save functions persist a record as the server holds it now. Call them
+// without server.Mutex, which they only take to copy the record, so other
+// connections are not held up while the store writes.
+
+// saveAccount persists the account of username
+func saveAccount(server *interfaces.Server, username string) {
+	if server.Store == nil {
+		return
+	}
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	server.Mutex.Lock()
+	account, exists := server.Accounts[username]
+	var record interfaces.Account
+	if exists {
+		record = *account
+	}
+	server.Mutex.Unlock()
+
+	if exists {
+		persistError(server.Store.SaveAccount(record))
+	}
+}
+
+// saveSession persists the session under the hash of its token, or removes
+// it from the store once the server no longer has it
+func saveSession(server *interfaces.Server, key string) {
+	if server.Store == nil {
+		return
+	}
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	server.Mutex.Lock()
+	session, exists := server.Sessions[key]
+	var record interfaces.Session
+	if exists {
+		record = *session
+	}
+	server.Mutex.Unlock()
+
+	if exists {
+		persistError(server.Store.SaveSession(key, record))
+	} else {
+		persistError(server.Store.DeleteSession(key))
+	}
+}
+
+// saveUser persists the durable fields of a user
+func saveUser(server *interfaces.Server, userId string) {
+	if server.Store == nil {
+		return
+	}
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	server.Mutex.Lock()
+	user, exists := server.Connections[userId]
+	var record interfaces.UserRecord
+	if exists {
+		record = interfaces.UserRecord{
+			UserId:        user.UserId,
+			Username:      user.Username,
+			StoreFilePath: user.StoreFilePath,
+			CurrentRoomID: user.CurrentRoomID,
+		}
+	}
+	server.Mutex.Unlock()
+
+	if exists {
+		persistError(server.Store.SaveUser(record))
+	}
+}
+
+// saveRoom persists a room and its members
+func saveRoom(server *interfaces.Server, roomID string) {
+	if server.Store == nil {
+		return
+	}
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomID]
+	var record interfaces.RoomRecord
+	if exists {
+		room.Mutex.RLock()
+		record = interfaces.RoomRecord{
+			ID:        room.ID,
+			Name:      room.Name,
+			CreatedBy: room.CreatedBy,
+			CreatedAt: room.CreatedAt,
+			Members:   make([]string, 0, len(room.Members)),
+		}
+		for memberID := range room.Members {
+			record.Members = append(record.Members, memberID)
+		}
+		room.Mutex.RUnlock()
+	}
+	server.Mutex.Unlock()
+
+	if exists {
+		sort.Strings(record.Members)
+		persistError(server.Store.SaveRoom(record))
+	}
+}
+
+// saveQueues persists the messages now waiting for the given users in one
+// write
+func saveQueues(server *interfaces.Server, userIds []string) {
+	if server.Store == nil || len(userIds) == 0 {
+		return
+	}
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	server.Mutex.Lock()
+	queues := make(map[string][]interfaces.Message, len(userIds))
+	for _, userId := range userIds {
+		queues[userId] = append([]interfaces.Message(nil), server.OfflineMessages[userId]...)
+	}
+	server.Mutex.Unlock()
+
+	persistError(server.Store.SaveQueues(queues))
+}
+
+// SaveSetting stores a server setting in memory and in the store
+func SaveSetting(server *interfaces.Server, key, value string) {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	server.Mutex.Lock()
+	server.Settings[key] = value
+	server.Mutex.Unlock()
+	if server.Store != nil {
+		persistError(server.Store.SaveSetting(key, value))
+	}
+}
+
+func persistError(err error) {
+	if err != nil {
+		fmt.Println("Error saving server state:", err)
+	}
+}
@@ -0,0 +1,189 @@
+package connection
+
+import (
+	"drizlink/server/interfaces"
+	"drizlink/server/storage"
+	"testing"
+	"time"
+)
+
+func newTestServer(store interfaces.Store) *interfaces.Server {
+	return &interfaces.Server{
+		Connections:     make(map[string]*interfaces.User),
+		Accounts:        make(map[string]*interfaces.Account),
+		Sessions:        make(map[string]*interfaces.Session),
+		Rooms:           make(map[string]*interfaces.Room),
+		Transfers:       make(map[string]*interfaces.Transfer),
+		Relays:          make(map[string]*interfaces.Transfer),
+		Direct:          make(map[string]*interfaces.Transfer),
+		Settings:        make(map[string]string),
+		OfflineMessages: make(map[string][]interfaces.Message),
+		Store:           store,
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	fresh := now.Add(-time.Hour).Format(time.RFC3339)
+	stale := now.Add(-48 * time.Hour).Format(time.RFC3339)
+
+	for _, err := range []error{
+		store.SaveAccount(interfaces.Account{Username: "alice", UserId: "1"}),
+		store.SaveAccount(interfaces.Account{Username: "bob", UserId: "2"}),
+		store.SaveSession("live", interfaces.Session{Username: "alice", ExpiresAt: now.Add(time.Hour)}),
+		store.SaveSession("expired", interfaces.Session{Username: "bob", ExpiresAt: now.Add(-time.Hour)}),
+		store.SaveUser(interfaces.UserRecord{UserId: "1", Username: "alice", StoreFilePath: "/a", CurrentRoomID: "room_1"}),
+		store.SaveUser(interfaces.UserRecord{UserId: "2", Username: "bob", StoreFilePath: "/b"}),
+		// "3" never made it into the users, so it cannot come back as a member
+		store.SaveRoom(interfaces.RoomRecord{ID: "room_1", Name: "team", CreatedBy: "1", Members: []string{"1", "2", "3"}}),
+		store.SaveSetting(retentionSetting, "24h"),
+		store.SaveQueues(map[string][]interfaces.Message{
+			"2": {
+				{SenderId: "1", Content: "old", Timestamp: stale},
+				{SenderId: "1", Content: "new", Timestamp: fresh},
+			},
+			"1": {{SenderId: "2", Content: "old", Timestamp: stale}},
+		}),
+	} {
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	server := newTestServer(store)
+	if err := LoadState(server); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+
+	if len(server.Accounts) != 2 || server.Accounts["alice"].UserId != "1" {
+		t.Errorf("accounts = %+v", server.Accounts)
+	}
+
+	if _, exists := server.Sessions["live"]; !exists {
+		t.Error("live session was not loaded")
+	}
+	if _, exists := server.Sessions["expired"]; exists {
+		t.Error("expired session was loaded")
+	}
+	if state, _ := store.Load(); len(state.Sessions) != 1 {
+		t.Errorf("expired session was not deleted from the store: %+v", state.Sessions)
+	}
+
+	alice := server.Connections["1"]
+	if alice == nil || alice.IsOnline || alice.Username != "alice" || alice.StoreFilePath != "/a" || alice.CurrentRoomID != "room_1" {
+		t.Errorf("user 1 = %+v", alice)
+	}
+
+	room := server.Rooms["room_1"]
+	if room == nil || room.Name != "team" || room.CreatedBy != "1" {
+		t.Fatalf("room = %+v", room)
+	}
+	if len(room.Members) != 2 || room.Members["1"] != alice || room.Members["2"] != server.Connections["2"] {
+		t.Errorf("room members = %+v", room.Members)
+	}
+
+	if messageRetention(server) != 24*time.Hour {
+		t.Errorf("retention = %v, want 24h", messageRetention(server))
+	}
+
+	if queue := server.OfflineMessages["2"]; len(queue) != 1 || queue[0].Content != "new" {
+		t.Errorf("queue of 2 = %+v, want only the message within retention", queue)
+	}
+	if queue, exists := server.OfflineMessages["1"]; exists {
+		t.Errorf("queue of 1 = %+v, want none since all of it expired", queue)
+	}
+}
+
+func TestLoadStateEmpty(t *testing.T) {
+	server := newTestServer(storage.NewMemoryStore())
+	if err := LoadState(server); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(server.Accounts)+len(server.Connections)+len(server.Rooms)+len(server.OfflineMessages) != 0 {
+		t.Errorf("empty store loaded state: %+v", server)
+	}
+}
+
+// unlockedStore fails a test when it is written to while server.Mutex is held
+type unlockedStore struct {
+	*storage.MemoryStore
+	t      *testing.T
+	server *interfaces.Server
+	writes int
+}
+
+func (s *unlockedStore) check(what string) {
+	s.writes++
+	if !s.server.Mutex.TryLock() {
+		s.t.Errorf("%s was written while holding server.Mutex", what)
+		return
+	}
+	s.server.Mutex.Unlock()
+}
+
+func (s *unlockedStore) SaveAccount(account interfaces.Account) error {
+	s.check("account")
+	return s.MemoryStore.SaveAccount(account)
+}
+
+func (s *unlockedStore) SaveSession(key string, session interfaces.Session) error {
+	s.check("session")
+	return s.MemoryStore.SaveSession(key, session)
+}
+
+func (s *unlockedStore) DeleteSession(key string) error {
+	s.check("session deletion")
+	return s.MemoryStore.DeleteSession(key)
+}
+
+func (s *unlockedStore) SaveUser(user interfaces.UserRecord) error {
+	s.check("user")
+	return s.MemoryStore.SaveUser(user)
+}
+
+func (s *unlockedStore) SaveRoom(room interfaces.RoomRecord) error {
+	s.check("room")
+	return s.MemoryStore.SaveRoom(room)
+}
+
+func TestSavesDoNotHoldTheLock(t *testing.T) {
+	store := &unlockedStore{MemoryStore: storage.NewMemoryStore(), t: t}
+	server := newTestServer(store)
+	store.server = server
+
+	account, registered, err := authenticate(server, "alice", "correct horse")
+	if err != nil || !registered {
+		t.Fatalf("authenticate = %v, %v", registered, err)
+	}
+	token, err := issueSession(server, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumeSession(server, token); err != nil {
+		t.Fatalf("resumeSession: %v", err)
+	}
+
+	user := &interfaces.User{UserId: account.UserId, Username: "alice", CurrentRoomID: "room_gone"}
+	server.Connections[user.UserId] = user
+	room, err := CreateRoom(server, "team", user.UserId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveUserFromRoom(server, room.ID, user.UserId); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserToRoom(server, room.ID, user.UserId); err != nil {
+		t.Fatal(err)
+	}
+	restoreRoom(server, user)
+
+	if store.writes != 7 {
+		t.Errorf("%d writes, want 7", store.writes)
+	}
+	state, _ := store.Load()
+	if len(state.Accounts) != 1 || len(state.Sessions) != 0 || state.Users[user.UserId].CurrentRoomID != "" ||
+		len(state.Rooms[room.ID].Members) != 1 {
+		t.Errorf("stored state = %+v", state)
+	}
+}
@@ -0,0 +1,45 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"strconv"
+	"sync"
+)
+
+// relayLimitSetting is the settings key for the bytes per second the server
+// relays for each user; 0 or no setting leaves relayed transfers unlimited
+const relayLimitSetting = "relay_limit"
+
+// relayLimiters holds each user's bucket, so all the transfers and streams
+// relayed for a user share one cap
+var (
+	relayLimiters      = make(map[string]*protocol.RateLimiter)
+	relayLimitersMutex sync.Mutex
+)
+
+// relayLimit returns the bytes per second relayed for each user, 0 if unlimited
+func relayLimit(server *interfaces.Server) int64 {
+	server.Mutex.Lock()
+	value := server.Settings[relayLimitSetting]
+	server.Mutex.Unlock()
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// relayLimiter returns the bucket counting the bytes relayed to and from user
+func relayLimiter(user *interfaces.User, rate int64) *protocol.RateLimiter {
+	relayLimitersMutex.Lock()
+	defer relayLimitersMutex.Unlock()
+	limiter, exists := relayLimiters[user.UserId]
+	if !exists {
+		limiter = protocol.NewRateLimiter(rate)
+		relayLimiters[user.UserId] = limiter
+	}
+	limiter.SetRate(rate)
+	return limiter
+}
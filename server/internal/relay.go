@@ -0,0 +1,272 @@
+package connection
+
+import (
+	"crypto/rand"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// offerTimeout bounds how long a transfer may wait for the recipient to
+// accept it and for both data connections to show up
+const offerTimeout = 5 * time.Minute
+
+// generateTransferToken returns an unguessable one-time token for a data connection
+func generateTransferToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// RegisterTransfer creates a pending transfer and returns it with its token
+func RegisterTransfer(server *interfaces.Server, kind string, sender, recipient *interfaces.User, name, checksum string, size int64) *interfaces.Transfer {
+	transfer := &interfaces.Transfer{
+		Token:     generateTransferToken(),
+		Kind:      kind,
+		Name:      name,
+		Size:      size,
+		Checksum:  checksum,
+		Sender:    sender,
+		Recipient: recipient,
+		CreatedAt: time.Now(),
+	}
+
+	addPendingTransfer(server, transfer)
+	return transfer
+}
+
+// RegisterStreams adds the further data connections of a file sent over
+// several streams. Each one is paired and relayed like a transfer of its own.
+func RegisterStreams(server *interfaces.Server, transfer *interfaces.Transfer, streams int) {
+	for i := 1; i < streams; i++ {
+		stream := &interfaces.Transfer{
+			Token:     protocol.StreamToken(transfer.Token, i),
+			Kind:      transfer.Kind,
+			Name:      transfer.Name,
+			Size:      transfer.Size,
+			Checksum:  transfer.Checksum,
+			Sender:    transfer.Sender,
+			Recipient: transfer.Recipient,
+			CreatedAt: transfer.CreatedAt,
+		}
+		transfer.Streams = append(transfer.Streams, stream.Token)
+		addPendingTransfer(server, stream)
+	}
+}
+
+func addPendingTransfer(server *interfaces.Server, transfer *interfaces.Transfer) {
+	server.Mutex.Lock()
+	server.Transfers[transfer.Token] = transfer
+	server.Mutex.Unlock()
+
+	// Forget the transfer if the data connections never show up
+	time.AfterFunc(offerTimeout, func() {
+		if removePendingTransfer(server, transfer.Token) {
+			fmt.Printf("Transfer %s expired before both sides connected\n", transfer.Token)
+		}
+	})
+}
+
+// removePendingTransfer drops a transfer that has not been paired yet and
+// closes any data connection already waiting for it
+func removePendingTransfer(server *interfaces.Server, token string) bool {
+	server.Mutex.Lock()
+	transfer, exists := server.Transfers[token]
+	if exists {
+		delete(server.Transfers, token)
+	}
+	server.Mutex.Unlock()
+
+	if !exists {
+		return false
+	}
+	if transfer.SenderData != nil {
+		transfer.SenderData.Close()
+	}
+	if transfer.RecipientData != nil {
+		transfer.RecipientData.Close()
+	}
+	for _, stream := range transfer.Streams {
+		removePendingTransfer(server, stream)
+	}
+	return true
+}
+
+// DropTransfers removes every pending or direct transfer the user takes part
+// in, e.g. after a disconnect
+func DropTransfers(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	var tokens []string
+	for token, transfer := range server.Transfers {
+		if transfer.Sender == user || transfer.Recipient == user {
+			tokens = append(tokens, token)
+		}
+	}
+	for token, transfer := range server.Direct {
+		if transfer.Sender == user || transfer.Recipient == user {
+			delete(server.Direct, token)
+		}
+	}
+	server.Mutex.Unlock()
+
+	for _, token := range tokens {
+		removePendingTransfer(server, token)
+	}
+}
+
+// HandleDataConnection attaches a data connection to its transfer and, once
+// both sides are present, relays bytes between them
+func HandleDataConnection(conn net.Conn, server *interfaces.Server, message string) {
+	hello, err := protocol.ParseDataHello(message)
+	if err != nil {
+		protocol.SendCommand(conn, "/DATA_REJECTED "+err.Error())
+		conn.Close()
+		return
+	}
+
+	server.Mutex.Lock()
+	transfer, exists := server.Transfers[hello.Token]
+	if !exists {
+		server.Mutex.Unlock()
+		protocol.SendCommand(conn, "/DATA_REJECTED unknown or expired transfer token")
+		conn.Close()
+		return
+	}
+
+	if hello.Role == protocol.RoleSend {
+		if transfer.SenderData != nil {
+			server.Mutex.Unlock()
+			protocol.SendCommand(conn, "/DATA_REJECTED sender already connected")
+			conn.Close()
+			return
+		}
+		transfer.SenderData = conn
+	} else {
+		if transfer.RecipientData != nil {
+			server.Mutex.Unlock()
+			protocol.SendCommand(conn, "/DATA_REJECTED recipient already connected")
+			conn.Close()
+			return
+		}
+		transfer.RecipientData = conn
+	}
+
+	paired := transfer.SenderData != nil && transfer.RecipientData != nil
+	if paired {
+		// The token is single use: once paired nobody else can attach to it
+		delete(server.Transfers, hello.Token)
+		server.Relays[hello.Token] = transfer
+	}
+	server.Mutex.Unlock()
+
+	if !paired {
+		return
+	}
+
+	relayTransfer(server, transfer)
+
+	server.Mutex.Lock()
+	delete(server.Relays, hello.Token)
+	server.Mutex.Unlock()
+}
+
+// findTransfer returns the transfer of a token, whether it is waiting for its
+// data connections, relayed or going direct. Call with server.Mutex held.
+func findTransfer(server *interfaces.Server, token string) (*interfaces.Transfer, bool) {
+	for _, transfers := range []map[string]*interfaces.Transfer{server.Transfers, server.Relays, server.Direct} {
+		if transfer, exists := transfers[token]; exists {
+			return transfer, true
+		}
+	}
+	return nil, false
+}
+
+// betweenUsers reports whether a transfer is between user and peer, in
+// either direction
+func betweenUsers(transfer *interfaces.Transfer, user, peer *interfaces.User) bool {
+	return (transfer.Sender == user && transfer.Recipient == peer) ||
+		(transfer.Sender == peer && transfer.Recipient == user)
+}
+
+// CancelTransfer stops a transfer the user takes part in, whether it is still
+// waiting for its data connections or already being relayed. Direct transfers
+// are stopped by the peers themselves; we only forget them.
+func CancelTransfer(server *interfaces.Server, user *interfaces.User, token string) {
+	server.Mutex.Lock()
+	pending, isPending := server.Transfers[token]
+	relayed, isRelayed := server.Relays[token]
+	if direct, isDirect := server.Direct[token]; isDirect && (direct.Sender == user || direct.Recipient == user) {
+		delete(server.Direct, token)
+	}
+	server.Mutex.Unlock()
+
+	switch {
+	case isPending && (pending.Sender == user || pending.Recipient == user):
+		removePendingTransfer(server, token)
+		fmt.Printf("Transfer %s '%s' cancelled by %s before it started\n", token, pending.Name, user.Username)
+	case isRelayed && (relayed.Sender == user || relayed.Recipient == user):
+		// Closing the data connections ends the relay loop
+		relayed.SenderData.Close()
+		relayed.RecipientData.Close()
+		for _, stream := range relayed.Streams {
+			CancelTransfer(server, user, stream)
+		}
+		fmt.Printf("Transfer %s '%s' cancelled by %s\n", token, relayed.Name, user.Username)
+	}
+}
+
+// relayTransfer tells both sides to start and copies bytes in both directions
+// until either side closes its data connection. Bytes in either direction
+// count against the relay limit of both users.
+func relayTransfer(server *interfaces.Server, transfer *interfaces.Transfer) {
+	for _, conn := range []net.Conn{transfer.SenderData, transfer.RecipientData} {
+		if err := protocol.SendCommand(conn, "/DATA_OK"); err != nil {
+			fmt.Printf("Error starting transfer %s: %v\n", transfer.Token, err)
+			transfer.SenderData.Close()
+			transfer.RecipientData.Close()
+			return
+		}
+	}
+
+	fmt.Printf("Relaying %s '%s' (%d bytes) from %s to %s\n",
+		transfer.Kind, transfer.Name, transfer.Size, transfer.Sender.Username, transfer.Recipient.Username)
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			transfer.SenderData.Close()
+			transfer.RecipientData.Close()
+		})
+	}
+
+	var toRecipient, toSender io.Writer = transfer.RecipientData, transfer.SenderData
+	if limit := relayLimit(server); limit > 0 {
+		limiters := []*protocol.RateLimiter{relayLimiter(transfer.Sender, limit), relayLimiter(transfer.Recipient, limit)}
+		toRecipient = protocol.NewRateLimitedWriter(transfer.RecipientData, limiters...)
+		toSender = protocol.NewRateLimitedWriter(transfer.SenderData, limiters...)
+	}
+
+	var relayed int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayed, _ = io.Copy(toRecipient, transfer.SenderData)
+		closeBoth()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(toSender, transfer.RecipientData)
+		closeBoth()
+	}()
+	wg.Wait()
+
+	fmt.Printf("Transfer %s finished: relayed %d bytes to %s\n", transfer.Token, relayed, transfer.Recipient.Username)
+}
@@ -0,0 +1,173 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"net"
+)
+
+// withObservedCandidate adds the sender's address as seen by the server to the
+// candidates it announced, since its own view of its interfaces may miss it
+func withObservedCandidate(candidates, observedIP string) string {
+	addresses := protocol.DecodeCandidates(candidates)
+	if len(addresses) == 0 {
+		return protocol.NoCandidates
+	}
+
+	_, port, err := net.SplitHostPort(addresses[0])
+	if err != nil {
+		return candidates
+	}
+
+	observed := net.JoinHostPort(observedIP, port)
+	for _, address := range addresses {
+		if address == observed {
+			return candidates
+		}
+	}
+	return protocol.EncodeCandidates(append(addresses, observed))
+}
+
+// checkOfferAttributes drops a room attribute the sender is not entitled to,
+// since recipients may auto-accept files sent to a room they trust
+func checkOfferAttributes(server *interfaces.Server, sender, recipient *interfaces.User, encoded string) string {
+	attributes := protocol.DecodeAttributes(encoded)
+	roomID, hasRoom := attributes[protocol.AttrRoom]
+	if !hasRoom {
+		return encoded
+	}
+
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomID]
+	server.Mutex.Unlock()
+
+	member := false
+	if exists {
+		room.Mutex.RLock()
+		_, senderIn := room.Members[sender.UserId]
+		_, recipientIn := room.Members[recipient.UserId]
+		room.Mutex.RUnlock()
+		member = senderIn && recipientIn
+	}
+	if !member {
+		fmt.Printf("Dropping room %s from offer by %s: not shared with %s\n", roomID, sender.Username, recipient.Username)
+		delete(attributes, protocol.AttrRoom)
+	}
+	return protocol.EncodeAttributes(attributes)
+}
+
+// HandleTransferAnswer forwards the recipient's "/TRANSFER_ACCEPT" or
+// "/TRANSFER_DECLINE" to the sender. A declined transfer is dropped.
+func HandleTransferAnswer(server *interfaces.Server, user *interfaces.User, command, token string) {
+	forwardToSender(server, user, token, "answer", fmt.Sprintf("%s %s", command, token))
+	if command == "/TRANSFER_DECLINE" {
+		CancelTransfer(server, user, token)
+	}
+}
+
+// HandleTransferPath records how the recipient reached the sender. A direct
+// transfer is only remembered so signals pass between its two sides until it
+// is done; for the relay we tell the sender to open its data connection to
+// the server as well.
+func HandleTransferPath(server *interfaces.Server, user *interfaces.User, token, path string) {
+	server.Mutex.Lock()
+	transfer, exists := server.Transfers[token]
+	server.Mutex.Unlock()
+
+	if !exists || transfer.Recipient != user {
+		fmt.Printf("Ignoring transfer path for unknown transfer %s from %s\n", token, user.Username)
+		return
+	}
+
+	switch path {
+	case protocol.PathDirect:
+		removePendingTransfer(server, token)
+		server.Mutex.Lock()
+		server.Direct[token] = transfer
+		server.Mutex.Unlock()
+		fmt.Printf("Transfer %s '%s' is going direct from %s to %s\n",
+			token, transfer.Name, transfer.Sender.Username, transfer.Recipient.Username)
+	case protocol.PathRelay:
+		err := protocol.SendCommand(transfer.Sender.Conn, fmt.Sprintf("/TRANSFER_PATH %s %s", token, protocol.PathRelay))
+		if err != nil {
+			fmt.Printf("Error asking %s to use the relay: %v\n", transfer.Sender.Username, err)
+			removePendingTransfer(server, token)
+		}
+	default:
+		fmt.Printf("Invalid transfer path %q from %s\n", path, user.Username)
+	}
+}
+
+// HandleTransferDone forgets a direct transfer once either side reports
+// "/TRANSFER_DONE" for it. Its bytes never pass the server, so this is the
+// only way to know it ended while both users stay online.
+func HandleTransferDone(server *interfaces.Server, user *interfaces.User, token string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if transfer, exists := server.Direct[token]; exists && (transfer.Sender == user || transfer.Recipient == user) {
+		delete(server.Direct, token)
+	}
+}
+
+// HandleTransferKey forwards the recipient's public key to the sender. We
+// only pass keys along; the derived key never exists on the server.
+func HandleTransferKey(server *interfaces.Server, user *interfaces.User, token, publicKey string) {
+	forwardToSender(server, user, token, "transfer key", fmt.Sprintf("/TRANSFER_KEY %s %s", token, publicKey))
+}
+
+// HandleTransferOffset forwards the recipient's resume offer to the sender
+func HandleTransferOffset(server *interfaces.Server, user *interfaces.User, offer protocol.ResumeOffer) {
+	forwardToSender(server, user, offer.Token, "resume offer", offer.Encode())
+}
+
+// forwardToSender passes a command from the recipient of a transfer on to
+// its sender. The data connections may already have been paired, since they
+// race with the control connection.
+func forwardToSender(server *interfaces.Server, user *interfaces.User, token, what, command string) {
+	server.Mutex.Lock()
+	transfer, exists := server.Transfers[token]
+	if !exists {
+		transfer, exists = server.Relays[token]
+	}
+	server.Mutex.Unlock()
+
+	if !exists || transfer.Recipient != user {
+		fmt.Printf("Ignoring %s for unknown transfer %s from %s\n", what, token, user.Username)
+		return
+	}
+
+	err := protocol.SendCommand(transfer.Sender.Conn, command)
+	if err != nil {
+		fmt.Printf("Error forwarding %s to %s: %v\n", what, transfer.Sender.Username, err)
+		removePendingTransfer(server, token)
+	}
+}
+
+// HandleTransferSignal passes a "/TRANSFER_PAUSE", "/TRANSFER_RESUME" or
+// "/TRANSFER_CANCEL" on to the peer as "<command> <fromId> <token>". Signals
+// are only passed on between the two sides of a transfer the server
+// brokered; a cancel also stops it here.
+func HandleTransferSignal(server *interfaces.Server, user *interfaces.User, command, peerId, token string) {
+	server.Mutex.Lock()
+	peer, exists := server.Connections[peerId]
+	transfer, known := findTransfer(server, token)
+	server.Mutex.Unlock()
+
+	if !known || !betweenUsers(transfer, user, peer) {
+		fmt.Printf("Ignoring %s for unknown transfer %s from %s\n", command, token, user.Username)
+		return
+	}
+	if command == "/TRANSFER_CANCEL" {
+		CancelTransfer(server, user, token)
+	}
+	if !exists || !peer.IsOnline {
+		protocol.SendChat(user.Conn, fmt.Sprintf("User %s is not online", peerId))
+		return
+	}
+
+	err := protocol.SendCommand(peer.Conn, fmt.Sprintf("%s %s %s", command, user.UserId, token))
+	if err != nil {
+		fmt.Printf("Error forwarding %s to %s: %v\n", command, peer.Username, err)
+	}
+}
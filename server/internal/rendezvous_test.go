@@ -0,0 +1,138 @@
+package connection
+
+import (
+	"bytes"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"net"
+	"strings"
+	"testing"
+)
+
+// recordingConn keeps the commands written to it
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+// commands returns the commands and chat lines written so far
+func (c *recordingConn) commands() []string {
+	var lines []string
+	for {
+		frame, err := protocol.ReadFrame(&c.written)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, string(frame.Payload))
+	}
+}
+
+func newTestUser(server *interfaces.Server, id string) (*interfaces.User, *recordingConn) {
+	conn := &recordingConn{}
+	user := &interfaces.User{UserId: id, Username: "user" + id, Conn: conn, IsOnline: true}
+	server.Connections[id] = user
+	return user, conn
+}
+
+func TestHandleTransferSignalChecksPeers(t *testing.T) {
+	server := newTestServer(nil)
+	sender, _ := newTestUser(server, "1")
+	recipient, recipientConn := newTestUser(server, "2")
+	stranger, _ := newTestUser(server, "3")
+	_, thirdConn := newTestUser(server, "4")
+
+	server.Transfers["pending"] = &interfaces.Transfer{Token: "pending", Sender: sender, Recipient: recipient}
+	server.Relays["relayed"] = &interfaces.Transfer{Token: "relayed", Sender: sender, Recipient: recipient,
+		SenderData: &recordingConn{}, RecipientData: &recordingConn{}}
+	server.Direct["direct"] = &interfaces.Transfer{Token: "direct", Sender: sender, Recipient: recipient}
+
+	for _, command := range []string{"/TRANSFER_PAUSE", "/TRANSFER_RESUME", "/TRANSFER_CANCEL"} {
+		for _, token := range []string{"pending", "relayed", "direct"} {
+			HandleTransferSignal(server, sender, command, "2", token)
+		}
+		// Neither someone outside the transfer nor a made up one gets through
+		HandleTransferSignal(server, stranger, command, "2", "direct")
+		HandleTransferSignal(server, sender, command, "2", "unknown")
+		HandleTransferSignal(server, sender, command, "4", "direct")
+	}
+
+	want := []string{
+		"/TRANSFER_PAUSE 1 pending", "/TRANSFER_PAUSE 1 relayed", "/TRANSFER_PAUSE 1 direct",
+		"/TRANSFER_RESUME 1 pending", "/TRANSFER_RESUME 1 relayed", "/TRANSFER_RESUME 1 direct",
+		"/TRANSFER_CANCEL 1 pending", "/TRANSFER_CANCEL 1 relayed", "/TRANSFER_CANCEL 1 direct",
+	}
+	if got := recipientConn.commands(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("recipient got %q, want %q", got, want)
+	}
+	if got := thirdConn.commands(); len(got) != 0 {
+		t.Errorf("a user outside the transfer got %q", got)
+	}
+}
+
+func TestCancelSignalStopsTransfer(t *testing.T) {
+	server := newTestServer(nil)
+	sender, _ := newTestUser(server, "1")
+	recipient, _ := newTestUser(server, "2")
+	stranger, _ := newTestUser(server, "3")
+	server.Transfers["pending"] = &interfaces.Transfer{Token: "pending", Sender: sender, Recipient: recipient}
+	server.Direct["direct"] = &interfaces.Transfer{Token: "direct", Sender: sender, Recipient: recipient}
+
+	HandleTransferSignal(server, stranger, "/TRANSFER_CANCEL", "2", "pending")
+	HandleTransferSignal(server, stranger, "/TRANSFER_CANCEL", "1", "direct")
+	if len(server.Transfers) != 1 || len(server.Direct) != 1 {
+		t.Fatal("a user outside the transfers cancelled them")
+	}
+
+	HandleTransferSignal(server, recipient, "/TRANSFER_CANCEL", "1", "pending")
+	HandleTransferSignal(server, sender, "/TRANSFER_CANCEL", "2", "direct")
+	if len(server.Transfers) != 0 || len(server.Direct) != 0 {
+		t.Errorf("cancelled transfers are still known: %v %v", server.Transfers, server.Direct)
+	}
+}
+
+func TestDropTransfersForgetsDirect(t *testing.T) {
+	server := newTestServer(nil)
+	sender, _ := newTestUser(server, "1")
+	recipient, _ := newTestUser(server, "2")
+	other, _ := newTestUser(server, "3")
+	server.Direct["mine"] = &interfaces.Transfer{Token: "mine", Sender: sender, Recipient: recipient}
+	server.Direct["theirs"] = &interfaces.Transfer{Token: "theirs", Sender: other, Recipient: recipient}
+
+	DropTransfers(server, sender)
+	if _, exists := server.Direct["mine"]; exists {
+		t.Error("a direct transfer outlived its sender")
+	}
+	if _, exists := server.Direct["theirs"]; !exists {
+		t.Error("a direct transfer of other users was dropped")
+	}
+}
+
+func TestTransferDoneForgetsDirect(t *testing.T) {
+	server := newTestServer(nil)
+	sender, _ := newTestUser(server, "1")
+	recipient, _ := newTestUser(server, "2")
+	stranger, _ := newTestUser(server, "3")
+	server.Direct["first"] = &interfaces.Transfer{Token: "first", Sender: sender, Recipient: recipient}
+	server.Direct["second"] = &interfaces.Transfer{Token: "second", Sender: sender, Recipient: recipient}
+	server.Transfers["pending"] = &interfaces.Transfer{Token: "pending", Sender: sender, Recipient: recipient}
+
+	HandleTransferDone(server, stranger, "first")
+	HandleTransferDone(server, sender, "pending")
+	if len(server.Direct) != 2 || len(server.Transfers) != 1 {
+		t.Fatal("a done report from outside a direct transfer dropped a transfer")
+	}
+
+	HandleTransferDone(server, recipient, "first")
+	HandleTransferDone(server, sender, "second")
+	if len(server.Direct) != 0 {
+		t.Errorf("finished direct transfers are still known: %v", server.Direct)
+	}
+}
@@ -0,0 +1,108 @@
+package connection
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sessionLifetime is how long an unused session token stays valid
+const sessionLifetime = 30 * 24 * time.Hour
+
+var errSessionExpired = errors.New("session expired, please log in again")
+
+// hashSessionToken is the key a token is stored under, so a leaked session
+// table cannot be replayed
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueSession creates a new resume token for the account
+func issueSession(server *interfaces.Server, account *interfaces.Account) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	key := hashSessionToken(token)
+	session := &interfaces.Session{
+		Username:  account.Username,
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	}
+
+	server.Mutex.Lock()
+	server.Sessions[key] = session
+	server.Mutex.Unlock()
+	saveSession(server, key)
+	return token, nil
+}
+
+// resumeSession returns the account a token belongs to. Every token is good
+// for one reconnect only: it is consumed here and the caller issues a new one.
+func resumeSession(server *interfaces.Server, token string) (*interfaces.Account, error) {
+	key := hashSessionToken(token)
+
+	server.Mutex.Lock()
+	session, exists := server.Sessions[key]
+	if !exists {
+		server.Mutex.Unlock()
+		return nil, errSessionExpired
+	}
+	delete(server.Sessions, key)
+	account, exists := server.Accounts[session.Username]
+	server.Mutex.Unlock()
+	saveSession(server, key)
+
+	if !exists || time.Now().After(session.ExpiresAt) {
+		return nil, errSessionExpired
+	}
+	return account, nil
+}
+
+// revokeSession forgets a token of the given user, as on /logout
+func revokeSession(server *interfaces.Server, user *interfaces.User, token string) {
+	key := hashSessionToken(token)
+
+	server.Mutex.Lock()
+	session, exists := server.Sessions[key]
+	revoked := exists && session.Username == user.Username
+	if revoked {
+		delete(server.Sessions, key)
+	}
+	server.Mutex.Unlock()
+	if revoked {
+		saveSession(server, key)
+	}
+}
+
+// restoreRoom puts a returning user back into the room they were in, if
+// they are still a member of it
+func restoreRoom(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	room, exists := server.Rooms[user.CurrentRoomID]
+	member := false
+	if exists {
+		room.Mutex.RLock()
+		_, member = room.Members[user.UserId]
+		room.Mutex.RUnlock()
+	}
+	cleared := !member && user.CurrentRoomID != ""
+	if cleared {
+		user.CurrentRoomID = ""
+	}
+	server.Mutex.Unlock()
+	if cleared {
+		saveUser(server, user.UserId)
+	}
+
+	if member {
+		protocol.SendCommand(user.Conn, fmt.Sprintf("ROOM_JOINED %s %s", room.ID, room.Name))
+	}
+}
@@ -0,0 +1,97 @@
+package connection
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"drizlink/helper"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LoadTLSConfig builds the server TLS configuration. Without an explicit
+// certificate and key a self-signed certificate is generated once and kept in
+// the DrizLink config directory, so its fingerprint stays stable across
+// restarts and clients that pinned it keep trusting it.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		dir, err := helper.ConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate config directory: %v", err)
+		}
+		certFile = filepath.Join(dir, "server-cert.pem")
+		keyFile = filepath.Join(dir, "server-key.pem")
+
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			if err := generateSelfSignedCertificate(certFile, keyFile); err != nil {
+				return nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+			}
+		}
+	} else if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both --cert and --key are required when one is given")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// TLSFingerprint returns the fingerprint clients will pin for this configuration
+func TLSFingerprint(config *tls.Config) string {
+	if config == nil || len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	return helper.CertificateFingerprint(config.Certificates[0].Certificate[0])
+}
+
+// generateSelfSignedCertificate writes a new ECDSA key and a ten year self-signed certificate
+func generateSelfSignedCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"DrizLink"}, CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
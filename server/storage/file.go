@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"drizlink/server/interfaces"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileStore keeps the server state in a single JSON file. Every change
+// rewrites the file through a temporary file and a rename, so a crash never
+// leaves a half-written state behind.
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewFileStore opens the state file at path, creating it on first change
+func NewFileStore(path string) (*FileStore, error) {
+	store := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &store.state); err != nil {
+			return nil, fmt.Errorf("corrupt state file %s: %v", path, err)
+		}
+		// Older files may lack some sections
+		fresh := emptyState()
+		if store.state.Accounts == nil {
+			store.state.Accounts = fresh.Accounts
+		}
+		if store.state.Sessions == nil {
+			store.state.Sessions = fresh.Sessions
+		}
+		if store.state.Users == nil {
+			store.state.Users = fresh.Users
+		}
+		if store.state.Rooms == nil {
+			store.state.Rooms = fresh.Rooms
+		}
+		if store.state.Settings == nil {
+			store.state.Settings = fresh.Settings
+		}
+		if store.state.Queues == nil {
+			store.state.Queues = fresh.Queues
+		}
+	}
+
+	store.flush = store.write
+	return store, nil
+}
+
+func (s *FileStore) write(state *interfaces.State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"drizlink/server/interfaces"
+	"sync"
+)
+
+// MemoryStore keeps the server state in memory only. It is meant for tests
+// and for servers that should start fresh every time.
+type MemoryStore struct {
+	mutex sync.Mutex
+	state interfaces.State
+	// flush is called after every change while the lock is held; FileStore
+	// uses it to write the state to disk
+	flush func(state *interfaces.State) error
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: emptyState()}
+}
+
+func emptyState() interfaces.State {
+	return interfaces.State{
+		Accounts: make(map[string]interfaces.Account),
+		Sessions: make(map[string]interfaces.Session),
+		Users:    make(map[string]interfaces.UserRecord),
+		Rooms:    make(map[string]interfaces.RoomRecord),
+		Settings: make(map[string]string),
+		Queues:   make(map[string][]interfaces.Message),
+	}
+}
+
+// Load returns a copy of the stored state
+func (s *MemoryStore) Load() (*interfaces.State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := emptyState()
+	for k, v := range s.state.Accounts {
+		state.Accounts[k] = v
+	}
+	for k, v := range s.state.Sessions {
+		state.Sessions[k] = v
+	}
+	for k, v := range s.state.Users {
+		state.Users[k] = v
+	}
+	for k, v := range s.state.Rooms {
+		v.Members = append([]string(nil), v.Members...)
+		state.Rooms[k] = v
+	}
+	for k, v := range s.state.Settings {
+		state.Settings[k] = v
+	}
+	for k, v := range s.state.Queues {
+		state.Queues[k] = append([]interfaces.Message(nil), v...)
+	}
+	return &state, nil
+}
+
+// SaveAccount stores or replaces an account, keyed by username
+func (s *MemoryStore) SaveAccount(account interfaces.Account) error {
+	return s.update(func(state *interfaces.State) {
+		state.Accounts[account.Username] = account
+	})
+}
+
+// SaveSession stores a session under the hash of its token
+func (s *MemoryStore) SaveSession(key string, session interfaces.Session) error {
+	return s.update(func(state *interfaces.State) {
+		state.Sessions[key] = session
+	})
+}
+
+// DeleteSession forgets a session
+func (s *MemoryStore) DeleteSession(key string) error {
+	return s.update(func(state *interfaces.State) {
+		delete(state.Sessions, key)
+	})
+}
+
+// SaveUser stores or replaces a user, keyed by user ID
+func (s *MemoryStore) SaveUser(user interfaces.UserRecord) error {
+	return s.update(func(state *interfaces.State) {
+		state.Users[user.UserId] = user
+	})
+}
+
+// SaveRoom stores or replaces a room with its members
+func (s *MemoryStore) SaveRoom(room interfaces.RoomRecord) error {
+	room.Members = append([]string(nil), room.Members...)
+	return s.update(func(state *interfaces.State) {
+		state.Rooms[room.ID] = room
+	})
+}
+
+// SaveSetting stores a server setting
+func (s *MemoryStore) SaveSetting(key, value string) error {
+	return s.update(func(state *interfaces.State) {
+		state.Settings[key] = value
+	})
+}
+
+// SaveQueues replaces the messages waiting for each of the given offline
+// users in one change; an empty queue is removed
+func (s *MemoryStore) SaveQueues(queues map[string][]interfaces.Message) error {
+	copies := make(map[string][]interfaces.Message, len(queues))
+	for userId, messages := range queues {
+		copies[userId] = append([]interfaces.Message(nil), messages...)
+	}
+	return s.update(func(state *interfaces.State) {
+		for userId, messages := range copies {
+			if len(messages) == 0 {
+				delete(state.Queues, userId)
+			} else {
+				state.Queues[userId] = messages
+			}
+		}
+	})
+}
+
+// Close releases the store; a memory store has nothing to release
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) update(change func(state *interfaces.State)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	change(&s.state)
+	if s.flush != nil {
+		return s.flush(&s.state)
+	}
+	return nil
+}
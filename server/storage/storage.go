@@ -0,0 +1,20 @@
+// Package storage holds the backends that persist server state between runs
+package storage
+
+import (
+	"drizlink/server/interfaces"
+	"fmt"
+)
+
+// Open returns the store of the given kind: "file" for the on-disk JSON
+// store at path, or "memory" for a store that forgets everything on exit
+func Open(kind, path string) (interfaces.Store, error) {
+	switch kind {
+	case "file":
+		return NewFileStore(path)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q, use file or memory", kind)
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"drizlink/server/interfaces"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stores runs a test against every backend. reopen returns the store a
+// restarted server would get.
+func stores(t *testing.T, test func(t *testing.T, store interfaces.Store, reopen func() interfaces.Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore(), func() interfaces.Store { return NewMemoryStore() })
+	})
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		open := func() interfaces.Store {
+			store, err := NewFileStore(path)
+			if err != nil {
+				t.Fatalf("NewFileStore: %v", err)
+			}
+			return store
+		}
+		test(t, open(), open)
+	})
+}
+
+// fill saves one of everything and returns the state it should load as
+func fill(t *testing.T, store interfaces.Store) *interfaces.State {
+	t.Helper()
+	want := emptyState()
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	account := interfaces.Account{Username: "alice", PasswordHash: "pbkdf2-sha256$1$aa$bb", UserId: "42", CreatedAt: created}
+	session := interfaces.Session{Username: "alice", ExpiresAt: created.Add(time.Hour)}
+	user := interfaces.UserRecord{UserId: "42", Username: "alice", StoreFilePath: "/shared", CurrentRoomID: "room_1"}
+	room := interfaces.RoomRecord{ID: "room_1", Name: "team", CreatedBy: "42", CreatedAt: "2026-01-02 03:04:05", Members: []string{"42", "7"}}
+	queue := []interfaces.Message{
+		{SenderId: "7", SenderUsername: "bob", Content: "hi", Timestamp: created.Format(time.RFC3339)},
+		{SenderId: "7", SenderUsername: "bob", Content: "there", Timestamp: created.Format(time.RFC3339), Direct: true},
+	}
+
+	for _, err := range []error{
+		store.SaveAccount(account),
+		store.SaveSession("token-hash", session),
+		store.SaveSession("gone", session),
+		store.DeleteSession("gone"),
+		store.SaveUser(user),
+		store.SaveRoom(room),
+		store.SaveSetting("message_retention", "24h"),
+		store.SaveQueues(map[string][]interfaces.Message{"42": queue, "7": queue}),
+		store.SaveQueues(map[string][]interfaces.Message{"7": nil}),
+	} {
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	want.Accounts["alice"] = account
+	want.Sessions["token-hash"] = session
+	want.Users["42"] = user
+	want.Rooms["room_1"] = room
+	want.Settings["message_retention"] = "24h"
+	want.Queues["42"] = queue
+	return &want
+}
+
+func load(t *testing.T, store interfaces.Store) *interfaces.State {
+	t.Helper()
+	state, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return state
+}
+
+func TestStoreSaveAndLoad(t *testing.T) {
+	stores(t, func(t *testing.T, store interfaces.Store, _ func() interfaces.Store) {
+		want := fill(t, store)
+		if got := load(t, store); !reflect.DeepEqual(got, want) {
+			t.Errorf("Load = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestStoreLoadReturnsCopy(t *testing.T) {
+	stores(t, func(t *testing.T, store interfaces.Store, _ func() interfaces.Store) {
+		want := fill(t, store)
+
+		state := load(t, store)
+		state.Rooms["room_1"].Members[0] = "changed"
+		state.Queues["42"][0].Content = "changed"
+		delete(state.Accounts, "alice")
+
+		if got := load(t, store); !reflect.DeepEqual(got, want) {
+			t.Errorf("changing a loaded state changed the store: %+v", got)
+		}
+	})
+}
+
+func TestStoreReplaces(t *testing.T) {
+	stores(t, func(t *testing.T, store interfaces.Store, _ func() interfaces.Store) {
+		fill(t, store)
+		room := interfaces.RoomRecord{ID: "room_1", Name: "renamed", Members: []string{"42"}}
+		if err := store.SaveRoom(room); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveSetting("message_retention", "0s"); err != nil {
+			t.Fatal(err)
+		}
+
+		state := load(t, store)
+		if got := state.Rooms["room_1"]; !reflect.DeepEqual(got, room) {
+			t.Errorf("room = %+v, want %+v", got, room)
+		}
+		if got := state.Settings["message_retention"]; got != "0s" {
+			t.Errorf("setting = %q, want 0s", got)
+		}
+	})
+}
+
+func TestStoreRestart(t *testing.T) {
+	stores(t, func(t *testing.T, store interfaces.Store, reopen func() interfaces.Store) {
+		want := fill(t, store)
+		if err := store.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		got := load(t, reopen())
+		if _, memory := store.(*MemoryStore); memory {
+			// A memory store starts fresh every time
+			empty := emptyState()
+			want = &empty
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("after restart Load = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestFileStoreOlderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"Settings": {"message_retention": "1h"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	// Sections missing from the file must still be usable
+	if err := store.SaveAccount(interfaces.Account{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveQueues(map[string][]interfaces.Message{"42": {{Content: "hi"}}}); err != nil {
+		t.Fatal(err)
+	}
+	state := load(t, store)
+	if state.Settings["message_retention"] != "1h" || len(state.Accounts) != 1 || len(state.Queues) != 1 {
+		t.Errorf("Load = %+v", state)
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Error("NewFileStore accepted a corrupt file")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if store, err := Open("memory", ""); err != nil {
+		t.Errorf("Open(memory): %v", err)
+	} else if _, ok := store.(*MemoryStore); !ok {
+		t.Errorf("Open(memory) = %T", store)
+	}
+	if _, err := Open("file", filepath.Join(t.TempDir(), "state.json")); err != nil {
+		t.Errorf("Open(file): %v", err)
+	}
+	if _, err := Open("redis", ""); err == nil {
+		t.Error("Open accepted an unknown store")
+	}
+}
@@ -61,10 +61,8 @@ func (pb *ProgressBar) Write(p []byte) (n int, err error) {
 	pb.Mutex.Lock()
 	defer pb.Mutex.Unlock()
 	
-	if pb.IsPaused {
-		return len(p), nil
-	}
-	
+	// Bytes still in flight when a transfer is paused are counted too, so
+	// the bar ends at the real total
 	return pb.Bar.Write(p)
 }
 
@@ -82,6 +80,14 @@ func (pb *ProgressBar) SetPaused(paused bool) {
 	}
 }
 
+// SetProgress moves the bar to n bytes, e.g. when a transfer resumes part way
+func (pb *ProgressBar) SetProgress(n int64) {
+	pb.Mutex.Lock()
+	defer pb.Mutex.Unlock()
+
+	pb.Bar.Set64(n)
+}
+
 func (pb *ProgressBar) GetTransferId() string {
 	return pb.TransferId
 }
@@ -102,8 +108,10 @@ func PrintHelp() {
 	
 	fmt.Println(HeaderColor("\n🌐 General Commands:"))
 	fmt.Printf("  %s - Show online users\n", CommandColor("/status"))
+	fmt.Printf("  %s - Send a private message, delivered later if they are offline\n", CommandColor("/msg <userId> <message>"))
 	fmt.Printf("  %s - Show this help message\n", CommandColor("/help"))
 	fmt.Printf("  %s - Disconnect and exit\n", CommandColor("exit"))
+	fmt.Printf("  %s - Forget this device's saved session and exit\n", CommandColor("/logout"))
 	
 	fmt.Println(HeaderColor("\n🏠 Room Commands:"))
 	fmt.Printf("  %s - Create a new room with selected users\n", CommandColor("/createroom"))
@@ -121,6 +129,14 @@ func PrintHelp() {
 	fmt.Printf("  %s - Show all active transfers\n", CommandColor("/transfers"))
 	fmt.Printf("  %s - Pause an active transfer\n", CommandColor("/pause <transferId>"))
 	fmt.Printf("  %s - Resume a paused transfer\n", CommandColor("/resume <transferId>"))
+	fmt.Printf("  %s - Cancel a transfer\n", CommandColor("/cancel <transferId>"))
+	fmt.Printf("  %s - Show finished transfers\n", CommandColor("/history [peer <id>] [status <status>] [since <date>] [until <date>]"))
+	fmt.Printf("  %s - Send a history entry again, or ask for it again\n", CommandColor("/history retry <number>"))
+	fmt.Printf("  %s - Show the send queue, or reorder, hold or release a queued send\n", CommandColor("/queue [max <n> | front|hold|release <id> | priority <id> high|normal|low]"))
+	fmt.Printf("  %s - Show or change bandwidth limits (e.g. 2MB, off)\n", CommandColor("/limit [<transferId>|default <rate>]"))
+	fmt.Printf("  %s - Receive an offered file or folder\n", CommandColor("/accept <transferId> [rename|overwrite]"))
+	fmt.Printf("  %s - Refuse an offered file or folder\n", CommandColor("/decline <transferId>"))
+	fmt.Printf("  %s - List or change auto-accept rules\n", CommandColor("/autoaccept [user|room <id> | size <limit> | remove user|room <id>]"))
 	
 	fmt.Println(InfoColor("------------------------------------------------"))
 	fmt.Println(InfoColor("Type a message and press Enter to send to current room or everyone\n"))